@@ -12,6 +12,8 @@ policies for more information.
 // related to implementing our k-DHT protocol.
 package kdht
 
+import "cse586.kdht/given/keys"
+
 // The following error values are defined here so that they can be
 // used with errors.Is().  If you want to provide more detailed
 // information, look at fmt.Errorf() and %w.
@@ -31,6 +33,43 @@ var ValueError = &kError{"The value could not be found"}
 
 var InvalidNodeError = &kError{"The node does not exist"}
 
+// The following errors indicate that a remote node rejected a request
+// by replying with an ERROR message.  They are returned by ErrorFor(),
+// and may be wrapped with the detail string sent by the remote node.
+
+// TooLargeError indicates that a value was too large to be stored.
+var TooLargeError = &kError{"The value is too large to be stored"}
+
+// QuotaError indicates that a node has no room to store a value.
+var QuotaError = &kError{"The node has no room to store the value"}
+
+// BadRequestError indicates that a node considered a request to be
+// malformed, for example because its key is not a valid key.
+var BadRequestError = &kError{"The request was malformed"}
+
+// PeerShutdownError indicates that a remote node is shutting down and
+// will not serve requests.
+var PeerShutdownError = &kError{"The remote node is shutting down"}
+
+// VersionError indicates that a remote node speaks an incompatible
+// major protocol version.
+var VersionError = &kError{"The remote node speaks an incompatible protocol version"}
+
+// RemoteError indicates that a remote node rejected a request without
+// giving a specific reason.
+var RemoteError = &kError{"The remote node rejected the request"}
+
+// KeySpaceError indicates that a key or node ID does not have the
+// width of the keys of this node's network, such as a remote node
+// from a network using a different keys.Space.
+var KeySpaceError = &kError{"The key is not in this network's key space"}
+
+// RoutingError indicates that a routing table could not be consulted,
+// such as when the kdht-router process has exited.  The errors
+// returned by a RoutingTableV2 wrap it, and may also wrap the
+// underlying failure.
+var RoutingError = &kError{"The routing table failed"}
+
 // Node represents an instance of a k-DHT node, and the operations that
 // can be performed on that node.  If the node has been shut down, any
 // operation invoked on the node should return a ShutdownError.
@@ -40,16 +79,22 @@ type Node interface {
 	//
 	// If this node has been shut down, the node cannot be
 	// contacted, or the node does not respond to the ping, an
-	// error is returned.
-	Ping(id []byte, message []byte) error
+	// error is returned.  If the node rejects the ping, the error
+	// given by ErrorFor() is returned.
+	Ping(id keys.Key, message []byte) error
 
 	// Store stores the given value into the DHT at its address
-	// (computed as the SHA-1 sum of the value itself) by sending
+	// (computed as the hash of the value itself in the network's
+	// keys.Space, SHA-1 by default) by sending
 	// a store message to the K nodes closest to the address.
 	//
-	// If fewer than K nodes can be found to store the value,
-	// StorageError is returned (even if it was successfully
-	// stored on some nodes).
+	// If fewer than K nodes can be found to store the value, or
+	// fewer than K nodes acknowledge the store, StorageError is
+	// returned (even if it was successfully stored on some
+	// nodes).  If a node rejected the store, the returned error
+	// also wraps the error given by ErrorFor().  A value that
+	// cannot fit in a single message is refused immediately with
+	// TooLargeError.
 	Store(value []byte) error
 
 	// FindNode looks up the K nodes closest to the given node
@@ -59,7 +104,7 @@ type Node interface {
 	// than K nodes are returned.  Note that this method cannot
 	// fail if this node is active, as it can return a slice
 	// containing only  itself.
-	FindNode(id []byte) ([]*NodeInfo, error)
+	FindNode(id keys.Key) ([]*NodeInfo, error)
 
 	// FindValue retrieves the value for a given ID from the DHT.
 	// As with Kademlia, the process for FindValue is identical to
@@ -70,7 +115,24 @@ type Node interface {
 	//
 	// If the value cannot be found, ValueError is returned
 	// instead.
-	FindValue(id []byte) ([]byte, NodeInfo, error)
+	FindValue(id keys.Key) ([]byte, NodeInfo, error)
+
+	// Get sends a GET message for the given key directly to the
+	// node with the given ID, without performing a lookup.  This
+	// allows a caller to check whether a particular node holds a
+	// value.
+	//
+	// If the node responds but does not store the key, ValueError
+	// is returned.  If the node is not in the routing table,
+	// InvalidNodeError is returned.  If the node rejects the
+	// request for another reason, the error given by ErrorFor()
+	// is returned.  Any other error indicates that the node could
+	// not be contacted.
+	Get(id keys.Key, key keys.Key) ([]byte, error)
+
+	// GetAddress is identical to Get, except that the node is
+	// contacted at the given address rather than looked up by ID.
+	GetAddress(addr string, key keys.Key) ([]byte, error)
 
 	// Shutdown stops this k-DHT node.  Its listening socket is
 	// closed, and any ongoing operations stop as soon as is
@@ -121,19 +183,21 @@ type RoutingTable interface {
 	// This operation fails and returns InvalidNodeError if the
 	// node is not present in the table or local node's ID is
 	// attempted to be removed.
-	RemoveNode(key []byte) error
+	RemoveNode(key keys.Key) error
 
 	// Lookup finds a particular node in the local routing table
 	// by its ID, if it exists.  If it does not exist, nothing
 	// happens and ok is false.
-	Lookup(key []byte) (node *NodeInfo, ok bool)
+	Lookup(key keys.Key) (node *NodeInfo, ok bool)
 
 	// Retrieve the nodes stored in a numbered bucket.  Bucket 0
 	// is the bucket representing nodes that differ only in the
-	// least-significant bit, and bucket 159 is the bucket
-	// representing nodes that differ in the most-significant bit.
-	// This is the same notation used in the Kademlia paper, and
-	// the same behavior provided by given/keys.DistanceBucket().
+	// least-significant bit, and bucket b - 1, where b is the
+	// width in bits of the local node's ID, is the bucket
+	// representing nodes that differ in the most-significant bit:
+	// bucket 159 in keys.SHA1, or 255 in keys.SHA256.  This is the
+	// same notation used in the Kademlia paper, and the same
+	// behavior provided by given/keys.Key.Bucket().
 	//
 	// This operation returns nil if the specified bucket is empty.
 	GetNodes(bucket int) []*NodeInfo
@@ -144,15 +208,146 @@ type RoutingTable interface {
 	//
 	// This operation cannot fail and cannot return an empty slice
 	// because the local node is always present.
-	ClosestK(key []byte) []*NodeInfo
+	ClosestK(key keys.Key) []*NodeInfo
 
 	// Buckets returns the number of non-empty buckets in this
-	// routing table.  These buckets necessarily start with bucket
-	// number 159 and work their way down to 160 - Buckets().  The
-	// return value of this function is in 0 <= Buckets() < 160.
+	// routing table.  For a local ID of b bits, these buckets
+	// necessarily start with bucket number b - 1 and work their
+	// way down to b - Buckets(), and the return value of this
+	// function is in 0 <= Buckets() < b.  In keys.SHA1, they run
+	// from bucket 159 down to 160 - Buckets().
 	Buckets() int
 }
 
+// RoutingTableV2 is a RoutingTable whose operations can report that
+// the table itself failed, rather than answering as if it were empty.
+// Each method behaves as the RoutingTable method of the same name
+// when it returns a nil error, and returns an error wrapping
+// RoutingError when the table failed.  RemoveNode still returns
+// InvalidNodeError for a node that is not in the table, and Lookup
+// reports a node that is not in the table with ok false and a nil
+// error.
+//
+// A RoutingTable is adapted to this interface by AdaptRoutingTable.
+type RoutingTableV2 interface {
+	K() (int, error)
+	InsertNode(node *NodeInfo) error
+	RemoveNode(key keys.Key) error
+	Lookup(key keys.Key) (node *NodeInfo, ok bool, err error)
+	GetNodes(bucket int) ([]*NodeInfo, error)
+	ClosestK(key keys.Key) ([]*NodeInfo, error)
+	Buckets() (int, error)
+}
+
+// FallibleRoutingTable is implemented by RoutingTables that can
+// detect their own failures, such as the kdht-router proxy.  Fallible
+// returns the same table as a RoutingTableV2.
+type FallibleRoutingTable interface {
+	RoutingTable
+	Fallible() RoutingTableV2
+}
+
+// AdaptRoutingTable returns table as a RoutingTableV2.  If table is a
+// FallibleRoutingTable, its failures are reported; otherwise it is
+// assumed never to fail.
+func AdaptRoutingTable(table RoutingTable) RoutingTableV2 {
+	if fallible, ok := table.(FallibleRoutingTable); ok {
+		return fallible.Fallible()
+	}
+	return infallibleTable{table}
+}
+
+// infallibleTable adapts a RoutingTable that cannot fail to
+// RoutingTableV2.
+type infallibleTable struct {
+	table RoutingTable
+}
+
+func (t infallibleTable) K() (int, error) {
+	return t.table.K(), nil
+}
+
+func (t infallibleTable) InsertNode(node *NodeInfo) error {
+	t.table.InsertNode(node)
+	return nil
+}
+
+func (t infallibleTable) RemoveNode(key keys.Key) error {
+	return t.table.RemoveNode(key)
+}
+
+func (t infallibleTable) Lookup(key keys.Key) (*NodeInfo, bool, error) {
+	node, ok := t.table.Lookup(key)
+	return node, ok, nil
+}
+
+func (t infallibleTable) GetNodes(bucket int) ([]*NodeInfo, error) {
+	return t.table.GetNodes(bucket), nil
+}
+
+func (t infallibleTable) ClosestK(key keys.Key) ([]*NodeInfo, error) {
+	return t.table.ClosestK(key), nil
+}
+
+func (t infallibleTable) Buckets() (int, error) {
+	return t.table.Buckets(), nil
+}
+
+// ErrorFor returns the error corresponding to an ErrorCode received
+// in an ERROR message.  ErrorCode_NOT_FOUND maps to ValueError, so
+// that a missing key looks the same whether it was reported by a
+// remote node or discovered locally.
+func ErrorFor(code ErrorCode) error {
+	switch code {
+	case ErrorCode_NOT_FOUND:
+		return ValueError
+	case ErrorCode_TOO_LARGE:
+		return TooLargeError
+	case ErrorCode_QUOTA_EXCEEDED:
+		return QuotaError
+	case ErrorCode_BAD_REQUEST:
+		return BadRequestError
+	case ErrorCode_SHUTTING_DOWN:
+		return PeerShutdownError
+	case ErrorCode_VERSION_MISMATCH:
+		return VersionError
+	}
+	return RemoteError
+}
+
+// VersionOf returns the major and minor protocol versions advertised
+// by a node.  Nodes that predate protocol versioning advertise a zero
+// version, and are treated as version 1.0.
+func VersionOf(info *NodeInfo) (major uint32, minor uint32) {
+	version := info.GetVersion()
+	if version == 0 {
+		return 1, 0
+	}
+	return version >> 16, version & 0xffff
+}
+
+// Key returns the ID of a node as a keys.Key.  It returns
+// keys.LengthError if the ID is not the width of any keys.Space,
+// which can only happen for a NodeInfo received from the network that
+// has not been checked.  The ID may still be from a different Space
+// than the local node's.
+func (x *NodeInfo) Key() (keys.Key, error) {
+	return keys.FromBytes(x.GetId())
+}
+
+// Compatible returns true if a node advertising the given information
+// speaks the same major protocol version as this implementation.
+func Compatible(info *NodeInfo) bool {
+	major, _ := VersionOf(info)
+	return major == ProtocolMajor
+}
+
+// HasCapability returns true if a node advertises the given
+// capability.
+func HasCapability(info *NodeInfo, capability Capability) bool {
+	return info.GetCapabilities()&uint64(capability) != 0
+}
+
 // kError is an internal type that represents an error in a KDHT
 // operation.
 type kError struct {
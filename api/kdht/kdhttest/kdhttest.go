@@ -0,0 +1,510 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+// The kdhttest package is a conformance test suite for
+// implementations of kdht.Node and kdht.RoutingTable.  It checks the
+// behavior documented in api/kdht using only the interfaces
+// themselves, so that any implementation, including the kdht-router
+// proxy, can be validated the same way.
+//
+// To use it, call TestRoutingTable or TestNode from an ordinary test
+// with a constructor for the implementation:
+//
+//	func TestConformance(t *testing.T) {
+//		kdhttest.TestRoutingTable(t, router.New)
+//	}
+package kdhttest
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// NewRoutingTable creates a routing table for node with the given k.
+type NewRoutingTable func(node *kdht.NodeInfo, k int) (kdht.RoutingTable, error)
+
+// NewNode creates a node with the given ID that listens on addr and
+// bootstraps from neighbors.
+type NewNode func(id keys.Key, addr string, k int, alpha int, neighbors []string) (kdht.Node, error)
+
+// seed makes the random IDs used by the suite the same on every run.
+const seed = 586
+
+// inserts is the number of random nodes inserted into the tables
+// that are checked against the routing table invariants.
+const inserts = 200
+
+// settleTime bounds how long nodes may take to learn of each other.
+const settleTime = 5 * time.Second
+
+// TestRoutingTable runs the routing table conformance tests against
+// tables created by newTable.
+func TestRoutingTable(t *testing.T, newTable NewRoutingTable) {
+	t.Run("Empty", func(t *testing.T) { testEmpty(t, newTable) })
+	t.Run("Remove", func(t *testing.T) { testRemove(t, newTable) })
+	t.Run("Invariants", func(t *testing.T) {
+		for _, k := range []int{1, 2, 3, 8, 20} {
+			t.Run(fmt.Sprintf("K%v", k), func(t *testing.T) { testInvariants(t, newTable, k, keys.Default) })
+		}
+	})
+}
+
+// TestRoutingTableSpace runs the routing table invariant tests
+// against tables created by newTable for a local node with an ID in
+// space, and checks that nodes with IDs of any other width are never
+// inserted.
+func TestRoutingTableSpace(t *testing.T, newTable NewRoutingTable, space *keys.Space) {
+	t.Run("Invariants", func(t *testing.T) { testInvariants(t, newTable, 3, space) })
+	t.Run("Foreign", func(t *testing.T) {
+		rng := rand.New(rand.NewSource(seed))
+		table, self := makeTable(t, newTable, randomIn(rng, space.Size()), 3)
+		for _, size := range []int{keys.SHA1.Size(), keys.SHA256.Size()} {
+			if size == space.Size() {
+				continue
+			}
+			node := &kdht.NodeInfo{Id: randomIn(rng, size).Bytes(), Address: "foreign"}
+			table.InsertNode(node)
+			if _, ok := table.Lookup(idOf(node)); ok {
+				t.Errorf("a node with a %v-byte ID was inserted into a %v table", size, space)
+			}
+		}
+		checkTable(t, table, self, []*kdht.NodeInfo{self})
+	})
+}
+
+// makeTable creates a table for a node with the given ID, failing the
+// test if it cannot be created.
+func makeTable(t *testing.T, newTable NewRoutingTable, id keys.Key, k int) (kdht.RoutingTable, *kdht.NodeInfo) {
+	t.Helper()
+	self := &kdht.NodeInfo{Id: id.Bytes(), Address: "self"}
+	table, err := newTable(self, k)
+	if err != nil || table == nil {
+		t.Fatalf("(routing table creation failed) %v", err)
+	}
+	return table, self
+}
+
+func testEmpty(t *testing.T, newTable NewRoutingTable) {
+	rng := rand.New(rand.NewSource(seed))
+	table, self := makeTable(t, newTable, randomID(rng), 3)
+
+	if table.K() != 3 {
+		t.Errorf("table with k = 3 had k = %v", table.K())
+	}
+	if table.Buckets() != 1 {
+		t.Errorf("empty table had %v buckets instead of 1", table.Buckets())
+	}
+	if node, ok := table.Lookup(idOf(self)); !ok || !bytes.Equal(node.Id, self.Id) {
+		t.Errorf("could not look up the local node: %v %v", ok, node)
+	}
+	if _, ok := table.Lookup(randomID(rng)); ok {
+		t.Errorf("lookup of an unknown node succeeded")
+	}
+
+	closest := table.ClosestK(randomID(rng))
+	if len(closest) != 1 || !bytes.Equal(closest[0].Id, self.Id) {
+		t.Errorf("ClosestK of an empty table was not the local node: %v", closest)
+	}
+	checkTable(t, table, self, []*kdht.NodeInfo{self})
+}
+
+func testRemove(t *testing.T, newTable NewRoutingTable) {
+	rng := rand.New(rand.NewSource(seed))
+	table, self := makeTable(t, newTable, randomID(rng), 3)
+
+	if err := table.RemoveNode(idOf(self)); !errors.Is(err, kdht.InvalidNodeError) {
+		t.Errorf("removing the local node returned %v instead of InvalidNodeError", err)
+	}
+	if err := table.RemoveNode(randomID(rng)); !errors.Is(err, kdht.InvalidNodeError) {
+		t.Errorf("removing an unknown node returned %v instead of InvalidNodeError", err)
+	}
+
+	node := &kdht.NodeInfo{Id: randomID(rng).Bytes(), Address: "node"}
+	table.InsertNode(node)
+	if act, ok := table.Lookup(idOf(node)); !ok || !bytes.Equal(act.Id, node.Id) || act.Address != node.Address {
+		t.Fatalf("could not look up an inserted node: %v %v", ok, act)
+	}
+	if err := table.RemoveNode(idOf(node)); err != nil {
+		t.Fatalf("(removing an inserted node failed) %v", err)
+	}
+	if _, ok := table.Lookup(idOf(node)); ok {
+		t.Errorf("lookup of a removed node succeeded")
+	}
+	if err := table.RemoveNode(idOf(node)); !errors.Is(err, kdht.InvalidNodeError) {
+		t.Errorf("removing a node twice returned %v instead of InvalidNodeError", err)
+	}
+	if _, ok := table.Lookup(idOf(self)); !ok {
+		t.Errorf("the local node was lost")
+	}
+}
+
+// testInvariants fills a table with random nodes, and nodes that
+// share long prefixes with the local node, and checks the table's
+// structure and every ClosestK after each batch of insertions and
+// removals.
+func testInvariants(t *testing.T, newTable NewRoutingTable, k int, space *keys.Space) {
+	rng := rand.New(rand.NewSource(seed + int64(k)))
+	table, self := makeTable(t, newTable, randomIn(rng, space.Size()), k)
+
+	present := []*kdht.NodeInfo{self}
+	for i := 0; i < inserts; i++ {
+		id := randomIn(rng, space.Size())
+		if i%2 == 1 {
+			// Share a prefix with the local node, to fill the
+			// buckets closest to it
+			id = nearID(rng, idOf(self))
+		}
+		node := &kdht.NodeInfo{Id: id.Bytes(), Address: fmt.Sprintf("node%v", i)}
+		table.InsertNode(node)
+		if _, ok := table.Lookup(id); ok {
+			present = append(present, node)
+		}
+
+		if i%20 == 19 {
+			// Remove a random node other than the local node
+			victim := present[1+rng.Intn(len(present)-1)]
+			if err := table.RemoveNode(idOf(victim)); err != nil {
+				t.Fatalf("(removing a present node failed) %v", err)
+			}
+			present = removeID(present, idOf(victim))
+		}
+
+		if i%10 == 9 {
+			checkTable(t, table, self, present)
+		}
+	}
+}
+
+// checkTable checks that the nodes in the buckets of a table are
+// exactly the expected nodes, that the buckets obey the documented
+// bounds, and that ClosestK agrees with a brute-force search.
+func checkTable(t *testing.T, table kdht.RoutingTable, self *kdht.NodeInfo, expected []*kdht.NodeInfo) {
+	t.Helper()
+
+	bits := idOf(self).Bits()
+	buckets := table.Buckets()
+	if buckets < 1 || buckets >= bits {
+		t.Fatalf("Buckets() returned %v, out of range", buckets)
+	}
+	last := bits - buckets
+
+	var all []*kdht.NodeInfo
+	for b := -1; b <= bits; b++ {
+		nodes := table.GetNodes(b)
+		if b < last || b >= bits {
+			if nodes != nil {
+				t.Fatalf("bucket %v of a table with %v buckets is not nil: %v", b, buckets, nodes)
+			}
+			continue
+		}
+		if b == last && len(nodes) == 0 {
+			t.Fatalf("the last bucket of a table with %v buckets is empty", buckets)
+		}
+		if len(nodes) > table.K() {
+			t.Fatalf("bucket %v holds %v nodes with k = %v", b, len(nodes), table.K())
+		}
+
+		for _, node := range nodes {
+			// Every bucket but the last holds exactly the nodes
+			// at its distance, and the last holds the rest
+			db := idOf(self).Bucket(idOf(node))
+			if bytes.Equal(node.Id, self.Id) {
+				db = -1
+			}
+			if (b > last && db != b) || (b == last && db > b) {
+				t.Fatalf("node %v at distance bucket %v is in bucket %v", idOf(node), db, b)
+			}
+			if _, ok := table.Lookup(idOf(node)); !ok {
+				t.Fatalf("node %v is in bucket %v but cannot be looked up", idOf(node), b)
+			}
+		}
+		all = append(all, nodes...)
+	}
+
+	if len(all) != len(expected) {
+		t.Fatalf("the table holds %v nodes instead of %v", len(all), len(expected))
+	}
+	for _, node := range expected {
+		if !containsID(all, idOf(node)) {
+			t.Fatalf("node %v is missing from the buckets", idOf(node))
+		}
+	}
+
+	rng := rand.New(rand.NewSource(int64(len(all))))
+	targets := []keys.Key{idOf(self), randomIn(rng, idOf(self).Size()), nearID(rng, idOf(self))}
+	for _, node := range expected {
+		targets = append(targets, idOf(node))
+	}
+	for _, target := range targets {
+		checkClosest(t, table, all, target)
+	}
+}
+
+// checkClosest compares ClosestK(target) to the nodes closest to
+// target by brute force.  The interface does not require the nodes to
+// be ordered by distance, so they are compared in distance order.
+func checkClosest(t *testing.T, table kdht.RoutingTable, all []*kdht.NodeInfo, target keys.Key) {
+	t.Helper()
+
+	exp := sortByDistance(all, target)
+	if len(exp) > table.K() {
+		exp = exp[:table.K()]
+	}
+	act := sortByDistance(table.ClosestK(target), target)
+	if len(act) != len(exp) {
+		t.Fatalf("ClosestK(%v) returned %v nodes instead of %v", target, len(act), len(exp))
+	}
+	for i := range exp {
+		if !bytes.Equal(act[i].Id, exp[i].Id) {
+			t.Fatalf("ClosestK(%v) returned the wrong nodes:\n    exp: %v\n    act: %v",
+				target, ids(exp), ids(act))
+		}
+	}
+}
+
+// TestNode runs the node conformance tests against nodes created by
+// newNode.  The nodes listen on free ports on localhost.
+func TestNode(t *testing.T, newNode NewNode) {
+	t.Run("Operations", func(t *testing.T) { testOperations(t, newNode) })
+	t.Run("Shutdown", func(t *testing.T) { testShutdown(t, newNode) })
+}
+
+// makeNodes creates nodes with random IDs and k = 2, each
+// bootstrapping from the node before it, and waits until every node
+// has a neighbor.
+func makeNodes(t *testing.T, newNode NewNode, n int) ([]kdht.Node, []keys.Key, []string) {
+	t.Helper()
+	rng := rand.New(rand.NewSource(seed))
+
+	var nodes []kdht.Node
+	var ids []keys.Key
+	var addrs []string
+	t.Cleanup(func() {
+		for _, node := range nodes {
+			node.Shutdown()
+		}
+	})
+	for i := 0; i < n; i++ {
+		id := randomID(rng)
+		addr := freeAddress(t)
+		var neighbors []string
+		if i > 0 {
+			neighbors = []string{addrs[i-1]}
+		}
+		node, err := newNode(id, addr, 2, 2, neighbors)
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+		nodes = append(nodes, node)
+		ids = append(ids, id)
+		addrs = append(addrs, addr)
+	}
+
+	deadline := time.Now().Add(settleTime)
+	for i, node := range nodes {
+		for !containsOther(node.Neighbors(), ids[i]) {
+			if time.Now().After(deadline) {
+				t.Fatalf("node%v has no neighbors", i)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return nodes, ids, addrs
+}
+
+func testOperations(t *testing.T, newNode NewNode) {
+	nodes, ids, addrs := makeNodes(t, newNode, 3)
+	rng := rand.New(rand.NewSource(seed + 1))
+
+	if err := nodes[1].Ping(ids[0], []byte("hello")); err != nil {
+		t.Errorf("(ping of a neighbor failed) %v", err)
+	}
+	unknown := randomID(rng)
+	if err := nodes[0].Ping(unknown, nil); !errors.Is(err, kdht.InvalidNodeError) {
+		t.Errorf("ping of an unknown node returned %v instead of InvalidNodeError", err)
+	}
+	if _, err := nodes[0].Get(unknown, unknown); !errors.Is(err, kdht.InvalidNodeError) {
+		t.Errorf("Get from an unknown node returned %v instead of InvalidNodeError", err)
+	}
+
+	found, err := nodes[0].FindNode(ids[2])
+	if err != nil {
+		t.Fatalf("(find node failed) %v", err)
+	}
+	if len(found) == 0 || len(found) > 2 {
+		t.Errorf("FindNode with k = 2 returned %v nodes", len(found))
+	}
+
+	if err := nodes[0].Store(make([]byte, 1<<16)); !errors.Is(err, kdht.TooLargeError) {
+		t.Errorf("Store of a value larger than a message returned %v instead of TooLargeError", err)
+	}
+
+	val := []byte("conformance")
+	key := keys.Compute(val)
+	if err := nodes[0].Store(val); err != nil {
+		t.Fatalf("(store failed) %v", err)
+	}
+	// With k = 2, one of the three nodes does not hold the value,
+	// and must find it
+	var holders, others []int
+	for i, addr := range addrs {
+		if act, err := nodes[0].GetAddress(addr, key); err == nil && bytes.Equal(act, val) {
+			holders = append(holders, i)
+		} else {
+			others = append(others, i)
+		}
+	}
+	if len(holders) < 2 {
+		t.Fatalf("only %v nodes hold a value stored with k = 2", len(holders))
+	}
+	for _, i := range others {
+		act, _, err := nodes[i].FindValue(key)
+		if err != nil {
+			t.Fatalf("(node%v find value failed) %v", i, err)
+		}
+		if !bytes.Equal(act, val) {
+			t.Fatalf("node%v found an incorrect value:\n    exp: %v\n    act: %v\n", i, val, act)
+		}
+	}
+
+	missing := keys.Compute([]byte("missing"))
+	if _, _, err := nodes[0].FindValue(missing); !errors.Is(err, kdht.ValueError) {
+		t.Errorf("FindValue of a missing key returned %v instead of ValueError", err)
+	}
+	if _, err := nodes[0].GetAddress(addrs[1], missing); !errors.Is(err, kdht.ValueError) {
+		t.Errorf("GetAddress of a missing key returned %v instead of ValueError", err)
+	}
+}
+
+func testShutdown(t *testing.T, newNode NewNode) {
+	nodes, ids, addrs := makeNodes(t, newNode, 2)
+	node := nodes[0]
+
+	if err := node.Shutdown(); err != nil {
+		t.Fatalf("(shutdown failed) %v", err)
+	}
+
+	key := keys.Compute([]byte("val1"))
+	calls := map[string]error{}
+	calls["Shutdown"] = node.Shutdown()
+	calls["Ping"] = node.Ping(ids[1], nil)
+	calls["Store"] = node.Store([]byte("val1"))
+	_, calls["FindNode"] = node.FindNode(ids[1])
+	_, _, calls["FindValue"] = node.FindValue(key)
+	_, calls["Get"] = node.Get(ids[1], key)
+	_, calls["GetAddress"] = node.GetAddress(addrs[1], key)
+	for name, err := range calls {
+		if !errors.Is(err, kdht.ShutdownError) {
+			t.Errorf("%v after shutdown returned %v instead of ShutdownError", name, err)
+		}
+	}
+
+	if err := nodes[1].Ping(ids[0], nil); err == nil {
+		t.Errorf("ping of a shut down node succeeded")
+	}
+}
+
+// freeAddress returns a localhost address with a port that is not in
+// use.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("(listen failed) %v", err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func randomID(rng *rand.Rand) keys.Key {
+	return randomIn(rng, keys.Size)
+}
+
+// randomIn returns a random ID that is size bytes wide.
+func randomIn(rng *rand.Rand, size int) keys.Key {
+	b := make([]byte, size)
+	rng.Read(b)
+	id, _ := keys.FromBytes(b)
+	return id
+}
+
+// idOf returns the ID of a node known to be valid.
+func idOf(node *kdht.NodeInfo) keys.Key {
+	id, _ := node.Key()
+	return id
+}
+
+// nearID returns a random ID that shares a random-length prefix with
+// id.  The prefix is at most half of the key, so that the table never
+// needs all of its buckets.
+func nearID(rng *rand.Rand, id keys.Key) keys.Key {
+	near := randomIn(rng, id.Size()).Bytes()
+	idb := id.Bytes()
+	prefix := rng.Intn(id.Bits() / 2)
+	for bit := 0; bit < prefix; bit++ {
+		mask := byte(0x80) >> (bit % 8)
+		near[bit/8] = near[bit/8]&^mask | idb[bit/8]&mask
+	}
+	key, _ := keys.FromBytes(near)
+	return key
+}
+
+func sortByDistance(nodes []*kdht.NodeInfo, target keys.Key) []*kdht.NodeInfo {
+	sorted := append([]*kdht.NodeInfo(nil), nodes...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return target.Cmp(idOf(sorted[i]), idOf(sorted[j])) < 0
+	})
+	return sorted
+}
+
+func containsID(nodes []*kdht.NodeInfo, id keys.Key) bool {
+	for _, node := range nodes {
+		if idOf(node) == id {
+			return true
+		}
+	}
+	return false
+}
+
+// containsOther reports whether nodes holds a node other than self.
+func containsOther(nodes []*kdht.NodeInfo, self keys.Key) bool {
+	for _, node := range nodes {
+		if idOf(node) != self {
+			return true
+		}
+	}
+	return false
+}
+
+func removeID(nodes []*kdht.NodeInfo, id keys.Key) []*kdht.NodeInfo {
+	for i, node := range nodes {
+		if idOf(node) == id {
+			return append(nodes[:i:i], nodes[i+1:]...)
+		}
+	}
+	return nodes
+}
+
+func ids(nodes []*kdht.NodeInfo) []keys.Key {
+	ids := make([]keys.Key, len(nodes))
+	for i, node := range nodes {
+		ids[i] = idOf(node)
+	}
+	return ids
+}
@@ -0,0 +1,66 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package kdhttest
+
+import (
+	"math/rand"
+	"testing"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+func TestModel_Conformance(t *testing.T) {
+	TestRoutingTable(t, NewModel)
+}
+
+func TestModel_Space(t *testing.T) {
+	TestRoutingTableSpace(t, NewModel, keys.SHA256)
+}
+
+// brokenTable discards every node inserted after the third, so that
+// TestProperties has a failure to find and shrink.
+type brokenTable struct {
+	kdht.RoutingTable
+	inserts int
+}
+
+func (table *brokenTable) InsertNode(node *kdht.NodeInfo) {
+	table.inserts++
+	if table.inserts <= 3 {
+		table.RoutingTable.InsertNode(node)
+	}
+}
+
+func TestModel_Shrink(t *testing.T) {
+	newTable := func(node *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+		model, err := NewModel(node, k)
+		return &brokenTable{RoutingTable: model}, err
+	}
+
+	var failed *sequence
+	for i := 0; failed == nil; i++ {
+		s := randomSequence(rand.New(rand.NewSource(int64(i))))
+		if err := s.run(newTable); err != nil {
+			failed, _ = s.shrink(newTable, err)
+		}
+	}
+
+	// The fourth successful insertion is enough to fail
+	if len(failed.ops) > 4 {
+		t.Fatalf("a failing sequence was shrunk to %v operations:\n%v", len(failed.ops), failed)
+	}
+	for _, o := range failed.ops {
+		if o.kind != opInsert {
+			t.Fatalf("a shrunk sequence holds an unneeded operation:\n%v", failed)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package kdhttest
+
+import (
+	"errors"
+	"sync"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// Model is a reference routing table, written to be obviously correct
+// rather than fast.  It keeps every node in one flat list and works
+// out which bucket a node is in from its distance to the local node
+// whenever it needs to.
+//
+// Its buckets follow the rules of the project handout: the last
+// bucket, which holds the local node, is split when it is full and a
+// node belongs in it, and a node that belongs in any other full
+// bucket is discarded.  Buckets are never merged.  Inserting a known
+// node replaces its entry, except for the local node, whose entry
+// never changes.
+type Model struct {
+	local *kdht.NodeInfo
+	id    keys.Key
+	k     int
+	// nodes holds every node in the table, including the local
+	// node, in the order in which they were inserted.
+	nodes []*kdht.NodeInfo
+	// depth is the number of buckets.
+	depth int
+	mutex *sync.Mutex
+}
+
+// NewModel returns an empty Model for node.  It has the same
+// signature as router.New, so that it can be used wherever a table
+// constructor is.
+func NewModel(node *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+	id, err := node.Key()
+	if err != nil {
+		return nil, errors.New("invalid id")
+	}
+	if k <= 0 {
+		return nil, errors.New("invalid k")
+	}
+	return &Model{local: node, id: id, k: k, nodes: []*kdht.NodeInfo{node}, depth: 1, mutex: &sync.Mutex{}}, nil
+}
+
+func (m *Model) K() int {
+	return m.k
+}
+
+// bucket returns the number of the bucket that holds id.
+func (m *Model) bucket(id keys.Key) int {
+	last := m.id.Bits() - m.depth
+	if id == m.id {
+		return last
+	}
+	b := m.id.Bucket(id)
+	if b < last {
+		return last
+	}
+	return b
+}
+
+// count returns the number of nodes in bucket b.
+func (m *Model) count(b int) int {
+	n := 0
+	for _, node := range m.nodes {
+		if m.bucket(idOf(node)) == b {
+			n++
+		}
+	}
+	return n
+}
+
+// find returns the index of id in nodes, or -1.
+func (m *Model) find(id keys.Key) int {
+	for i, node := range m.nodes {
+		if idOf(node) == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *Model) InsertNode(node *kdht.NodeInfo) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The local node's entry is never replaced by one from the
+	// network, and nodes of other key spaces are never inserted
+	id := idOf(node)
+	if id == m.id || id.Size() != m.id.Size() {
+		return
+	}
+	if i := m.find(id); i >= 0 {
+		m.nodes[i] = node
+		return
+	}
+	for {
+		b := m.bucket(id)
+		if m.count(b) < m.k {
+			m.nodes = append(m.nodes, node)
+			return
+		}
+		if b != m.id.Bits()-m.depth {
+			return
+		}
+		m.depth++
+	}
+}
+
+func (m *Model) RemoveNode(key keys.Key) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	i := m.find(key)
+	if i < 0 || key == m.id {
+		return kdht.InvalidNodeError
+	}
+	m.nodes = append(m.nodes[:i:i], m.nodes[i+1:]...)
+	return nil
+}
+
+func (m *Model) Lookup(key keys.Key) (*kdht.NodeInfo, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if i := m.find(key); i >= 0 {
+		return m.nodes[i], true
+	}
+	return nil, false
+}
+
+func (m *Model) GetNodes(bucket int) []*kdht.NodeInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var nodes []*kdht.NodeInfo
+	for _, node := range m.nodes {
+		if m.bucket(idOf(node)) == bucket {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// ClosestK returns the nodes closest to key, nearest first.
+func (m *Model) ClosestK(key keys.Key) []*kdht.NodeInfo {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	closest := sortByDistance(m.nodes, key)
+	if len(closest) > m.k {
+		closest = closest[:m.k]
+	}
+	return closest
+}
+
+func (m *Model) Buckets() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.depth
+}
@@ -0,0 +1,230 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package kdhttest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// opsLength is the number of operations in each random sequence run
+// by TestProperties.
+const opsLength = 300
+
+// opKind is the kind of an operation on a routing table.
+type opKind int
+
+const (
+	opInsert opKind = iota
+	opRemove
+	opLookup
+	opClosestK
+	opGetNodes
+)
+
+// op is one operation in a sequence run against a table and the model.
+type op struct {
+	kind   opKind
+	id     keys.Key
+	bucket int
+}
+
+func (o op) String() string {
+	switch o.kind {
+	case opInsert:
+		return fmt.Sprintf("InsertNode(%v)", o.id)
+	case opRemove:
+		return fmt.Sprintf("RemoveNode(%v)", o.id)
+	case opLookup:
+		return fmt.Sprintf("Lookup(%v)", o.id)
+	case opClosestK:
+		return fmt.Sprintf("ClosestK(%v)", o.id)
+	}
+	return fmt.Sprintf("GetNodes(%v)", o.bucket)
+}
+
+// sequence is a series of operations on a table for one local node.
+type sequence struct {
+	self keys.Key
+	k    int
+	ops  []op
+}
+
+func (s *sequence) String() string {
+	lines := []string{fmt.Sprintf("table for %v with k = %v:", s.self, s.k)}
+	for _, o := range s.ops {
+		lines = append(lines, "    "+o.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// TestProperties runs the given number of random sequences of
+// operations against tables created by newTable and against Model,
+// and fails if the results ever differ.  A failing sequence is shrunk
+// to one from which no single operation can be removed without the
+// failure disappearing, and that sequence is reported.
+func TestProperties(t *testing.T, newTable NewRoutingTable, sequences int) {
+	rng := rand.New(rand.NewSource(seed))
+	for i := 0; i < sequences; i++ {
+		s := randomSequence(rng)
+		err := s.run(newTable)
+		if err == nil {
+			continue
+		}
+
+		s, err = s.shrink(newTable, err)
+		t.Fatalf("sequence %v failed: %v\n%v", i, err, s)
+	}
+}
+
+// randomSequence returns a sequence of random operations.  Most IDs
+// are drawn from the nodes already used, or share a prefix with the
+// local node, so that removals and lookups hit and the table splits.
+func randomSequence(rng *rand.Rand) *sequence {
+	ks := []int{1, 2, 3, 4, 8, 20}
+	s := &sequence{self: randomID(rng), k: ks[rng.Intn(len(ks))]}
+
+	used := []keys.Key{s.self}
+	pick := func() keys.Key {
+		switch rng.Intn(3) {
+		case 0:
+			return used[rng.Intn(len(used))]
+		case 1:
+			return nearID(rng, s.self)
+		}
+		return randomID(rng)
+	}
+	for i := 0; i < opsLength; i++ {
+		o := op{}
+		switch n := rng.Intn(10); {
+		case n < 5:
+			o = op{kind: opInsert, id: pick()}
+			used = append(used, o.id)
+		case n < 7:
+			o = op{kind: opRemove, id: pick()}
+		case n < 8:
+			o = op{kind: opLookup, id: pick()}
+		case n < 9:
+			o = op{kind: opClosestK, id: pick()}
+		default:
+			o = op{kind: opGetNodes, bucket: kdht.KeyBits - 1 - rng.Intn(kdht.KeyBits/2)}
+		}
+		s.ops = append(s.ops, o)
+	}
+	return s
+}
+
+// run performs the sequence on a new table and a new Model, and
+// returns an error describing the first difference between them.
+func (s *sequence) run(newTable NewRoutingTable) error {
+	self := &kdht.NodeInfo{Id: s.self.Bytes(), Address: "self"}
+	table, err := newTable(self, s.k)
+	if err != nil {
+		return fmt.Errorf("creating the table: %w", err)
+	}
+	model, _ := NewModel(self, s.k)
+
+	for i, o := range s.ops {
+		if err := compare(o, table, model); err != nil {
+			return fmt.Errorf("operation %v, %v: %w", i, o, err)
+		}
+		if act, exp := table.Buckets(), model.Buckets(); act != exp {
+			return fmt.Errorf("after operation %v, %v: Buckets() is %v instead of %v", i, o, act, exp)
+		}
+	}
+	return nil
+}
+
+// compare performs an operation on both table and model, and returns
+// an error if their results differ.
+func compare(o op, table kdht.RoutingTable, model kdht.RoutingTable) error {
+	switch o.kind {
+	case opInsert:
+		node := &kdht.NodeInfo{Id: o.id.Bytes(), Address: o.id.String()[:8]}
+		table.InsertNode(node)
+		model.InsertNode(node)
+		_, act := table.Lookup(o.id)
+		_, exp := model.Lookup(o.id)
+		if act != exp {
+			return fmt.Errorf("the node was inserted: %v, expected %v", act, exp)
+		}
+
+	case opRemove:
+		act := table.RemoveNode(o.id)
+		exp := model.RemoveNode(o.id)
+		if (act == nil) != (exp == nil) || (act != nil && !errors.Is(act, kdht.InvalidNodeError)) {
+			return fmt.Errorf("returned %v, expected %v", act, exp)
+		}
+
+	case opLookup:
+		actNode, act := table.Lookup(o.id)
+		expNode, exp := model.Lookup(o.id)
+		if act != exp || (act && actNode.Address != expNode.Address) {
+			return fmt.Errorf("returned %v %v, expected %v %v", actNode, act, expNode, exp)
+		}
+
+	case opClosestK:
+		act := sortByDistance(table.ClosestK(o.id), o.id)
+		exp := model.ClosestK(o.id)
+		if !sameIDs(act, exp) {
+			return fmt.Errorf("returned %v, expected %v", ids(act), ids(exp))
+		}
+
+	case opGetNodes:
+		// Buckets may be in any order, so sort both by ID
+		act := sortByDistance(table.GetNodes(o.bucket), keys.Key{})
+		exp := sortByDistance(model.GetNodes(o.bucket), keys.Key{})
+		if !sameIDs(act, exp) {
+			return fmt.Errorf("returned %v, expected %v", ids(act), ids(exp))
+		}
+	}
+	return nil
+}
+
+// shrink removes operations from a failing sequence for as long as it
+// keeps failing, first in large chunks and then one at a time.  It
+// returns the shortest failing sequence found and its error.
+func (s *sequence) shrink(newTable NewRoutingTable, err error) (*sequence, error) {
+	for chunk := len(s.ops) / 2; chunk >= 1; chunk /= 2 {
+		for start := 0; start < len(s.ops); {
+			end := start + chunk
+			if end > len(s.ops) {
+				end = len(s.ops)
+			}
+			ops := append(s.ops[:start:start], s.ops[end:]...)
+			candidate := &sequence{self: s.self, k: s.k, ops: ops}
+			if cerr := candidate.run(newTable); cerr != nil {
+				s, err = candidate, cerr
+				continue
+			}
+			start += chunk
+		}
+	}
+	return s, err
+}
+
+func sameIDs(a, b []*kdht.NodeInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if idOf(a[i]) != idOf(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -29,6 +29,62 @@ const (
 	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
 )
 
+// Capability is a bit in NodeInfo.capabilities advertising an
+// optional protocol feature.  Nodes must not use a feature with a
+// peer that does not advertise it.
+type Capability int32
+
+const (
+	// No optional features
+	Capability_CAP_NONE Capability = 0
+	// The node understands ERROR replies
+	Capability_CAP_ERROR Capability = 1
+	// Replies to STORE and GET carry the request key, so several
+	// requests may share a connection and be answered out of order
+	Capability_CAP_PIPELINE Capability = 2
+)
+
+// Enum value maps for Capability.
+var (
+	Capability_name = map[int32]string{
+		0: "CAP_NONE",
+		1: "CAP_ERROR",
+		2: "CAP_PIPELINE",
+	}
+	Capability_value = map[string]int32{
+		"CAP_NONE":     0,
+		"CAP_ERROR":    1,
+		"CAP_PIPELINE": 2,
+	}
+)
+
+func (x Capability) Enum() *Capability {
+	p := new(Capability)
+	*p = x
+	return p
+}
+
+func (x Capability) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (Capability) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_kdht_messages_proto_enumTypes[0].Descriptor()
+}
+
+func (Capability) Type() protoreflect.EnumType {
+	return &file_api_kdht_messages_proto_enumTypes[0]
+}
+
+func (x Capability) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use Capability.Descriptor instead.
+func (Capability) EnumDescriptor() ([]byte, []int) {
+	return file_api_kdht_messages_proto_rawDescGZIP(), []int{0}
+}
+
 // MessageType indicates the type of a Message.  Different
 // message types have different valid fields.
 type MessageType int32
@@ -50,6 +106,8 @@ const (
 	MessageType_NODES MessageType = 6
 	// Reply to successful FIND_VALUE
 	MessageType_VALUE MessageType = 7
+	// Rejection of any request, with an ErrorCode
+	MessageType_ERROR MessageType = 8
 )
 
 // Enum value maps for MessageType.
@@ -63,6 +121,7 @@ var (
 		5: "ACK",
 		6: "NODES",
 		7: "VALUE",
+		8: "ERROR",
 	}
 	MessageType_value = map[string]int32{
 		"PING":       0,
@@ -73,6 +132,7 @@ var (
 		"ACK":        5,
 		"NODES":      6,
 		"VALUE":      7,
+		"ERROR":      8,
 	}
 )
 
@@ -87,11 +147,11 @@ func (x MessageType) String() string {
 }
 
 func (MessageType) Descriptor() protoreflect.EnumDescriptor {
-	return file_api_kdht_messages_proto_enumTypes[0].Descriptor()
+	return file_api_kdht_messages_proto_enumTypes[1].Descriptor()
 }
 
 func (MessageType) Type() protoreflect.EnumType {
-	return &file_api_kdht_messages_proto_enumTypes[0]
+	return &file_api_kdht_messages_proto_enumTypes[1]
 }
 
 func (x MessageType) Number() protoreflect.EnumNumber {
@@ -100,11 +160,82 @@ func (x MessageType) Number() protoreflect.EnumNumber {
 
 // Deprecated: Use MessageType.Descriptor instead.
 func (MessageType) EnumDescriptor() ([]byte, []int) {
-	return file_api_kdht_messages_proto_rawDescGZIP(), []int{0}
+	return file_api_kdht_messages_proto_rawDescGZIP(), []int{1}
+}
+
+// ErrorCode indicates why a request was rejected in an ERROR
+// message.
+type ErrorCode int32
+
+const (
+	// No specific reason was given
+	ErrorCode_UNKNOWN ErrorCode = 0
+	// The requested key is not stored at this node
+	ErrorCode_NOT_FOUND ErrorCode = 1
+	// The value in a STORE is too large to be stored
+	ErrorCode_TOO_LARGE ErrorCode = 2
+	// The node has no room to store another value
+	ErrorCode_QUOTA_EXCEEDED ErrorCode = 3
+	// The request was malformed (e.g., a bad key)
+	ErrorCode_BAD_REQUEST ErrorCode = 4
+	// The node is shutting down and will not serve requests
+	ErrorCode_SHUTTING_DOWN ErrorCode = 5
+	// The sender speaks an incompatible major protocol version
+	ErrorCode_VERSION_MISMATCH ErrorCode = 6
+)
+
+// Enum value maps for ErrorCode.
+var (
+	ErrorCode_name = map[int32]string{
+		0: "UNKNOWN",
+		1: "NOT_FOUND",
+		2: "TOO_LARGE",
+		3: "QUOTA_EXCEEDED",
+		4: "BAD_REQUEST",
+		5: "SHUTTING_DOWN",
+		6: "VERSION_MISMATCH",
+	}
+	ErrorCode_value = map[string]int32{
+		"UNKNOWN":          0,
+		"NOT_FOUND":        1,
+		"TOO_LARGE":        2,
+		"QUOTA_EXCEEDED":   3,
+		"BAD_REQUEST":      4,
+		"SHUTTING_DOWN":    5,
+		"VERSION_MISMATCH": 6,
+	}
+)
+
+func (x ErrorCode) Enum() *ErrorCode {
+	p := new(ErrorCode)
+	*p = x
+	return p
+}
+
+func (x ErrorCode) String() string {
+	return protoimpl.X.EnumStringOf(x.Descriptor(), protoreflect.EnumNumber(x))
+}
+
+func (ErrorCode) Descriptor() protoreflect.EnumDescriptor {
+	return file_api_kdht_messages_proto_enumTypes[2].Descriptor()
+}
+
+func (ErrorCode) Type() protoreflect.EnumType {
+	return &file_api_kdht_messages_proto_enumTypes[2]
+}
+
+func (x ErrorCode) Number() protoreflect.EnumNumber {
+	return protoreflect.EnumNumber(x)
+}
+
+// Deprecated: Use ErrorCode.Descriptor instead.
+func (ErrorCode) EnumDescriptor() ([]byte, []int) {
+	return file_api_kdht_messages_proto_rawDescGZIP(), []int{2}
 }
 
 // NodeInfo represents a node in the DHT.  It contains the node's
-// listening TCP address and its 160-bit node ID.
+// listening TCP address and its 160-bit node ID, as well as the
+// protocol version and capabilities it advertises.
 //
 // It is an error to send an Address that is not a valid string
 // containing a node address that can be connected to with net.Dial(),
@@ -117,6 +248,11 @@ type NodeInfo struct {
 
 	Address string `protobuf:"bytes,1,opt,name=address,proto3" json:"address,omitempty"`
 	Id      []byte `protobuf:"bytes,2,opt,name=id,proto3" json:"id,omitempty"`
+	// The protocol version spoken by this node, as (major << 16) |
+	// minor.  Zero indicates a node that predates versioning.
+	Version uint32 `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	// A bitmap of Capability values supported by this node.
+	Capabilities uint64 `protobuf:"varint,4,opt,name=capabilities,proto3" json:"capabilities,omitempty"`
 }
 
 func (x *NodeInfo) Reset() {
@@ -165,6 +301,20 @@ func (x *NodeInfo) GetId() []byte {
 	return nil
 }
 
+func (x *NodeInfo) GetVersion() uint32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *NodeInfo) GetCapabilities() uint64 {
+	if x != nil {
+		return x.Capabilities
+	}
+	return 0
+}
+
 // Message is the universal message type in a KDHT.  Every message
 // includes a Sender and Type, and the Type determines which other
 // fields are valid.  You must always send a well-formed Message,
@@ -175,7 +325,8 @@ type Message struct {
 	sizeCache     protoimpl.SizeCache
 	unknownFields protoimpl.UnknownFields
 
-	// The sender of this message; both address and id must be present.
+	// The sender of this message; both address and id must be
+	// present, and version and capabilities should be.
 	Sender *NodeInfo `protobuf:"bytes,1,opt,name=sender,proto3" json:"sender,omitempty"`
 	// The type of this message
 	Type MessageType `protobuf:"varint,2,opt,name=type,proto3,enum=kdht.MessageType" json:"type,omitempty"`
@@ -184,20 +335,27 @@ type Message struct {
 	// GET: the key to retrieve
 	// FIND_NODE: the node ID to find
 	// FIND_VALUE: the key for the value to be retrieved
-	// ACK: the key that was stored in a STORE or requested by GET (empty for PING ACK)
+	// ACK: the key that was stored in a STORE (empty for PING ACK)
 	// NODES: the key requested in FIND_NODE or FIND_VALUE
 	// VALUE: the key requested in FIND_VALUE
+	// ERROR: the key in the rejected request, if any
 	Key []byte `protobuf:"bytes,3,opt,name=Key,proto3" json:"Key,omitempty"`
 	// Value is present only for:
 	// PING: an optional value may be sent for your debugging purposes
 	// STORE: the value to store for this key
-	// ACK: The value sent in a PING being acknowledged (empty for STORE ACK or GET (N)ACK)
+	// ACK: The value sent in a PING being acknowledged (empty for STORE ACK)
 	// VALUE: the value retrieved by a GET or FIND_VALUE
 	Value []byte `protobuf:"bytes,4,opt,name=Value,proto3" json:"Value,omitempty"`
 	// Nodes is the list of the K closest nodes to a requested key in
 	// the response to a FIND_NODE or FIND_VALUE message (assuming
 	// that the value was not found, in the latter case).
 	Nodes []*NodeInfo `protobuf:"bytes,5,rep,name=Nodes,proto3" json:"Nodes,omitempty"`
+	// Error is the reason a request was rejected, and is present
+	// only for ERROR.
+	Error ErrorCode `protobuf:"varint,6,opt,name=Error,proto3,enum=kdht.ErrorCode" json:"Error,omitempty"`
+	// Detail is an optional human-readable description of the
+	// error, and is present only for ERROR.
+	Detail string `protobuf:"bytes,7,opt,name=Detail,proto3" json:"Detail,omitempty"`
 }
 
 func (x *Message) Reset() {
@@ -267,34 +425,69 @@ func (x *Message) GetNodes() []*NodeInfo {
 	return nil
 }
 
+func (x *Message) GetError() ErrorCode {
+	if x != nil {
+		return x.Error
+	}
+	return ErrorCode_UNKNOWN
+}
+
+func (x *Message) GetDetail() string {
+	if x != nil {
+		return x.Detail
+	}
+	return ""
+}
+
 var File_api_kdht_messages_proto protoreflect.FileDescriptor
 
 var file_api_kdht_messages_proto_rawDesc = []byte{
 	0x0a, 0x17, 0x61, 0x70, 0x69, 0x2f, 0x6b, 0x64, 0x68, 0x74, 0x2f, 0x6d, 0x65, 0x73, 0x73, 0x61,
 	0x67, 0x65, 0x73, 0x2e, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x12, 0x04, 0x6b, 0x64, 0x68, 0x74, 0x22,
-	0x34, 0x0a, 0x08, 0x4e, 0x6f, 0x64, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x61,
+	0x72, 0x0a, 0x08, 0x4e, 0x6f, 0x64, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x12, 0x18, 0x0a, 0x07, 0x61,
 	0x64, 0x64, 0x72, 0x65, 0x73, 0x73, 0x18, 0x01, 0x20, 0x01, 0x28, 0x09, 0x52, 0x07, 0x61, 0x64,
 	0x64, 0x72, 0x65, 0x73, 0x73, 0x12, 0x0e, 0x0a, 0x02, 0x69, 0x64, 0x18, 0x02, 0x20, 0x01, 0x28,
-	0x0c, 0x52, 0x02, 0x69, 0x64, 0x22, 0xa6, 0x01, 0x0a, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67,
-	0x65, 0x12, 0x26, 0x0a, 0x06, 0x73, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28,
-	0x0b, 0x32, 0x0e, 0x2e, 0x6b, 0x64, 0x68, 0x74, 0x2e, 0x4e, 0x6f, 0x64, 0x65, 0x49, 0x6e, 0x66,
-	0x6f, 0x52, 0x06, 0x73, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x12, 0x25, 0x0a, 0x04, 0x74, 0x79, 0x70,
-	0x65, 0x18, 0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x11, 0x2e, 0x6b, 0x64, 0x68, 0x74, 0x2e, 0x4d,
-	0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65,
-	0x12, 0x10, 0x0a, 0x03, 0x4b, 0x65, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x4b,
-	0x65, 0x79, 0x12, 0x14, 0x0a, 0x05, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28,
-	0x0c, 0x52, 0x05, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x24, 0x0a, 0x05, 0x4e, 0x6f, 0x64, 0x65,
-	0x73, 0x18, 0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0e, 0x2e, 0x6b, 0x64, 0x68, 0x74, 0x2e, 0x4e,
-	0x6f, 0x64, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x05, 0x4e, 0x6f, 0x64, 0x65, 0x73, 0x2a, 0x69,
-	0x0a, 0x0b, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12, 0x08, 0x0a,
-	0x04, 0x50, 0x49, 0x4e, 0x47, 0x10, 0x00, 0x12, 0x09, 0x0a, 0x05, 0x53, 0x54, 0x4f, 0x52, 0x45,
-	0x10, 0x01, 0x12, 0x07, 0x0a, 0x03, 0x47, 0x45, 0x54, 0x10, 0x02, 0x12, 0x0d, 0x0a, 0x09, 0x46,
-	0x49, 0x4e, 0x44, 0x5f, 0x4e, 0x4f, 0x44, 0x45, 0x10, 0x03, 0x12, 0x0e, 0x0a, 0x0a, 0x46, 0x49,
-	0x4e, 0x44, 0x5f, 0x56, 0x41, 0x4c, 0x55, 0x45, 0x10, 0x04, 0x12, 0x07, 0x0a, 0x03, 0x41, 0x43,
-	0x4b, 0x10, 0x05, 0x12, 0x09, 0x0a, 0x05, 0x4e, 0x4f, 0x44, 0x45, 0x53, 0x10, 0x06, 0x12, 0x09,
-	0x0a, 0x05, 0x56, 0x41, 0x4c, 0x55, 0x45, 0x10, 0x07, 0x42, 0x16, 0x5a, 0x14, 0x63, 0x73, 0x65,
-	0x35, 0x38, 0x36, 0x2e, 0x6b, 0x64, 0x68, 0x74, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x6b, 0x64, 0x68,
-	0x74, 0x62, 0x06, 0x70, 0x72, 0x6f, 0x74, 0x6f, 0x33,
+	0x0c, 0x52, 0x02, 0x69, 0x64, 0x12, 0x18, 0x0a, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e,
+	0x18, 0x03, 0x20, 0x01, 0x28, 0x0d, 0x52, 0x07, 0x76, 0x65, 0x72, 0x73, 0x69, 0x6f, 0x6e, 0x12,
+	0x22, 0x0a, 0x0c, 0x63, 0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x69, 0x65, 0x73, 0x18,
+	0x04, 0x20, 0x01, 0x28, 0x04, 0x52, 0x0c, 0x63, 0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74,
+	0x69, 0x65, 0x73, 0x22, 0xe5, 0x01, 0x0a, 0x07, 0x4d, 0x65, 0x73, 0x73, 0x61, 0x67, 0x65, 0x12,
+	0x26, 0x0a, 0x06, 0x73, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x18, 0x01, 0x20, 0x01, 0x28, 0x0b, 0x32,
+	0x0e, 0x2e, 0x6b, 0x64, 0x68, 0x74, 0x2e, 0x4e, 0x6f, 0x64, 0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52,
+	0x06, 0x73, 0x65, 0x6e, 0x64, 0x65, 0x72, 0x12, 0x25, 0x0a, 0x04, 0x74, 0x79, 0x70, 0x65, 0x18,
+	0x02, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x11, 0x2e, 0x6b, 0x64, 0x68, 0x74, 0x2e, 0x4d, 0x65, 0x73,
+	0x73, 0x61, 0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x52, 0x04, 0x74, 0x79, 0x70, 0x65, 0x12, 0x10,
+	0x0a, 0x03, 0x4b, 0x65, 0x79, 0x18, 0x03, 0x20, 0x01, 0x28, 0x0c, 0x52, 0x03, 0x4b, 0x65, 0x79,
+	0x12, 0x14, 0x0a, 0x05, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x18, 0x04, 0x20, 0x01, 0x28, 0x0c, 0x52,
+	0x05, 0x56, 0x61, 0x6c, 0x75, 0x65, 0x12, 0x24, 0x0a, 0x05, 0x4e, 0x6f, 0x64, 0x65, 0x73, 0x18,
+	0x05, 0x20, 0x03, 0x28, 0x0b, 0x32, 0x0e, 0x2e, 0x6b, 0x64, 0x68, 0x74, 0x2e, 0x4e, 0x6f, 0x64,
+	0x65, 0x49, 0x6e, 0x66, 0x6f, 0x52, 0x05, 0x4e, 0x6f, 0x64, 0x65, 0x73, 0x12, 0x25, 0x0a, 0x05,
+	0x45, 0x72, 0x72, 0x6f, 0x72, 0x18, 0x06, 0x20, 0x01, 0x28, 0x0e, 0x32, 0x0f, 0x2e, 0x6b, 0x64,
+	0x68, 0x74, 0x2e, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x43, 0x6f, 0x64, 0x65, 0x52, 0x05, 0x45, 0x72,
+	0x72, 0x6f, 0x72, 0x12, 0x16, 0x0a, 0x06, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x18, 0x07, 0x20,
+	0x01, 0x28, 0x09, 0x52, 0x06, 0x44, 0x65, 0x74, 0x61, 0x69, 0x6c, 0x2a, 0x3b, 0x0a, 0x0a, 0x43,
+	0x61, 0x70, 0x61, 0x62, 0x69, 0x6c, 0x69, 0x74, 0x79, 0x12, 0x0c, 0x0a, 0x08, 0x43, 0x41, 0x50,
+	0x5f, 0x4e, 0x4f, 0x4e, 0x45, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x43, 0x41, 0x50, 0x5f, 0x45,
+	0x52, 0x52, 0x4f, 0x52, 0x10, 0x01, 0x12, 0x10, 0x0a, 0x0c, 0x43, 0x41, 0x50, 0x5f, 0x50, 0x49,
+	0x50, 0x45, 0x4c, 0x49, 0x4e, 0x45, 0x10, 0x02, 0x2a, 0x74, 0x0a, 0x0b, 0x4d, 0x65, 0x73, 0x73,
+	0x61, 0x67, 0x65, 0x54, 0x79, 0x70, 0x65, 0x12, 0x08, 0x0a, 0x04, 0x50, 0x49, 0x4e, 0x47, 0x10,
+	0x00, 0x12, 0x09, 0x0a, 0x05, 0x53, 0x54, 0x4f, 0x52, 0x45, 0x10, 0x01, 0x12, 0x07, 0x0a, 0x03,
+	0x47, 0x45, 0x54, 0x10, 0x02, 0x12, 0x0d, 0x0a, 0x09, 0x46, 0x49, 0x4e, 0x44, 0x5f, 0x4e, 0x4f,
+	0x44, 0x45, 0x10, 0x03, 0x12, 0x0e, 0x0a, 0x0a, 0x46, 0x49, 0x4e, 0x44, 0x5f, 0x56, 0x41, 0x4c,
+	0x55, 0x45, 0x10, 0x04, 0x12, 0x07, 0x0a, 0x03, 0x41, 0x43, 0x4b, 0x10, 0x05, 0x12, 0x09, 0x0a,
+	0x05, 0x4e, 0x4f, 0x44, 0x45, 0x53, 0x10, 0x06, 0x12, 0x09, 0x0a, 0x05, 0x56, 0x41, 0x4c, 0x55,
+	0x45, 0x10, 0x07, 0x12, 0x09, 0x0a, 0x05, 0x45, 0x52, 0x52, 0x4f, 0x52, 0x10, 0x08, 0x2a, 0x84,
+	0x01, 0x0a, 0x09, 0x45, 0x72, 0x72, 0x6f, 0x72, 0x43, 0x6f, 0x64, 0x65, 0x12, 0x0b, 0x0a, 0x07,
+	0x55, 0x4e, 0x4b, 0x4e, 0x4f, 0x57, 0x4e, 0x10, 0x00, 0x12, 0x0d, 0x0a, 0x09, 0x4e, 0x4f, 0x54,
+	0x5f, 0x46, 0x4f, 0x55, 0x4e, 0x44, 0x10, 0x01, 0x12, 0x0d, 0x0a, 0x09, 0x54, 0x4f, 0x4f, 0x5f,
+	0x4c, 0x41, 0x52, 0x47, 0x45, 0x10, 0x02, 0x12, 0x12, 0x0a, 0x0e, 0x51, 0x55, 0x4f, 0x54, 0x41,
+	0x5f, 0x45, 0x58, 0x43, 0x45, 0x45, 0x44, 0x45, 0x44, 0x10, 0x03, 0x12, 0x0f, 0x0a, 0x0b, 0x42,
+	0x41, 0x44, 0x5f, 0x52, 0x45, 0x51, 0x55, 0x45, 0x53, 0x54, 0x10, 0x04, 0x12, 0x11, 0x0a, 0x0d,
+	0x53, 0x48, 0x55, 0x54, 0x54, 0x49, 0x4e, 0x47, 0x5f, 0x44, 0x4f, 0x57, 0x4e, 0x10, 0x05, 0x12,
+	0x14, 0x0a, 0x10, 0x56, 0x45, 0x52, 0x53, 0x49, 0x4f, 0x4e, 0x5f, 0x4d, 0x49, 0x53, 0x4d, 0x41,
+	0x54, 0x43, 0x48, 0x10, 0x06, 0x42, 0x16, 0x5a, 0x14, 0x63, 0x73, 0x65, 0x35, 0x38, 0x36, 0x2e,
+	0x6b, 0x64, 0x68, 0x74, 0x2f, 0x61, 0x70, 0x69, 0x2f, 0x6b, 0x64, 0x68, 0x74, 0x62, 0x06, 0x70,
+	0x72, 0x6f, 0x74, 0x6f, 0x33,
 }
 
 var (
@@ -309,22 +502,25 @@ func file_api_kdht_messages_proto_rawDescGZIP() []byte {
 	return file_api_kdht_messages_proto_rawDescData
 }
 
-var file_api_kdht_messages_proto_enumTypes = make([]protoimpl.EnumInfo, 1)
+var file_api_kdht_messages_proto_enumTypes = make([]protoimpl.EnumInfo, 3)
 var file_api_kdht_messages_proto_msgTypes = make([]protoimpl.MessageInfo, 2)
 var file_api_kdht_messages_proto_goTypes = []interface{}{
-	(MessageType)(0), // 0: kdht.MessageType
-	(*NodeInfo)(nil), // 1: kdht.NodeInfo
-	(*Message)(nil),  // 2: kdht.Message
+	(Capability)(0),  // 0: kdht.Capability
+	(MessageType)(0), // 1: kdht.MessageType
+	(ErrorCode)(0),   // 2: kdht.ErrorCode
+	(*NodeInfo)(nil), // 3: kdht.NodeInfo
+	(*Message)(nil),  // 4: kdht.Message
 }
 var file_api_kdht_messages_proto_depIdxs = []int32{
-	1, // 0: kdht.Message.sender:type_name -> kdht.NodeInfo
-	0, // 1: kdht.Message.type:type_name -> kdht.MessageType
-	1, // 2: kdht.Message.Nodes:type_name -> kdht.NodeInfo
-	3, // [3:3] is the sub-list for method output_type
-	3, // [3:3] is the sub-list for method input_type
-	3, // [3:3] is the sub-list for extension type_name
-	3, // [3:3] is the sub-list for extension extendee
-	0, // [0:3] is the sub-list for field type_name
+	3, // 0: kdht.Message.sender:type_name -> kdht.NodeInfo
+	1, // 1: kdht.Message.type:type_name -> kdht.MessageType
+	3, // 2: kdht.Message.Nodes:type_name -> kdht.NodeInfo
+	2, // 3: kdht.Message.Error:type_name -> kdht.ErrorCode
+	4, // [4:4] is the sub-list for method output_type
+	4, // [4:4] is the sub-list for method input_type
+	4, // [4:4] is the sub-list for extension type_name
+	4, // [4:4] is the sub-list for extension extendee
+	0, // [0:4] is the sub-list for field type_name
 }
 
 func init() { file_api_kdht_messages_proto_init() }
@@ -363,7 +559,7 @@ func file_api_kdht_messages_proto_init() {
 		File: protoimpl.DescBuilder{
 			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
 			RawDescriptor: file_api_kdht_messages_proto_rawDesc,
-			NumEnums:      1,
+			NumEnums:      3,
 			NumMessages:   2,
 			NumExtensions: 0,
 			NumServices:   0,
@@ -0,0 +1,64 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package kdht
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func FuzzMessage(f *testing.F) {
+	sender := &NodeInfo{Id: make([]byte, KeyBytes), Address: "localhost:4586",
+		Version: ProtocolVersion, Capabilities: Capabilities}
+	seeds := []*Message{
+		{Sender: sender, Type: MessageType_PING, Value: []byte("hello")},
+		{Sender: sender, Type: MessageType_STORE, Key: make([]byte, KeyBytes), Value: []byte("val1")},
+		{Sender: sender, Type: MessageType_NODES, Nodes: []*NodeInfo{sender, {Id: []byte{1}}}},
+		{Sender: sender, Type: MessageType_ERROR, Error: ErrorCode_BAD_REQUEST, Detail: "detail"},
+		{},
+	}
+	for _, seed := range seeds {
+		data, err := proto.Marshal(seed)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		message := &Message{}
+		if proto.Unmarshal(data, message) != nil {
+			return
+		}
+
+		// Anything that parses must survive the helpers used on
+		// received messages, and a round trip
+		Compatible(message.Sender)
+		HasCapability(message.Sender, Capability_CAP_PIPELINE)
+		ErrorFor(message.Error)
+		for _, info := range message.Nodes {
+			VersionOf(info)
+		}
+
+		again, err := proto.Marshal(message)
+		if err != nil {
+			t.Fatalf("(marshal of a parsed message failed) %v", err)
+		}
+		parsed := &Message{}
+		if err := proto.Unmarshal(again, parsed); err != nil {
+			t.Fatalf("(unmarshal of a marshaled message failed) %v", err)
+		}
+		if !proto.Equal(message, parsed) {
+			t.Fatalf("message changed in a round trip:\n    exp: %v\n    act: %v", message, parsed)
+		}
+	})
+}
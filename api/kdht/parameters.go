@@ -10,10 +10,30 @@ policies for more package.
 
 package kdht
 
-import "crypto/sha1"
+import "cse586.kdht/given/keys"
 
-// KeyBytes is the size in bytes of the keys in the k-DHT
-const KeyBytes = sha1.Size
+// KeyBytes is the size in bytes of the keys in the k-DHT, when it
+// uses the default keys.Space
+const KeyBytes = keys.Size
 
-// KeyBits is the ssize in bits of the keys in the k-DHT
-const KeyBits = 8 * KeyBytes
+// KeyBits is the ssize in bits of the keys in the k-DHT, when it uses
+// the default keys.Space
+const KeyBits = keys.Bits
+
+// ProtocolMajor is the major version of the k-DHT protocol spoken by
+// this implementation.  Nodes with different major versions cannot
+// communicate.
+const ProtocolMajor = 1
+
+// ProtocolMinor is the minor version of the k-DHT protocol spoken by
+// this implementation.  Minor versions may add fields or message
+// types, but only behind a Capability.
+const ProtocolMinor = 2
+
+// ProtocolVersion is ProtocolMajor and ProtocolMinor packed as in
+// NodeInfo.Version.
+const ProtocolVersion = ProtocolMajor<<16 | ProtocolMinor
+
+// Capabilities is the set of Capability bits advertised by this
+// implementation.
+const Capabilities = uint64(Capability_CAP_ERROR | Capability_CAP_PIPELINE)
@@ -0,0 +1,95 @@
+// The kdht-cluster command launches a network of k-DHT nodes on the
+// local host, waits for it to converge, prints a summary of every
+// node, and keeps the network running until it is interrupted.
+//
+// For example, to start ten nodes with reproducible IDs, each
+// bootstrapping from a random earlier node:
+//
+//	kdht-cluster -n 10 -topology random -seed test
+//
+// The nodes run within this process unless -subprocess is given, in
+// which case each node is a kdht-node subprocess.  Either way, the
+// routing table server kdht-router must be in the PATH.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"cse586.kdht/given/keys"
+	"cse586.kdht/impl/cluster"
+)
+
+func main() {
+	log.SetPrefix("kdht-cluster: ")
+	log.SetFlags(0)
+
+	opts := cluster.Options{}
+	var topology, space string
+	var settle, timeout time.Duration
+	var once bool
+	flag.IntVar(&opts.N, "n", 5, "number of nodes")
+	flag.IntVar(&opts.K, "k", 20, "k, the bucket size and replication factor")
+	flag.IntVar(&opts.Alpha, "alpha", 3, "alpha, the lookup concurrency")
+	flag.StringVar(&opts.Host, "host", "localhost", "`host` for every node to listen on")
+	flag.StringVar(&topology, "topology", "chain", "bootstrap topology: chain, star, or random")
+	flag.StringVar(&opts.Seed, "seed", "", "derive node IDs and the random topology from this `string`")
+	flag.StringVar(&space, "key-space", keys.Default.Name(), "key space of the network, sha1 or sha256")
+	flag.BoolVar(&opts.Subprocess, "subprocess", false, "run each node as a kdht-node subprocess")
+	flag.StringVar(&opts.Command, "node-cmd", "kdht-node", "kdht-node `command` for -subprocess")
+	flag.DurationVar(&settle, "settle", time.Second, "how long routing tables must be unchanged to count as converged")
+	flag.DurationVar(&timeout, "timeout", 30*time.Second, "how long to wait for convergence")
+	flag.BoolVar(&once, "once", false, "exit after printing the summary")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	if opts.Topology, err = cluster.ParseTopology(topology); err != nil {
+		log.Fatal(err)
+	}
+	if opts.KeySpace, err = keys.SpaceNamed(space); err != nil {
+		log.Fatal(err)
+	}
+
+	c, err := cluster.Start(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("started %v nodes, waiting for convergence", opts.N)
+
+	statuses, err := c.WaitConverged(settle, timeout)
+	if err != nil {
+		log.Print(err)
+	}
+	if statuses != nil {
+		printSummary(c, statuses)
+	}
+
+	if !once {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+	}
+	log.Printf("shutting down")
+	c.Shutdown()
+}
+
+// printSummary prints a table with one line per node.
+func printSummary(c *cluster.Cluster, statuses []cluster.Status) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tID\tADDRESS\tNEIGHBORS\tBUCKETS")
+	for i, member := range c.Members {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", member.Index, member.ID,
+			member.Address, statuses[i].Neighbors, statuses[i].Buckets)
+	}
+	w.Flush()
+}
@@ -0,0 +1,397 @@
+// The kdht-node command runs a single k-DHT node until it is
+// interrupted.
+//
+// The node is configured from command line flags, or from a JSON
+// configuration file given with -config whose fields have the same
+// names as the flags.  Flags given on the command line override the
+// configuration file.  For example:
+//
+//	kdht-node -listen localhost:4586 -seed alice -bootstrap localhost:5486
+//
+// If a data directory is given, the node's ID is kept there so that
+// it survives restarts, and locally stored values are saved there on
+// shutdown and reloaded on startup.
+//
+// With -control, the node also serves a local JSON control API (see
+// impl.NewControlHandler) on a loopback address, or on a Unix socket
+// if the address starts with "unix:".  The kdht command can use it
+// with its own -control flag.
+//
+// With -gateway, the node also serves an HTTP gateway (see
+// impl.NewGatewayHandler) that lets other programs store and fetch
+// values over HTTP.  Unlike the control API, the gateway may listen on
+// any address.
+//
+// The routing table server kdht-router must be in the PATH.
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"cse586.kdht/given/keys"
+	"cse586.kdht/impl"
+)
+
+// config holds every setting of the node.  The JSON field names match
+// the flag names.
+type config struct {
+	ID              string   `json:"id"`
+	Seed            string   `json:"seed"`
+	KeySpace        string   `json:"key-space"`
+	Listen          string   `json:"listen"`
+	K               int      `json:"k"`
+	Alpha           int      `json:"alpha"`
+	Bootstrap       []string `json:"bootstrap"`
+	DataDir         string   `json:"datadir"`
+	Handoff         bool     `json:"handoff"`
+	ShutdownTimeout string   `json:"shutdown-timeout"`
+	Control         string   `json:"control"`
+	Gateway         string   `json:"gateway"`
+}
+
+// idFile and valueDir are the names of the node ID file and the
+// stored values directory within the data directory.
+const idFile = "node-id"
+const valueDir = "values"
+
+func main() {
+	log.SetPrefix("kdht-node: ")
+
+	cfg, err := parseConfig(os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	space, err := keys.SpaceNamed(cfg.KeySpace)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id, err := nodeID(cfg, space)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	timeout, err := time.ParseDuration(cfg.ShutdownTimeout)
+	if err != nil {
+		log.Fatalf("invalid shutdown-timeout: %v", err)
+	}
+
+	node, err := impl.NewNodeWith(id, cfg.Listen, cfg.K, cfg.Alpha, cfg.Bootstrap, impl.NodeOptions{KeySpace: space})
+	if err != nil {
+		log.Fatal(err)
+	}
+	node.SetLogger(log.Default())
+	log.Printf("node %v listening on %v (k = %v, alpha = %v, %v keys)", id, node.Info().Address, cfg.K, cfg.Alpha, space)
+	if len(cfg.Bootstrap) > 0 {
+		log.Printf("bootstrapping from %v", strings.Join(cfg.Bootstrap, ", "))
+	}
+
+	if cfg.DataDir != "" {
+		n, err := loadValues(node, filepath.Join(cfg.DataDir, valueDir))
+		if err != nil {
+			log.Printf("loading values: %v", err)
+		}
+		log.Printf("loaded %v values from %v", n, cfg.DataDir)
+	}
+
+	opts := impl.ShutdownOptions{Timeout: timeout, Handoff: cfg.Handoff}
+	servers := []*http.Server{}
+	if cfg.Control != "" {
+		ln, err := listenControl(cfg.Control)
+		if err != nil {
+			node.Shutdown()
+			log.Fatalf("control: %v", err)
+		}
+		server := &http.Server{Handler: impl.NewControlHandler(node, opts)}
+		servers = append(servers, server)
+		go server.Serve(ln)
+		log.Printf("control API on %v", cfg.Control)
+	}
+	if cfg.Gateway != "" {
+		ln, err := net.Listen("tcp", cfg.Gateway)
+		if err != nil {
+			node.Shutdown()
+			log.Fatalf("gateway: %v", err)
+		}
+		server := &http.Server{Handler: impl.NewGatewayHandler(node)}
+		servers = append(servers, server)
+		go server.Serve(ln)
+		log.Printf("HTTP gateway on %v", cfg.Gateway)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-signals:
+		log.Printf("received %v", sig)
+		if err := node.ShutdownWith(opts); err != nil {
+			log.Printf("shutdown: %v", err)
+		}
+	case <-node.Done():
+		log.Printf("shut down by control API")
+	}
+
+	// Let in-flight HTTP requests, such as the control request that
+	// shut the node down, finish.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	for _, server := range servers {
+		server.Shutdown(ctx)
+	}
+	cancel()
+
+	if cfg.DataDir != "" {
+		n, err := saveValues(node, filepath.Join(cfg.DataDir, valueDir))
+		if err != nil {
+			log.Fatalf("saving values: %v", err)
+		}
+		log.Printf("saved %v values to %v", n, cfg.DataDir)
+	}
+	log.Printf("stopped")
+}
+
+// parseConfig builds the configuration from the command line and any
+// configuration file it names.
+func parseConfig(args []string) (*config, error) {
+	cfg := &config{}
+	var bootstrap string
+	var file string
+
+	flags := flag.NewFlagSet("kdht-node", flag.ContinueOnError)
+	flags.StringVar(&file, "config", "", "JSON configuration `file`")
+	flags.StringVar(&cfg.ID, "id", "", "node ID in hex")
+	flags.StringVar(&cfg.Seed, "seed", "", "derive the node ID from this `string`")
+	flags.StringVar(&cfg.KeySpace, "key-space", keys.Default.Name(), "key space of the network, sha1 or sha256")
+	flags.StringVar(&cfg.Listen, "listen", "localhost:4586", "listening `address`")
+	flags.IntVar(&cfg.K, "k", 20, "k, the bucket size and replication factor")
+	flags.IntVar(&cfg.Alpha, "alpha", 3, "alpha, the lookup concurrency")
+	flags.StringVar(&bootstrap, "bootstrap", "", "comma-separated bootstrap node `addresses`")
+	flags.StringVar(&cfg.DataDir, "datadir", "", "data `directory` for the node ID and stored values")
+	flags.BoolVar(&cfg.Handoff, "handoff", false, "hand off stored values to other nodes on shutdown")
+	flags.StringVar(&cfg.ShutdownTimeout, "shutdown-timeout", "5s", "how long to wait for in-flight requests on shutdown")
+	flags.StringVar(&cfg.Control, "control", "", "serve the control API on this loopback or unix:path `address`")
+	flags.StringVar(&cfg.Gateway, "gateway", "", "serve the HTTP gateway on this `address`")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() != 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", flags.Args())
+	}
+	if bootstrap != "" {
+		cfg.Bootstrap = strings.Split(bootstrap, ",")
+	}
+
+	if file == "" {
+		return cfg, nil
+	}
+
+	// Start over from the file, then apply the flags that were
+	// explicitly given so that they take precedence.
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	merged := *cfg
+	if err := json.Unmarshal(data, &merged); err != nil {
+		return nil, fmt.Errorf("%v: %w", file, err)
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "id":
+			merged.ID = cfg.ID
+		case "seed":
+			merged.Seed = cfg.Seed
+		case "key-space":
+			merged.KeySpace = cfg.KeySpace
+		case "listen":
+			merged.Listen = cfg.Listen
+		case "k":
+			merged.K = cfg.K
+		case "alpha":
+			merged.Alpha = cfg.Alpha
+		case "bootstrap":
+			merged.Bootstrap = cfg.Bootstrap
+		case "datadir":
+			merged.DataDir = cfg.DataDir
+		case "handoff":
+			merged.Handoff = cfg.Handoff
+		case "shutdown-timeout":
+			merged.ShutdownTimeout = cfg.ShutdownTimeout
+		case "control":
+			merged.Control = cfg.Control
+		case "gateway":
+			merged.Gateway = cfg.Gateway
+		}
+	})
+	return &merged, nil
+}
+
+// nodeID determines the node ID from the configuration.  An explicit
+// ID takes precedence over a seed; with neither, the ID saved in the
+// data directory is used, or a random ID is generated (and saved, if
+// there is a data directory).  The ID is in space.
+func nodeID(cfg *config, space *keys.Space) (keys.Key, error) {
+	switch {
+	case cfg.ID != "" && cfg.Seed != "":
+		return keys.Key{}, errors.New("only one of id and seed may be given")
+	case cfg.ID != "":
+		return space.Parse(cfg.ID)
+	case cfg.Seed != "":
+		return space.Compute([]byte(cfg.Seed)), nil
+	}
+
+	path := filepath.Join(cfg.DataDir, idFile)
+	if cfg.DataDir != "" {
+		data, err := os.ReadFile(path)
+		if err == nil {
+			return space.Parse(strings.TrimSpace(string(data)))
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return keys.Key{}, err
+		}
+	}
+
+	id, err := space.RandomFrom(rand.Reader)
+	if err != nil {
+		return keys.Key{}, err
+	}
+
+	if cfg.DataDir != "" {
+		if err := os.MkdirAll(cfg.DataDir, 0755); err != nil {
+			return keys.Key{}, err
+		}
+		if err := os.WriteFile(path, []byte(id.String()+"\n"), 0644); err != nil {
+			return keys.Key{}, err
+		}
+	}
+	return id, nil
+}
+
+// listenControl listens on the control API address, which is either
+// "unix:" followed by a socket path or a TCP address on a loopback
+// interface.  The control API is unauthenticated, so it must not be
+// reachable from other hosts.
+func listenControl(addr string) (net.Listener, error) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		// Remove a socket left behind by an earlier run
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return nil, fmt.Errorf("%v is not a loopback address", addr)
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// loadValues stores every file in dir that is named by a hex key into
+// the node's local storage.
+func loadValues(node *impl.KdmNode, dir string) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, entry := range entries {
+		if _, err := node.KeySpace().Parse(entry.Name()); err != nil {
+			continue
+		}
+		val, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return n, err
+		}
+		if err := node.StoreLocal(val); err != nil {
+			return n, fmt.Errorf("%v: %w", entry.Name(), err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// saveValues writes the node's locally stored values to dir, one file
+// per value named by its hex key, and then removes the files of values
+// that are no longer stored.  Each file is written under a temporary
+// name and renamed into place, so a failure partway leaves every value
+// that was saved before, and files not named by a key are left alone.
+func saveValues(node *impl.KdmNode, dir string) (int, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+
+	vals := node.LocalValues()
+	saved := make(map[string]bool)
+	for _, val := range vals {
+		name := node.KeySpace().Compute(val).String()
+		if err := writeFile(dir, name, val); err != nil {
+			return 0, err
+		}
+		saved[name] = true
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return len(vals), err
+	}
+	for _, entry := range entries {
+		if _, err := node.KeySpace().Parse(entry.Name()); err != nil || saved[entry.Name()] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, entry.Name())); err != nil {
+			return len(vals), err
+		}
+	}
+	return len(vals), nil
+}
+
+// writeFile replaces the file name in dir with data, by writing a
+// temporary file and renaming it.
+func writeFile(dir string, name string, data []byte) error {
+	f, err := os.CreateTemp(dir, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), filepath.Join(dir, name))
+}
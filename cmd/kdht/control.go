@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+	"cse586.kdht/impl"
+)
+
+// controlClient performs operations through the control API of a
+// running kdht-node rather than through an ephemeral node.
+type controlClient struct {
+	base   string
+	client *http.Client
+}
+
+// newControlClient returns a client for the control API at addr,
+// which is either "unix:" followed by a socket path or a TCP address.
+func newControlClient(addr string) *controlClient {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", path)
+			},
+		}
+		return &controlClient{base: "http://kdht-node", client: &http.Client{Transport: transport}}
+	}
+	return &controlClient{base: "http://" + addr, client: &http.Client{}}
+}
+
+// do performs a request and decodes the JSON response into v.  An
+// error response is returned as an error.
+func (cc *controlClient) do(method string, path string, body []byte, v any) error {
+	req, err := http.NewRequest(method, cc.base+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		failure := impl.ControlResult{}
+		if json.Unmarshal(data, &failure) == nil && failure.Error != "" {
+			return errors.New(failure.Error)
+		}
+		return fmt.Errorf("control API: %v", resp.Status)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (cc *controlClient) Store(val []byte) error {
+	return cc.do(http.MethodPost, "/store", val, &impl.ControlResult{})
+}
+
+func (cc *controlClient) FindValue(id keys.Key) ([]byte, kdht.NodeInfo, error) {
+	resp := impl.ControlResult{}
+	err := cc.do(http.MethodGet, "/find-value?key="+id.String(), nil, &resp)
+	if err != nil {
+		return nil, kdht.NodeInfo{}, err
+	}
+	info, err := fromJSON(resp.Node)
+	if err != nil {
+		return nil, kdht.NodeInfo{}, err
+	}
+	return resp.Value, kdht.NodeInfo{Id: info.Id, Address: info.Address}, nil
+}
+
+func (cc *controlClient) FindNode(id keys.Key) ([]*kdht.NodeInfo, error) {
+	resp := impl.ControlResult{}
+	if err := cc.do(http.MethodGet, "/find-node?id="+id.String(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return fromJSONList(resp.Nodes)
+}
+
+func (cc *controlClient) Ping(id keys.Key, message []byte) error {
+	return cc.ping(&impl.ControlPing{ID: id.String(), Message: string(message)})
+}
+
+func (cc *controlClient) PingAddress(addr string, message []byte) error {
+	return cc.ping(&impl.ControlPing{Address: addr, Message: string(message)})
+}
+
+func (cc *controlClient) ping(request *impl.ControlPing) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	return cc.do(http.MethodPost, "/ping", body, &impl.ControlResult{})
+}
+
+func (cc *controlClient) neighbors() ([]impl.ControlNode, error) {
+	resp := impl.ControlResult{}
+	err := cc.do(http.MethodGet, "/neighbors", nil, &resp)
+	return resp.Nodes, err
+}
+
+func (cc *controlClient) routing() ([]impl.ControlBucket, error) {
+	dump := impl.ControlRouting{}
+	err := cc.do(http.MethodGet, "/routing", nil, &dump)
+	return dump.Buckets, err
+}
+
+func (cc *controlClient) storage() (*impl.StorageStats, error) {
+	stats := &impl.StorageStats{}
+	err := cc.do(http.MethodGet, "/storage", nil, stats)
+	return stats, err
+}
+
+func (cc *controlClient) shutdown() error {
+	return cc.do(http.MethodPost, "/shutdown", nil, &impl.ControlResult{})
+}
+
+// fromJSON converts a node from the control API back into a NodeInfo.
+func fromJSON(n *impl.ControlNode) (*kdht.NodeInfo, error) {
+	if n == nil {
+		return nil, errors.New("control API: missing node")
+	}
+	id, err := keys.Parse(n.ID)
+	if err != nil {
+		return nil, fmt.Errorf("control API: invalid node ID %q", n.ID)
+	}
+	return &kdht.NodeInfo{Id: id.Bytes(), Address: n.Address}, nil
+}
+
+func fromJSONList(list []impl.ControlNode) ([]*kdht.NodeInfo, error) {
+	infos := []*kdht.NodeInfo{}
+	for i := range list {
+		info, err := fromJSON(&list[i])
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
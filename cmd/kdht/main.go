@@ -0,0 +1,322 @@
+// The kdht command is a command line client for a running k-DHT.
+//
+// It starts an ephemeral node, bootstraps it from one or more nodes
+// already in the DHT (typically a local kdht-node daemon), performs a
+// single operation, and shuts the ephemeral node down again.
+//
+// Usage:
+//
+//	kdht [flags] put [file]        store a file (or stdin), print its key
+//	kdht [flags] get KEY           retrieve the value for a hex key
+//	kdht [flags] ping ID|ADDRESS   ping a node by hex ID or address
+//	kdht [flags] find-node ID      find the K nodes closest to a hex ID
+//	kdht [flags] neighbors         list the nodes known after bootstrap
+//
+// With -control, operations are instead performed by a running
+// kdht-node through its control API, and these are also available:
+//
+//	kdht -control ADDR routing     dump the daemon's routing table
+//	kdht -control ADDR storage     show the daemon's storage statistics
+//	kdht -control ADDR shutdown    shut the daemon down
+//
+// With -json, results are printed as a single JSON object for use in
+// scripts.  The routing table server kdht-router must be in the PATH.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+	"cse586.kdht/impl"
+)
+
+// shutdownTimeout bounds how long the ephemeral node takes to shut
+// down and hand off its values.
+const shutdownTimeout = 5 * time.Second
+
+// dht is the set of operations used by the subcommands, provided
+// either by an ephemeral node or by a daemon's control API.
+type dht interface {
+	Store(val []byte) error
+	FindValue(id keys.Key) ([]byte, kdht.NodeInfo, error)
+	FindNode(id keys.Key) ([]*kdht.NodeInfo, error)
+	Ping(id keys.Key, message []byte) error
+	PingAddress(addr string, message []byte) error
+}
+
+// client holds the command line settings and either the ephemeral
+// node or the control API client.
+type client struct {
+	bootstrap []string
+	listen    string
+	k         int
+	alpha     int
+	json      bool
+	message   string
+	space     *keys.Space
+	control   *controlClient
+	node      *impl.KdmNode
+	dht       dht
+}
+
+// result is the JSON output of every subcommand.  Only the fields
+// relevant to the subcommand are present.  Nodes and buckets are
+// written as the control API writes them.
+type result struct {
+	Key     string               `json:"key,omitempty"`
+	Value   []byte               `json:"value,omitempty"`
+	Node    *impl.ControlNode    `json:"node,omitempty"`
+	Nodes   []impl.ControlNode   `json:"nodes,omitempty"`
+	Buckets []impl.ControlBucket `json:"buckets,omitempty"`
+	Storage *impl.StorageStats   `json:"storage,omitempty"`
+	Error   string               `json:"error,omitempty"`
+}
+
+func main() {
+	log.SetPrefix("kdht: ")
+	log.SetFlags(0)
+
+	c := &client{}
+	var bootstrap string
+	flag.StringVar(&bootstrap, "bootstrap", "localhost:4586", "comma-separated bootstrap node `addresses`")
+	flag.StringVar(&c.listen, "listen", "localhost:0", "listening `address` for the ephemeral node")
+	flag.IntVar(&c.k, "k", 20, "k, the bucket size and replication factor")
+	flag.IntVar(&c.alpha, "alpha", 3, "alpha, the lookup concurrency")
+	flag.BoolVar(&c.json, "json", false, "print results as JSON")
+	flag.StringVar(&c.message, "message", "", "message to send with ping")
+	control := flag.String("control", "", "use the control API of the kdht-node at this `address` instead of an ephemeral node")
+	space := flag.String("key-space", keys.Default.Name(), "key space of the network, sha1 or sha256")
+	flag.Usage = usage
+	flag.Parse()
+	c.bootstrap = strings.Split(bootstrap, ",")
+
+	var err error
+	if c.space, err = keys.SpaceNamed(*space); err != nil {
+		log.Fatal(err)
+	}
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	if *control != "" {
+		c.control = newControlClient(*control)
+		c.dht = c.control
+	} else if err := c.start(); err != nil {
+		log.Fatal(err)
+	}
+	res, err := c.run(flag.Arg(0), flag.Args()[1:])
+	if c.node != nil {
+		// The ephemeral node may be one of the closest nodes to a
+		// key it stored, so hand its values off rather than
+		// losing them.
+		c.node.ShutdownWith(impl.ShutdownOptions{Timeout: shutdownTimeout, Handoff: true})
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+	c.print(res)
+	if err != nil {
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), "usage: kdht [flags] put [file] | get KEY | ping ID|ADDRESS | find-node ID | neighbors\n")
+	fmt.Fprintf(flag.CommandLine.Output(), "       kdht -control ADDR [flags] routing | storage | shutdown\n")
+	flag.PrintDefaults()
+}
+
+// start creates the ephemeral node and bootstraps it by pinging each
+// bootstrap node and then looking up its own ID.
+func (c *client) start() error {
+	id, err := c.space.RandomFrom(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	node, err := impl.NewNodeWith(id, c.listen, c.k, c.alpha, nil, impl.NodeOptions{KeySpace: c.space})
+	if err != nil {
+		return err
+	}
+	c.node = node
+	c.dht = node
+
+	contacted := false
+	for _, addr := range c.bootstrap {
+		if err = node.PingAddress(addr, nil); err == nil {
+			contacted = true
+		}
+	}
+	if !contacted {
+		node.Shutdown()
+		return fmt.Errorf("could not contact any bootstrap node: %w", err)
+	}
+
+	_, err = node.FindNode(id)
+	return err
+}
+
+// run performs a subcommand.
+func (c *client) run(cmd string, args []string) (*result, error) {
+	res := &result{}
+	switch cmd {
+	case "put":
+		if len(args) > 1 {
+			return res, errors.New("usage: put [file]")
+		}
+		in := os.Stdin
+		if len(args) == 1 {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return res, err
+			}
+			defer f.Close()
+			in = f
+		}
+		val, err := io.ReadAll(in)
+		if err != nil {
+			return res, err
+		}
+		res.Key = c.space.Compute(val).String()
+		return res, c.dht.Store(val)
+
+	case "get":
+		key, err := c.oneKey(args, "get KEY")
+		if err != nil {
+			return res, err
+		}
+		res.Key = key.String()
+		val, info, err := c.dht.FindValue(key)
+		if err != nil {
+			return res, err
+		}
+		res.Value = val
+		res.Node = toJSON(&info)
+		return res, nil
+
+	case "ping":
+		if len(args) != 1 {
+			return res, errors.New("usage: ping ID|ADDRESS")
+		}
+		id, err := c.space.Parse(args[0])
+		if err != nil {
+			// Not an ID, so it must be an address
+			return res, c.dht.PingAddress(args[0], []byte(c.message))
+		}
+		res.Key = args[0]
+		// Find the node first so that it is in the routing table
+		if _, err := c.dht.FindNode(id); err != nil {
+			return res, err
+		}
+		return res, c.dht.Ping(id, []byte(c.message))
+
+	case "find-node":
+		id, err := c.oneKey(args, "find-node ID")
+		if err != nil {
+			return res, err
+		}
+		res.Key = id.String()
+		nodes, err := c.dht.FindNode(id)
+		res.Nodes = toJSONList(nodes)
+		return res, err
+
+	case "neighbors":
+		if len(args) != 0 {
+			return res, errors.New("usage: neighbors")
+		}
+		if c.control != nil {
+			nodes, err := c.control.neighbors()
+			res.Nodes = nodes
+			return res, err
+		}
+		res.Nodes = toJSONList(c.node.Neighbors())
+		return res, nil
+
+	case "routing", "storage", "shutdown":
+		if c.control == nil {
+			return res, fmt.Errorf("%v requires -control", cmd)
+		}
+		if len(args) != 0 {
+			return res, fmt.Errorf("usage: %v", cmd)
+		}
+		var err error
+		switch cmd {
+		case "routing":
+			res.Buckets, err = c.control.routing()
+		case "storage":
+			res.Storage, err = c.control.storage()
+		case "shutdown":
+			err = c.control.shutdown()
+		}
+		return res, err
+	}
+	return res, fmt.Errorf("unknown command %q", cmd)
+}
+
+// print writes a result to standard output, either as JSON or as
+// plain text.  Errors are written to standard error in plain text.
+func (c *client) print(res *result) {
+	if c.json {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+		return
+	}
+
+	if res.Error != "" {
+		log.Print(res.Error)
+		return
+	}
+	switch {
+	case res.Value != nil:
+		os.Stdout.Write(res.Value)
+	case res.Nodes != nil:
+		for _, n := range res.Nodes {
+			fmt.Printf("%v %v\n", n.ID, n.Address)
+		}
+	case res.Buckets != nil:
+		for _, b := range res.Buckets {
+			for _, n := range b.Nodes {
+				fmt.Printf("%3v %v %v\n", b.Index, n.ID, n.Address)
+			}
+		}
+	case res.Storage != nil:
+		fmt.Printf("%v values, %v of %v bytes\n", res.Storage.Values, res.Storage.Bytes, res.Storage.Quota)
+	case res.Key != "":
+		fmt.Println(res.Key)
+	}
+}
+
+// oneKey parses the single hex key argument of a subcommand.
+func (c *client) oneKey(args []string, usage string) (keys.Key, error) {
+	if len(args) != 1 {
+		return keys.Key{}, fmt.Errorf("usage: %v", usage)
+	}
+	return c.space.Parse(args[0])
+}
+
+func toJSON(info *kdht.NodeInfo) *impl.ControlNode {
+	return &impl.ControlNode{ID: hex.EncodeToString(info.Id), Address: info.Address}
+}
+
+func toJSONList(infos []*kdht.NodeInfo) []impl.ControlNode {
+	list := []impl.ControlNode{}
+	for _, info := range infos {
+		list = append(list, *toJSON(info))
+	}
+	return list
+}
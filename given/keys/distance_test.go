@@ -14,12 +14,10 @@ import (
 	"bytes"
 	"crypto/sha1"
 	"testing"
-
-	"cse586.kdht/api/kdht"
 )
 
 func TestConsistentLengthDistance(t *testing.T) {
-	if kdht.KeyBytes != 20 {
+	if Size != 20 {
 		t.Error("Distance tests assume key length of 20 bytes")
 	}
 }
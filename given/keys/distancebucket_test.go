@@ -12,12 +12,10 @@ package keys
 
 import (
 	"testing"
-
-	"cse586.kdht/api/kdht"
 )
 
 func TestConsistentLengthDistanceBucket(t *testing.T) {
-	if kdht.KeyBytes != 20 {
+	if Size != 20 {
 		t.Error("KeyDistance tests assume key length of 20 bytes")
 	}
 }
@@ -0,0 +1,70 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package keys
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzGetBit(f *testing.F) {
+	f.Add(make([]byte, Size), 0)
+	f.Add(Compute([]byte("val1")).Bytes(), Bits-1)
+	f.Add([]byte{0x1}, 0)
+	f.Add(Compute(nil).Bytes(), -1)
+	f.Add(Compute(nil).Bytes(), Bits)
+
+	f.Fuzz(func(t *testing.T, x []byte, b int) {
+		bit := GetBit(x, b)
+		if bit != 0 && bit != 1 {
+			t.Fatalf("GetBit(%x, %v) returned %v", x, b, bit)
+		}
+		if Check(x) != nil || b < 0 || b >= Bits {
+			if bit != 0 {
+				t.Fatalf("GetBit(%x, %v) of an invalid key or bit returned %v", x, b, bit)
+			}
+		}
+	})
+}
+
+func FuzzDistance(f *testing.F) {
+	f.Add(make([]byte, Size), Compute(nil).Bytes())
+	f.Add(Compute([]byte("val1")).Bytes(), Compute([]byte("val2")).Bytes())
+	f.Add([]byte{0x1}, Compute(nil).Bytes())
+	f.Add([]byte{}, []byte(nil))
+
+	f.Fuzz(func(t *testing.T, x []byte, y []byte) {
+		d := Distance(x, y)
+		if d != Distance(y, x) {
+			t.Fatalf("Distance(%x, %x) is not symmetric", x, y)
+		}
+
+		b := DistanceBucket(d)
+		if b < 0 || b >= Bits {
+			t.Fatalf("DistanceBucket(%x) returned %v", d, b)
+		}
+		if Check(x) != nil || Check(y) != nil {
+			return
+		}
+
+		if bytes.Equal(x, y) != (d == [Size]byte{}) {
+			t.Fatalf("Distance(%x, %x) is %x", x, y, d)
+		}
+		if d != [Size]byte{} && GetBit(d[:], b) != 1 {
+			t.Fatalf("bit %v of %x is not set", b, d)
+		}
+		for bit := b + 1; bit < Bits; bit++ {
+			if GetBit(d[:], bit) != 0 {
+				t.Fatalf("bit %v of %x is above its bucket %v", bit, d, b)
+			}
+		}
+	})
+}
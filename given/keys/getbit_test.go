@@ -12,14 +12,12 @@ package keys
 
 import (
 	"testing"
-
-	"cse586.kdht/api/kdht"
 )
 
 var emptyID = make([]byte, 20)
 
 func TestConsistentLengthGetBit(t *testing.T) {
-	if kdht.KeyBytes != 20 {
+	if Size != 20 {
 		t.Error("GetBit tests assume key length of 20 bytes")
 	}
 }
@@ -39,15 +37,15 @@ func TestGetLowestBit(t *testing.T) {
 }
 
 func TestGetHighestBit(t *testing.T) {
-	if GetBit(emptyID, kdht.KeyBits-1) != 0 {
+	if GetBit(emptyID, Bits-1) != 0 {
 		t.Error("Highest bit of empty ID was not zero")
 	}
 
 	id := []byte{0x80, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
-	if GetBit(id, kdht.KeyBits-1) != 1 {
+	if GetBit(id, Bits-1) != 1 {
 		t.Error("Highest bit was not one")
 	}
-	if GetBit(id, kdht.KeyBits-2) != 0 {
+	if GetBit(id, Bits-2) != 0 {
 		t.Error("Second highest bit was not zero")
 	}
 }
@@ -0,0 +1,190 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package keys
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestKeyParseString(t *testing.T) {
+	k := Compute([]byte("TestKeyParseString"))
+	s := k.String()
+	if len(s) != 2*Size || strings.ToLower(s) != s {
+		t.Errorf("String returned %q", s)
+	}
+
+	parsed, err := Parse(s)
+	if err != nil || parsed != k {
+		t.Errorf("Parse(%q) returned %v, %v", s, parsed, err)
+	}
+
+	if _, err := Parse(s[:len(s)-2]); !errors.Is(err, LengthError) {
+		t.Errorf("Parse of a short key returned %v instead of LengthError", err)
+	}
+	if _, err := Parse("xyz"); err == nil {
+		t.Error("Parse of invalid hex succeeded")
+	}
+}
+
+func TestKeyFromBytes(t *testing.T) {
+	k := Compute([]byte("TestKeyFromBytes"))
+	b := k.Bytes()
+	exp := sha1.Sum([]byte("TestKeyFromBytes"))
+	if !bytes.Equal(b, exp[:]) {
+		t.Errorf("Bytes returned %x instead of %x", b, exp)
+	}
+
+	// The slice must be a copy
+	b[0] ^= 0xff
+	if b[0] == k.Bytes()[0] {
+		t.Error("Bytes returned a slice sharing storage with the key")
+	}
+
+	parsed, err := FromBytes(k.Bytes())
+	if err != nil || parsed != k {
+		t.Errorf("FromBytes returned %v, %v", parsed, err)
+	}
+
+	for _, n := range []int{0, 1, Size - 1, Size + 1} {
+		if _, err := FromBytes(make([]byte, n)); !errors.Is(err, LengthError) {
+			t.Errorf("FromBytes of %v bytes returned %v instead of LengthError", n, err)
+		}
+	}
+}
+
+func TestKeyDistance(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		a, _ := RandomFrom(rng)
+		b, _ := RandomFrom(rng)
+
+		d := Distance(a.Bytes(), b.Bytes())
+		if !bytes.Equal(a.Distance(b).Bytes(), d[:]) {
+			t.Fatalf("Key.Distance and Distance differ for %v and %v", a, b)
+		}
+		if a.Bucket(b) != DistanceBucket(d) {
+			t.Fatalf("Key.Bucket and DistanceBucket differ for %v and %v", a, b)
+		}
+		if a.Bucket(b) != b.Bucket(a) {
+			t.Fatalf("Bucket is not symmetric for %v and %v", a, b)
+		}
+	}
+}
+
+func TestKeyCmp(t *testing.T) {
+	target, _ := FromBytes(make([]byte, Size))
+	near := keyWith(Size, Size-1, 0x01)
+	far := keyWith(Size, 0, 0x80)
+
+	if target.Cmp(near, far) != -1 {
+		t.Error("Cmp did not find the nearer key closer")
+	}
+	if target.Cmp(far, near) != 1 {
+		t.Error("Cmp did not find the farther key farther")
+	}
+	if target.Cmp(far, far) != 0 {
+		t.Error("Cmp of a key with itself was nonzero")
+	}
+	if target.Cmp(target, near) != -1 {
+		t.Error("Cmp did not find the target closest to itself")
+	}
+}
+
+func TestKeyRandom(t *testing.T) {
+	if Random() == Random() {
+		t.Error("Random returned the same key twice")
+	}
+
+	a, err1 := RandomFrom(rand.New(rand.NewSource(586)))
+	b, err2 := RandomFrom(rand.New(rand.NewSource(586)))
+	if err1 != nil || err2 != nil || a != b {
+		t.Errorf("RandomFrom with the same seed returned %v and %v", a, b)
+	}
+
+	if _, err := RandomFrom(bytes.NewReader(make([]byte, Size-1))); err == nil {
+		t.Error("RandomFrom a short reader succeeded")
+	}
+}
+
+func TestSpaces(t *testing.T) {
+	for _, s := range []*Space{SHA1, SHA256} {
+		named, err := SpaceNamed(s.Name())
+		if err != nil || named != s {
+			t.Errorf("SpaceNamed(%q) returned %v, %v", s.Name(), named, err)
+		}
+
+		k := s.Compute([]byte("TestSpaces"))
+		if k.Size() != s.Size() || k.Bits() != s.Bits() || !s.Contains(k) {
+			t.Errorf("%v key %v has width %v", s, k, k.Size())
+		}
+		if s.Check(k.Bytes()) != nil {
+			t.Errorf("%v rejected its own key %v", s, k)
+		}
+		if parsed, err := s.Parse(k.String()); err != nil || parsed != k {
+			t.Errorf("%v Parse returned %v, %v", s, parsed, err)
+		}
+		if r := s.Random(); !s.Contains(r) {
+			t.Errorf("%v Random returned %v", s, r)
+		}
+	}
+
+	if _, err := SpaceNamed("md5"); err == nil {
+		t.Error("SpaceNamed of an unknown space succeeded")
+	}
+
+	exp := sha256.Sum256([]byte("TestSpaces"))
+	if k := SHA256.Compute([]byte("TestSpaces")); !bytes.Equal(k.Bytes(), exp[:]) {
+		t.Errorf("SHA256 computed %v instead of %x", k, exp)
+	}
+
+	// Keys of one space are not keys of another
+	k := SHA1.Compute(nil)
+	if SHA256.Contains(k) || SHA256.Check(k.Bytes()) == nil {
+		t.Error("SHA256 accepted a SHA1 key")
+	}
+	if _, err := SHA256.FromBytes(k.Bytes()); !errors.Is(err, LengthError) {
+		t.Errorf("SHA256 FromBytes of a SHA1 key returned %v", err)
+	}
+	if _, err := SHA256.Parse(k.String()); !errors.Is(err, LengthError) || !strings.Contains(err.Error(), "must be 32 bytes") {
+		t.Errorf("SHA256 Parse of a SHA1 key returned %v", err)
+	}
+	if SHA1.Compute(nil) == SHA256.Compute(nil) {
+		t.Error("keys of different widths compared equal")
+	}
+}
+
+func TestKeyBucketWide(t *testing.T) {
+	zero, _ := SHA256.FromBytes(make([]byte, SHA256.Size()))
+	for bit := 0; bit < SHA256.Bits(); bit++ {
+		k := keyWith(SHA256.Size(), SHA256.Size()-1-bit/8, byte(1<<(bit%8)))
+		if b := zero.Bucket(k); b != bit {
+			t.Fatalf("key with only bit %v set is in bucket %v", bit, b)
+		}
+	}
+	if b := zero.Bucket(zero); b != 0 {
+		t.Errorf("Bucket of identical keys was %v", b)
+	}
+}
+
+// keyWith returns a key of the given width with byte i set to v and
+// every other byte zero.
+func keyWith(size int, i int, v byte) Key {
+	b := make([]byte, size)
+	b[i] = v
+	k, _ := FromBytes(b)
+	return k
+}
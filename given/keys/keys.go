@@ -12,30 +12,397 @@ policies for more information.
 // operations on KDHT keys.  The purpose of this package is to remove
 // some of the effort of key manipulation, so that you can concentrate
 // on implementing the DHT structure itself.
+//
+// Every k-DHT network uses a single key Space, which fixes the width
+// of its keys and the hash function that computes the key of a value.
+// The functions of this package that do not take a Space use the
+// Default space, which is SHA1.
 package keys
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/sha1"
-
-	"cse586.kdht/api/kdht"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 )
 
-// Compute computes and returns the key for obj
-func Compute(obj []byte) []byte {
-	k := sha1.Sum(obj)
-	return k[:]
+// Size is the size in bytes of the keys in the Default space.  It is
+// also available as kdht.KeyBytes.
+const Size = sha1.Size
+
+// Bits is the size in bits of the keys in the Default space.  It is
+// also available as kdht.KeyBits.
+const Bits = 8 * Size
+
+// MaxSize is the size in bytes of the widest keys of any Space.
+const MaxSize = sha256.Size
+
+// MaxBits is the size in bits of the widest keys of any Space.
+const MaxBits = 8 * MaxSize
+
+// LengthError is returned for a key that is not the width of any
+// Space, or not the width of the Space it was checked against.
+var LengthError = errors.New("key has the wrong length")
+
+// Space is a key space: the width of its keys and the hash function
+// used to compute the key of a value.
+type Space struct {
+	name string
+	size int
+	hash func([]byte) []byte
+}
+
+// SHA1 is the space of 160-bit keys computed with SHA-1.  It is the
+// Default, and the only space supported by kdht-router.
+var SHA1 = &Space{"sha1", sha1.Size, func(obj []byte) []byte {
+	sum := sha1.Sum(obj)
+	return sum[:]
+}}
+
+// SHA256 is the space of 256-bit keys computed with SHA-256.
+var SHA256 = &Space{"sha256", sha256.Size, func(obj []byte) []byte {
+	sum := sha256.Sum256(obj)
+	return sum[:]
+}}
+
+// Default is the space used by networks that do not choose another.
+var Default = SHA1
+
+// spaces lists every Space, for SpaceNamed and FromBytes.
+var spaces = []*Space{SHA1, SHA256}
+
+// SpaceNamed returns the Space with the given name, as returned by
+// Space.Name.
+func SpaceNamed(name string) (*Space, error) {
+	for _, s := range spaces {
+		if s.name == name {
+			return s, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key space %q", name)
+}
+
+// Name returns the name of s, such as "sha256".
+func (s *Space) Name() string {
+	return s.name
+}
+
+func (s *Space) String() string {
+	return s.name
+}
+
+// Size returns the width in bytes of the keys in s.
+func (s *Space) Size() int {
+	return s.size
+}
+
+// Bits returns the width in bits of the keys in s, which is also the
+// number of k-buckets in a routing table for s.
+func (s *Space) Bits() int {
+	return 8 * s.size
+}
+
+// Compute returns the key of obj in s.
+func (s *Space) Compute(obj []byte) Key {
+	k := Key{n: uint8(s.size)}
+	copy(k.b[:], s.hash(obj))
+	return k
+}
+
+// Contains reports whether k is the width of the keys in s.  Keys of
+// two spaces of the same width cannot be told apart.
+func (s *Space) Contains(k Key) bool {
+	return k.Size() == s.size
+}
+
+// Check returns LengthError if x is not a valid key in s.  Keys
+// received from the network should be checked before they are used.
+func (s *Space) Check(x []byte) error {
+	if len(x) != s.size {
+		return LengthError
+	}
+	return nil
+}
+
+// FromBytes returns the key held in b, or LengthError if b is not a
+// valid key in s.
+func (s *Space) FromBytes(b []byte) (Key, error) {
+	if err := s.Check(b); err != nil {
+		return Key{}, err
+	}
+	return FromBytes(b)
+}
+
+// Parse returns the key in s written in hexadecimal in x.  Its errors
+// quote x, and the error for a key of another width wraps LengthError
+// and gives the width of s, so that they may be shown to a user as
+// they are.
+func (s *Space) Parse(x string) (Key, error) {
+	b, err := hex.DecodeString(x)
+	if err != nil {
+		return Key{}, fmt.Errorf("invalid key %q: %w", x, err)
+	}
+	if err := s.Check(b); err != nil {
+		return Key{}, fmt.Errorf("invalid key %q: %w: must be %v bytes", x, err, s.size)
+	}
+	return FromBytes(b)
+}
+
+// RandomFrom returns a key in s read from r, such as a seeded
+// math/rand source for reproducible keys.
+func (s *Space) RandomFrom(r io.Reader) (Key, error) {
+	k := Key{n: uint8(s.size)}
+	_, err := io.ReadFull(r, k.b[:s.size])
+	return k, err
+}
+
+// Random returns a key in s chosen uniformly at random.
+func (s *Space) Random() Key {
+	k, err := s.RandomFrom(rand.Reader)
+	if err != nil {
+		panic("keys: cannot read random bytes: " + err.Error())
+	}
+	return k
+}
+
+// Key is a k-DHT key, which is either a node ID or the address of a
+// value.  A key knows its own width, and keys are comparable, so they
+// may be used as map keys.  The zero Key has no width and is not a
+// key in any Space.
+type Key struct {
+	// b holds the key in its first n bytes, and zeros after.
+	b [MaxSize]byte
+	n uint8
+}
+
+// FromBytes returns the key held in b, such as the Id of a NodeInfo
+// or the Key of a Message.  It returns LengthError if b is not the
+// width of any Space; use Space.FromBytes to check that a key is in
+// a particular Space.
+func FromBytes(b []byte) (Key, error) {
+	for _, s := range spaces {
+		if len(b) == s.size {
+			k := Key{n: uint8(len(b))}
+			copy(k.b[:], b)
+			return k, nil
+		}
+	}
+	return Key{}, LengthError
+}
+
+// Parse returns the key written in hexadecimal in s, as produced by
+// Key.String.
+func Parse(s string) (Key, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return Key{}, err
+	}
+	return FromBytes(b)
+}
+
+// Random returns a key in the Default space chosen uniformly at
+// random.
+func Random() Key {
+	return Default.Random()
+}
+
+// RandomFrom returns a key in the Default space read from r.
+func RandomFrom(r io.Reader) (Key, error) {
+	return Default.RandomFrom(r)
+}
+
+// Size returns the width of k in bytes.
+func (k Key) Size() int {
+	return int(k.n)
+}
+
+// Bits returns the width of k in bits.
+func (k Key) Bits() int {
+	return 8 * int(k.n)
+}
+
+// Bytes returns a copy of k as a slice, for use in a NodeInfo or a
+// Message.
+func (k Key) Bytes() []byte {
+	return append([]byte(nil), k.b[:k.n]...)
+}
+
+// String returns k in hexadecimal.
+func (k Key) String() string {
+	return hex.EncodeToString(k.b[:k.n])
+}
+
+// Distance returns the XOR distance between k and other, which has
+// the width of k.  The distance between keys of different widths is
+// meaningless.
+func (k Key) Distance(other Key) Key {
+	d := Key{n: k.n}
+	for i := range d.b {
+		d.b[i] = k.b[i] ^ other.b[i]
+	}
+	return d
+}
+
+// Bucket returns the k-bucket of other relative to k, as given by
+// DistanceBucket for keys of the width of k.
+func (k Key) Bucket(other Key) int {
+	d := k.Distance(other)
+	return highestBit(d.b[:d.n])
+}
+
+// Cmp compares the distances from k to a and to b.  It returns -1 if a
+// is closer to k, 1 if b is closer, and 0 if a and b are the same key.
+// It is suitable for sorting keys by their distance to k.
+func (k Key) Cmp(a Key, b Key) int {
+	da := k.Distance(a)
+	db := k.Distance(b)
+	return bytes.Compare(da.b[:], db.b[:])
+}
+
+// Bit returns the value of bit b of k, where bit 0 is the lowest-order
+// bit, as for GetBit.  It returns 0 if b is not in 0 <= b < k.Bits().
+func (k Key) Bit(b int) int {
+	if b < 0 || b >= k.Bits() {
+		return 0
+	}
+	return int(k.b[k.Size()-1-b/8]>>(b%8)) & 1
+}
+
+// withBit returns k with bit b set to v.
+func (k Key) withBit(b int, v int) Key {
+	mask := byte(1 << (b % 8))
+	if v == 0 {
+		k.b[k.Size()-1-b/8] &^= mask
+	} else {
+		k.b[k.Size()-1-b/8] |= mask
+	}
+	return k
+}
+
+// CommonPrefix returns the number of leading bits shared by a and b.
+// Identical keys share all a.Bits() bits, and keys in bucket i
+// relative to each other share a.Bits() - 1 - i bits.  The prefix of
+// keys of different widths is meaningless.
+func CommonPrefix(a Key, b Key) int {
+	if a == b {
+		return a.Bits()
+	}
+	return a.Bits() - 1 - a.Bucket(b)
+}
+
+// Range is the set of keys from Lo to Hi inclusive, treating keys as
+// big-endian integers.  Lo and Hi have the same width.  The zero Range
+// is empty.
+type Range struct {
+	Lo Key
+	Hi Key
+}
+
+// PrefixRange returns the range of keys that share their first n bits
+// with k.  It returns the zero Range if n is not in 0 <= n <= k.Bits().
+func PrefixRange(k Key, n int) Range {
+	if n < 0 || n > k.Bits() {
+		return Range{}
+	}
+	r := Range{k, k}
+	for b := 0; b < k.Bits()-n; b++ {
+		r.Lo = r.Lo.withBit(b, 0)
+		r.Hi = r.Hi.withBit(b, 1)
+	}
+	return r
+}
+
+// BucketRange returns the range of keys in k-bucket b relative to id,
+// that is, the keys x for which id.Bucket(x) == b.  Bucket 0 holds id
+// itself and the key differing from it only in bit 0; every other
+// bucket b holds the 2^b keys that share the bits above b with id and
+// differ from it in bit b.  BucketRange returns the zero Range if b is
+// not in 0 <= b < id.Bits().
+func BucketRange(id Key, b int) Range {
+	if b < 0 || b >= id.Bits() {
+		return Range{}
+	}
+	if b == 0 {
+		return PrefixRange(id, id.Bits()-1)
+	}
+	return PrefixRange(id.withBit(b, 1-id.Bit(b)), id.Bits()-b)
+}
+
+// Empty reports whether r holds no keys.
+func (r Range) Empty() bool {
+	return r.Lo.n == 0 || r.Lo.n != r.Hi.n || bytes.Compare(r.Lo.b[:], r.Hi.b[:]) > 0
+}
+
+// Contains reports whether k is in r.  A key of another width than r
+// is not.
+func (r Range) Contains(k Key) bool {
+	if r.Empty() || k.n != r.Lo.n {
+		return false
+	}
+	return bytes.Compare(r.Lo.b[:], k.b[:]) <= 0 && bytes.Compare(k.b[:], r.Hi.b[:]) <= 0
+}
+
+func (r Range) String() string {
+	return r.Lo.String() + "-" + r.Hi.String()
 }
 
-// GetBit returns the value of the given bit in a key (or distance).
+// RandomFrom returns a key chosen uniformly from r using bytes read
+// from rd, such as a seeded math/rand source for reproducible keys.
+func (r Range) RandomFrom(rd io.Reader) (Key, error) {
+	if r.Empty() {
+		return Key{}, errors.New("random key from an empty range")
+	}
+	lo := new(big.Int).SetBytes(r.Lo.b[:r.Lo.n])
+	span := new(big.Int).SetBytes(r.Hi.b[:r.Hi.n])
+	span.Sub(span, lo).Add(span, big.NewInt(1))
+	v, err := rand.Int(rd, span)
+	if err != nil {
+		return Key{}, err
+	}
+	k := Key{n: r.Lo.n}
+	v.Add(v, lo).FillBytes(k.b[:k.n])
+	return k, nil
+}
+
+// Random returns a key chosen uniformly at random from r, which must
+// not be empty.
+func (r Range) Random() Key {
+	k, err := r.RandomFrom(rand.Reader)
+	if err != nil {
+		panic("keys: " + err.Error())
+	}
+	return k
+}
+
+// Compute computes and returns the key for obj in the Default space.
+func Compute(obj []byte) Key {
+	return Default.Compute(obj)
+}
+
+// Check returns LengthError if x is not a valid key in the Default
+// space.  Keys received from the network should be checked before
+// they are used, as the other functions in this package return
+// meaningless values for invalid keys.
+func Check(x []byte) error {
+	return Default.Check(x)
+}
+
+// GetBit returns the value of the given bit in a key (or distance) in
+// the Default space.
 //
-// This function returns a meaningless value if b >= kdht.KeyBits or
-// if len(x) != kdht.KeyBytes.
+// This function returns 0 if b is not in 0 <= b < Bits or if
+// len(x) != Size.
 func GetBit(x []byte, b int) int {
-	if b >= kdht.KeyBits || len(x) != kdht.KeyBytes {
+	if b < 0 || b >= Bits || len(x) != Size {
 		return 0
 	}
-	// Bit 0 is in x[kdht.KeyBytes-1]
-	v := x[kdht.KeyBytes-1-(b/8)]
+	// Bit 0 is in x[Size-1]
+	v := x[Size-1-(b/8)]
 	if v&byte(1<<(b%8)) == 0 {
 		return 0
 	} else {
@@ -43,30 +410,38 @@ func GetBit(x []byte, b int) int {
 	}
 }
 
-// Distance computes the distance between two keys x and y
+// Distance computes the distance between two keys x and y in the
+// Default space, given as slices.  Use Key.Distance for keys that are
+// already Keys.
 //
-// This function may crash if x and y are not valid keys.
-func Distance(x []byte, y []byte) (d [kdht.KeyBytes]byte) {
-	for i := 0; i < kdht.KeyBytes; i++ {
-		d[i] = x[i] ^ y[i]
+// If x or y is not a valid key, it is truncated or padded with zeros
+// to Size, and the result is meaningless.
+func Distance(x []byte, y []byte) (d [Size]byte) {
+	copy(d[:], x)
+	for i := 0; i < Size && i < len(y); i++ {
+		d[i] ^= y[i]
 	}
 	return
 }
 
 // Compute the k-bucket of the first bit difference in the distance
-// between two keys.
+// between two keys in the Default space.  Use Key.Bucket for keys of
+// other widths.
 //
 // We treat the key as a big-endian integer, so the zero bit of byte
-// KeyBytes - 1 of the key is the lowest-order bit.  Two keys
-// differing in the most significant bit go into bucket kdht.KeyBits -
-// 1, and two identical keys go into bucket 0.  This matches the
-// description of k-buckets in the Kademlia paper (see Section 2.2).
-//
-// The job of this function is therefore to find the _highest order
-// bit_ that is set in the given key distance, and return the index of
-// that bit.
-func DistanceBucket(d [kdht.KeyBytes]byte) int {
-	for i := 0; i < kdht.KeyBytes; i++ {
+// Size - 1 of the key is the lowest-order bit.  Two keys differing in
+// the most significant bit go into bucket Bits - 1, and two identical
+// keys go into bucket 0.  This matches the description of k-buckets
+// in the Kademlia paper (see Section 2.2).
+func DistanceBucket(d [Size]byte) int {
+	return highestBit(d[:])
+}
+
+// highestBit returns the index of the highest order bit that is set
+// in d, treated as a big-endian integer, or 0 if d is zero.
+func highestBit(d []byte) int {
+	bits := 8 * len(d)
+	for i := 0; i < len(d); i++ {
 		// If this byte is identical, the difference must be
 		// in another bucket
 		if d[i] == 0 {
@@ -82,7 +457,7 @@ func DistanceBucket(d [kdht.KeyBytes]byte) int {
 			if b&(1<<j) != 0 {
 				// This is the first non-zero bit in
 				// the distance.
-				return kdht.KeyBits - (8*i + (8 - j))
+				return bits - (8*i + (8 - j))
 			}
 		}
 	}
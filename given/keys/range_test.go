@@ -0,0 +1,231 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package keys
+
+import (
+	"bytes"
+	"math/big"
+	"math/rand"
+	"testing"
+)
+
+// rangeIDs returns the local IDs used by the range tests: all zeros,
+// all ones, and a few random IDs, in each Space.
+func rangeIDs() []Key {
+	rng := rand.New(rand.NewSource(43))
+	var ids []Key
+	for _, s := range spaces {
+		zero, _ := s.FromBytes(make([]byte, s.Size()))
+		ones, _ := s.FromBytes(bytes.Repeat([]byte{0xff}, s.Size()))
+		ids = append(ids, zero, ones)
+		for i := 0; i < 3; i++ {
+			k, _ := s.RandomFrom(rng)
+			ids = append(ids, k)
+		}
+	}
+	return ids
+}
+
+func toInt(k Key) *big.Int {
+	return new(big.Int).SetBytes(k.Bytes())
+}
+
+// fromInt returns v as a key of the given width, or false if v does
+// not fit.
+func fromInt(v *big.Int, size int) (Key, bool) {
+	if v.Sign() < 0 || v.BitLen() > 8*size {
+		return Key{}, false
+	}
+	b := make([]byte, size)
+	v.FillBytes(b)
+	k, _ := FromBytes(b)
+	return k, true
+}
+
+// rangeSize returns the number of keys in r.
+func rangeSize(r Range) *big.Int {
+	n := new(big.Int).Sub(toInt(r.Hi), toInt(r.Lo))
+	return n.Add(n, big.NewInt(1))
+}
+
+func TestKeyBit(t *testing.T) {
+	for _, id := range rangeIDs() {
+		if id.Size() == Size {
+			b := id.Bytes()
+			for i := 0; i < Bits; i++ {
+				if id.Bit(i) != GetBit(b, i) {
+					t.Fatalf("Bit(%v) of %v differs from GetBit", i, id)
+				}
+			}
+		}
+		if id.Bit(-1) != 0 || id.Bit(id.Bits()) != 0 {
+			t.Errorf("Bit out of range of %v was nonzero", id)
+		}
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	for _, id := range rangeIDs() {
+		if p := CommonPrefix(id, id); p != id.Bits() {
+			t.Errorf("CommonPrefix of %v with itself is %v", id, p)
+		}
+		for b := 0; b < id.Bits(); b++ {
+			other := id.withBit(b, 1-id.Bit(b))
+			if p := CommonPrefix(id, other); p != id.Bits()-1-b {
+				t.Fatalf("CommonPrefix of %v and %v is %v, not %v", id, other, p, id.Bits()-1-b)
+			}
+			if CommonPrefix(other, id) != CommonPrefix(id, other) {
+				t.Fatalf("CommonPrefix is not symmetric for %v and %v", id, other)
+			}
+		}
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+	for _, id := range rangeIDs() {
+		for n := 0; n <= id.Bits(); n++ {
+			r := PrefixRange(id, n)
+			if !r.Contains(id) {
+				t.Fatalf("PrefixRange(%v, %v) = %v does not contain %v", id, n, r, id)
+			}
+			if CommonPrefix(id, r.Lo) < n || CommonPrefix(id, r.Hi) < n {
+				t.Fatalf("PrefixRange(%v, %v) = %v has bounds outside the prefix", id, n, r)
+			}
+			exp := new(big.Int).Lsh(big.NewInt(1), uint(id.Bits()-n))
+			if rangeSize(r).Cmp(exp) != 0 {
+				t.Fatalf("PrefixRange(%v, %v) holds %v keys, not %v", id, n, rangeSize(r), exp)
+			}
+		}
+		if !PrefixRange(id, -1).Empty() || !PrefixRange(id, id.Bits()+1).Empty() {
+			t.Errorf("PrefixRange of %v out of range was not empty", id)
+		}
+	}
+}
+
+func TestBucketRangeBounds(t *testing.T) {
+	one := big.NewInt(1)
+	for _, id := range rangeIDs() {
+		total := new(big.Int)
+		for b := 0; b < id.Bits(); b++ {
+			r := BucketRange(id, b)
+			if r.Empty() {
+				t.Fatalf("BucketRange(%v, %v) is empty", id, b)
+			}
+			if id.Bucket(r.Lo) != b || id.Bucket(r.Hi) != b {
+				t.Fatalf("BucketRange(%v, %v) = %v has bounds in buckets %v and %v",
+					id, b, r, id.Bucket(r.Lo), id.Bucket(r.Hi))
+			}
+			if r.Contains(id) != (b == 0) {
+				t.Fatalf("BucketRange(%v, %v) = %v contains the local ID: %v", id, b, r, r.Contains(id))
+			}
+
+			// The keys just outside the range are in other buckets
+			if below, ok := fromInt(new(big.Int).Sub(toInt(r.Lo), one), id.Size()); ok {
+				if id.Bucket(below) == b || r.Contains(below) {
+					t.Fatalf("BucketRange(%v, %v) = %v does not start at its lower bound", id, b, r)
+				}
+			}
+			if above, ok := fromInt(new(big.Int).Add(toInt(r.Hi), one), id.Size()); ok {
+				if id.Bucket(above) == b || r.Contains(above) {
+					t.Fatalf("BucketRange(%v, %v) = %v does not end at its upper bound", id, b, r)
+				}
+			}
+
+			exp := new(big.Int).Lsh(one, uint(b))
+			if b == 0 {
+				exp = big.NewInt(2)
+			}
+			if rangeSize(r).Cmp(exp) != 0 {
+				t.Fatalf("BucketRange(%v, %v) holds %v keys, not %v", id, b, rangeSize(r), exp)
+			}
+			total.Add(total, exp)
+		}
+
+		// The buckets are disjoint, so together they hold every key
+		if exp := new(big.Int).Lsh(one, uint(id.Bits())); total.Cmp(exp) != 0 {
+			t.Errorf("the buckets of %v hold %v keys, not %v", id, total, exp)
+		}
+		if !BucketRange(id, -1).Empty() || !BucketRange(id, id.Bits()).Empty() {
+			t.Errorf("BucketRange of %v out of range was not empty", id)
+		}
+	}
+}
+
+// TestBucketRangeLowByte checks Contains against Bucket for every key
+// that differs from the local ID only in its last byte.
+func TestBucketRangeLowByte(t *testing.T) {
+	for _, id := range rangeIDs() {
+		for b := 0; b <= 8; b++ {
+			r := BucketRange(id, b)
+			for v := 0; v < 256; v++ {
+				kb := id.Bytes()
+				kb[len(kb)-1] = byte(v)
+				k, _ := FromBytes(kb)
+				if r.Contains(k) != (id.Bucket(k) == b) {
+					t.Fatalf("BucketRange(%v, %v) = %v contains %v: %v, but it is in bucket %v",
+						id, b, r, k, r.Contains(k), id.Bucket(k))
+				}
+			}
+		}
+	}
+}
+
+func TestRangeRandom(t *testing.T) {
+	rng := rand.New(rand.NewSource(586))
+	for _, id := range rangeIDs() {
+		for b := 0; b < id.Bits(); b++ {
+			r := BucketRange(id, b)
+			for i := 0; i < 4; i++ {
+				k, err := r.RandomFrom(rng)
+				if err != nil {
+					t.Fatalf("(RandomFrom failed) %v", err)
+				}
+				if !r.Contains(k) || id.Bucket(k) != b {
+					t.Fatalf("RandomFrom(%v) returned %v in bucket %v, not %v", r, k, id.Bucket(k), b)
+				}
+			}
+		}
+	}
+
+	// Both keys of bucket 0 are chosen
+	id := Compute([]byte("TestRangeRandom"))
+	r := BucketRange(id, 0)
+	seen := make(map[Key]bool)
+	for i := 0; i < 64; i++ {
+		seen[r.Random()] = true
+	}
+	if len(seen) != 2 || !seen[r.Lo] || !seen[r.Hi] {
+		t.Errorf("Random of %v returned %v distinct keys", r, len(seen))
+	}
+
+	a, _ := r.RandomFrom(rand.New(rand.NewSource(1)))
+	b, _ := r.RandomFrom(rand.New(rand.NewSource(1)))
+	if a != b {
+		t.Errorf("RandomFrom with the same seed returned %v and %v", a, b)
+	}
+
+	if _, err := (Range{}).RandomFrom(rng); err == nil {
+		t.Error("RandomFrom of the zero Range succeeded")
+	}
+	if _, err := (Range{r.Hi, r.Lo}).RandomFrom(rng); err == nil {
+		t.Error("RandomFrom of an inverted Range succeeded")
+	}
+}
+
+func TestRangeContainsWidth(t *testing.T) {
+	r := PrefixRange(SHA256.Compute(nil), 0)
+	if r.Contains(SHA1.Compute(nil)) {
+		t.Error("a SHA256 range contains a SHA1 key")
+	}
+	if (Range{}).Contains(Key{}) {
+		t.Error("the zero Range contains the zero Key")
+	}
+}
@@ -13,9 +13,21 @@ package router
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"cse586.kdht/api/kdht"
+	"cse586.kdht/api/kdht/kdhttest"
+	"cse586.kdht/given/keys"
+	"google.golang.org/protobuf/proto"
 )
 
 // We only need to provide a small number of tests here, because the
@@ -48,7 +60,7 @@ func TestLookupSelf(t *testing.T) {
 	key := sha1.Sum([]byte("Dogs and Chaplains"))
 	rt, _ := New(&kdht.NodeInfo{Id: key[:], Address: ""}, 3)
 
-	n, ok := rt.Lookup(key[:])
+	n, ok := rt.Lookup(toKey(key))
 	if !ok || bytes.Compare(n.Id, key[:]) != 0 {
 		t.Errorf("Could not look up self, or ID differed: %v %s", ok, n)
 	}
@@ -59,8 +71,383 @@ func TestLookupUnknown(t *testing.T) {
 	rt, _ := New(&kdht.NodeInfo{Id: key[:], Address: ""}, 3)
 
 	id := sha1.Sum(key[:])
-	_, ok := rt.Lookup(id[:])
+	_, ok := rt.Lookup(toKey(id))
 	if ok {
 		t.Error("Lookup of invalid node succeeded?")
 	}
 }
+
+func TestVersionRecorded(t *testing.T) {
+	key := sha1.Sum([]byte("Beautiful Day"))
+	rt, _ := New(&kdht.NodeInfo{Id: key[:], Address: "", Version: 0x10001, Capabilities: 1}, 3)
+
+	id := sha1.Sum(key[:])
+	rt.InsertNode(&kdht.NodeInfo{Id: id[:], Address: "a", Version: 0x10002, Capabilities: 3})
+
+	n, ok := rt.Lookup(toKey(id))
+	if !ok || n.Version != 0x10002 || n.Capabilities != 3 {
+		t.Errorf("Version was not recorded: %v %s", ok, n)
+	}
+
+	n, ok = rt.Lookup(toKey(key))
+	if !ok || n.Version != 0x10001 || n.Capabilities != 1 {
+		t.Errorf("Local version was not recorded: %v %s", ok, n)
+	}
+
+	// A newer advertisement from a contact wins
+	rt.InsertNode(&kdht.NodeInfo{Id: id[:], Address: "a", Version: 0x10003})
+	if n, ok = rt.Lookup(toKey(id)); !ok || n.Version != 0x10003 {
+		t.Errorf("Version was not updated: %v %s", ok, n)
+	}
+
+	// Versions are kept only for the nodes in the table
+	sr := rt.(*socketRouterClient)
+	for i := 0; i < 200; i++ {
+		other := sha1.Sum([]byte{byte(i)})
+		rt.InsertNode(&kdht.NodeInfo{Id: other[:], Address: fmt.Sprint(i), Version: 0x10001})
+	}
+	rt.RemoveNode(toKey(id))
+	present := 0
+	for i := 0; i < 200; i++ {
+		other := sha1.Sum([]byte{byte(i)})
+		if _, ok := rt.Lookup(toKey(other)); ok {
+			present++
+		}
+	}
+	sr.vl.Lock()
+	recorded := len(sr.versions)
+	sr.vl.Unlock()
+	if recorded != present+1 {
+		t.Errorf("%v versions were recorded for %v contacts", recorded, present)
+	}
+}
+
+func TestShadowReconciled(t *testing.T) {
+	key := sha1.Sum([]byte("Elvis Presley and America"))
+	rt, err := New(&kdht.NodeInfo{Id: key[:], Address: ""}, 3)
+	if err != nil {
+		t.Fatalf("Could not create router object: %v", err)
+	}
+	sr := rt.(*socketRouterClient)
+	requests := func() uint64 {
+		sr.l.Lock()
+		srv := sr.srv
+		sr.l.Unlock()
+		srv.wl.Lock()
+		defer srv.wl.Unlock()
+		return srv.nextID
+	}
+
+	// Inserting a new node takes a single round trip
+	id := sha1.Sum(key[:])
+	before := requests()
+	rt.InsertNode(&kdht.NodeInfo{Id: id[:], Address: "a"})
+	if sent := requests() - before; sent != 1 {
+		t.Errorf("Inserting a node sent %v requests", sent)
+	}
+
+	// The nodes that the server did not keep are pruned from the
+	// shadow table as it grows
+	var ids [][sha1.Size]byte
+	for i := 0; i < 500; i++ {
+		id := sha1.Sum([]byte(fmt.Sprint(i)))
+		ids = append(ids, id)
+		rt.InsertNode(&kdht.NodeInfo{Id: id[:], Address: fmt.Sprint(i)})
+	}
+	present := 1
+	for _, id := range ids {
+		if _, ok := rt.Lookup(toKey(id)); ok {
+			present++
+		}
+	}
+	sr.l.Lock()
+	recorded := len(sr.shadow.order)
+	sr.l.Unlock()
+	if recorded < present || recorded >= present+reconcileAfter {
+		t.Errorf("The shadow table holds %v nodes for %v contacts", recorded, present)
+	}
+}
+
+func TestRouterFallible(t *testing.T) {
+	key := sha1.Sum([]byte("Zoo Station"))
+	rt, _ := New(&kdht.NodeInfo{Id: key[:], Address: ""}, 3)
+	fallible, ok := rt.(kdht.FallibleRoutingTable)
+	if !ok {
+		t.Fatal("The router is not a FallibleRoutingTable")
+	}
+	v2 := kdht.AdaptRoutingTable(rt)
+
+	id := sha1.Sum(key[:])
+	if _, ok, err := v2.Lookup(toKey(id)); ok || err != nil {
+		t.Errorf("Lookup of an unknown node: %v %v", ok, err)
+	}
+	if err := v2.RemoveNode(toKey(id)); !errors.Is(err, kdht.InvalidNodeError) || errors.Is(err, kdht.RoutingError) {
+		t.Errorf("RemoveNode of an unknown node returned %v", err)
+	}
+
+	// Losing the server for good is a failure of every
+	// operation, not an empty table
+	t.Setenv("PATH", "")
+	fallible.(*socketRouterClient).srv.c.Close()
+	if k, err := v2.K(); !errors.Is(err, kdht.RoutingError) {
+		t.Errorf("K without a server returned %v, %v", k, err)
+	}
+	if err := v2.InsertNode(&kdht.NodeInfo{Id: id[:], Address: "a"}); !errors.Is(err, kdht.RoutingError) {
+		t.Errorf("InsertNode without a server returned %v", err)
+	}
+	if _, _, err := v2.Lookup(toKey(key)); !errors.Is(err, kdht.RoutingError) {
+		t.Errorf("Lookup without a server returned %v", err)
+	}
+	if _, err := v2.ClosestK(toKey(id)); !errors.Is(err, kdht.RoutingError) {
+		t.Errorf("ClosestK without a server returned %v", err)
+	}
+	if _, err := v2.GetNodes(159); !errors.Is(err, kdht.RoutingError) {
+		t.Errorf("GetNodes without a server returned %v", err)
+	}
+	if _, err := v2.Buckets(); !errors.Is(err, kdht.RoutingError) {
+		t.Errorf("Buckets without a server returned %v", err)
+	}
+	if rt.K() != 0 || rt.ClosestK(toKey(id)) != nil {
+		t.Errorf("The RoutingTable methods did not report an empty table")
+	}
+}
+
+func TestRouterRestart(t *testing.T) {
+	key := sha1.Sum([]byte("Until the End of the World"))
+	rt, err := New(&kdht.NodeInfo{Id: key[:], Address: ""}, 3)
+	if err != nil {
+		t.Fatalf("Could not create router object: %v", err)
+	}
+	sr := rt.(*socketRouterClient)
+
+	var ids [][sha1.Size]byte
+	for i := 0; i < 20; i++ {
+		id := sha1.Sum([]byte{byte(i)})
+		ids = append(ids, id)
+		rt.InsertNode(&kdht.NodeInfo{Id: id[:], Address: fmt.Sprint(i), Version: 0x10001})
+	}
+	rt.RemoveNode(toKey(ids[0]))
+	before := closestAll(rt, ids)
+
+	// A server that exits is replaced with the same contents
+	sr.l.Lock()
+	srv := sr.srv
+	sr.l.Unlock()
+	srv.cmd.Process.Kill()
+	<-srv.exited
+
+	if after := closestAll(rt, ids); !equalNodes(before, after) {
+		t.Errorf("The table changed across a restart")
+	}
+	if _, ok := rt.Lookup(toKey(ids[0])); ok {
+		t.Errorf("A removed node was restored")
+	}
+	h := rt.(HealthReporter).Health()
+	if !h.Up || h.Restarts != 1 || h.LastFailure == nil || h.LastRestart.IsZero() {
+		t.Errorf("Health after a restart was %+v", h)
+	}
+	present := 0
+	for _, id := range ids {
+		if _, ok := rt.Lookup(toKey(id)); ok {
+			present++
+		}
+	}
+	if h.Contacts != present {
+		t.Errorf("Health reports %v contacts instead of %v", h.Contacts, present)
+	}
+}
+
+func TestRouterHang(t *testing.T) {
+	key := sha1.Sum([]byte("Stay (Faraway, So Close!)"))
+	rt, err := NewWith(&kdht.NodeInfo{Id: key[:], Address: ""}, 3, Options{RequestTimeout: 200 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Could not create router object: %v", err)
+	}
+	id := sha1.Sum(key[:])
+	rt.InsertNode(&kdht.NodeInfo{Id: id[:], Address: "a"})
+
+	// A server that stops answering is restarted, and the request
+	// is retried
+	sr := rt.(*socketRouterClient)
+	sr.l.Lock()
+	srv := sr.srv
+	sr.l.Unlock()
+	srv.cmd.Process.Signal(syscall.SIGSTOP)
+
+	start := time.Now()
+	if n, ok := rt.Lookup(toKey(id)); !ok || n.Address != "a" {
+		t.Errorf("Lookup after a hang returned %v %v", ok, n)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Lookup after a hang took %v", elapsed)
+	}
+	select {
+	case <-srv.exited:
+	default:
+		t.Errorf("The hung server was not killed")
+	}
+	if h := rt.(HealthReporter).Health(); !h.Up || h.Restarts != 1 || !errors.Is(h.LastFailure, os.ErrDeadlineExceeded) {
+		t.Errorf("Health after a hang was %+v", h)
+	}
+}
+
+func TestRouterConcurrent(t *testing.T) {
+	key := sha1.Sum([]byte("Lemon"))
+	rt, err := New(&kdht.NodeInfo{Id: key[:], Address: ""}, 20)
+	if err != nil {
+		t.Fatalf("Could not create router object: %v", err)
+	}
+
+	// Requests from many goroutines are in flight at once, and
+	// each receives the response to its own request
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		g := g
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				id := sha1.Sum([]byte{byte(g), byte(i)})
+				addr := fmt.Sprint(g, i)
+				rt.InsertNode(&kdht.NodeInfo{Id: id[:], Address: addr})
+				if n, ok := rt.Lookup(toKey(id)); ok && (!bytes.Equal(n.Id, id[:]) || n.Address != addr) {
+					t.Errorf("Lookup of %x returned %x at %v", id, n.Id, n.Address)
+				}
+				if nodes := rt.ClosestK(toKey(id)); len(nodes) == 0 {
+					t.Errorf("ClosestK of %x returned no nodes", id)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRouterOutOfOrder(t *testing.T) {
+	client, fake := net.Pipe()
+	srv := &server{c: client, exited: make(chan struct{})}
+	go srv.read()
+	defer srv.fail(fmt.Errorf("%w: test over", errServer))
+
+	// The fake server reads every request before it answers any,
+	// and then answers them last first
+	const n = 4
+	go func() {
+		var reqs []*kdht.RouteRequest
+		lenbuf := make([]byte, 4)
+		for len(reqs) < n {
+			if _, err := io.ReadFull(fake, lenbuf); err != nil {
+				return
+			}
+			var l int
+			fmt.Sscanf(string(lenbuf), "%04x", &l)
+			m := make([]byte, l)
+			if _, err := io.ReadFull(fake, m); err != nil {
+				return
+			}
+			req := new(kdht.RouteRequest)
+			if err := proto.Unmarshal(m, req); err != nil {
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		for i := n - 1; i >= 0; i-- {
+			resp := &kdht.RouteResponse{Type: reqs[i].Type, I: reqs[i].I, Id: reqs[i].Id}
+			m, _ := proto.Marshal(resp)
+			fake.Write(append([]byte(fmt.Sprintf("%04x", len(m))), m...))
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := srv.do(&kdht.RouteRequest{Type: kdht.RouteType_K, I: int32(i)}, 5*time.Second)
+			if err != nil || r.I != int32(i) {
+				t.Errorf("Request %v was answered with %v, %v", i, r.GetI(), err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// BenchmarkRouterParallel measures the throughput of a mix of
+// InsertNode and ClosestK from many goroutines, with each request
+// waiting for the one before it as they did before requests carried
+// IDs, and with requests in flight at once.
+func BenchmarkRouterParallel(b *testing.B) {
+	for _, serial := range []bool{true, false} {
+		name := "pipelined"
+		if serial {
+			name = "serial"
+		}
+		serial := serial
+		b.Run(name, func(b *testing.B) {
+			key := sha1.Sum([]byte("Zooropa"))
+			rt, err := New(&kdht.NodeInfo{Id: key[:], Address: ""}, 20)
+			if err != nil {
+				b.Fatalf("Could not create router object: %v", err)
+			}
+			var l sync.Mutex
+			var n uint32
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddUint32(&n, 1)
+					id := sha1.Sum([]byte(fmt.Sprint(i % 1024)))
+					if serial {
+						l.Lock()
+					}
+					if i%4 == 0 {
+						rt.InsertNode(&kdht.NodeInfo{Id: id[:], Address: fmt.Sprint(i)})
+					} else {
+						rt.ClosestK(toKey(id))
+					}
+					if serial {
+						l.Unlock()
+					}
+				}
+			})
+		})
+	}
+}
+
+// closestAll returns the nodes closest to each of ids.
+func closestAll(rt kdht.RoutingTable, ids [][sha1.Size]byte) [][]*kdht.NodeInfo {
+	var all [][]*kdht.NodeInfo
+	for _, id := range ids {
+		all = append(all, rt.ClosestK(toKey(id)))
+	}
+	return all
+}
+
+func equalNodes(a, b [][]*kdht.NodeInfo) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if len(a[i]) != len(b[i]) {
+			return false
+		}
+		for j := range a[i] {
+			if !proto.Equal(a[i][j], b[i][j]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func TestRouterConformance(t *testing.T) {
+	kdhttest.TestRoutingTable(t, New)
+}
+
+func TestRouterProperties(t *testing.T) {
+	kdhttest.TestProperties(t, New, 50)
+}
+
+func toKey(id [sha1.Size]byte) keys.Key {
+	key, _ := keys.FromBytes(id[:])
+	return key
+}
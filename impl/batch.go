@@ -0,0 +1,403 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package impl
+
+import (
+	"bytes"
+	"math/big"
+	"slices"
+	"sync"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// batchConcurrency bounds the number of lookups and peer connections
+// that a single StoreMany or FindValues call runs at once.
+const batchConcurrency = 16
+
+// StoreResult is the outcome of storing a single value with
+// StoreMany.  Err is nil or an error as returned by Store.
+type StoreResult struct {
+	Key keys.Key
+	Err error
+}
+
+// ValueResult is the outcome of retrieving a single key with
+// FindValues.  Value and Node are as returned by FindValue, and Err is
+// nil or an error as returned by FindValue.
+type ValueResult struct {
+	Key   keys.Key
+	Value []byte
+	Node  *kdht.NodeInfo
+	Err   error
+}
+
+// batchGroup is a set of nearby keys that share one lookup result.
+type batchGroup struct {
+	keys    []keys.Key
+	closest []*kdht.NodeInfo
+	// err is the failure of the routing table, if the lookup failed
+	err error
+}
+
+// StoreMany stores each of the given values as Store would, and
+// returns one result per value in the same order.
+//
+// Keys whose closest nodes are the same share a single node
+// lookup, and all of the STORE messages destined for one node are
+// sent over one connection when the node advertises CAP_PIPELINE.
+func (node *KdmNode) StoreMany(vals [][]byte) []StoreResult {
+	running := node.begin()
+	if running {
+		defer node.end()
+	}
+
+	results := make([]StoreResult, len(vals))
+	values := make(map[keys.Key][]byte)
+	ids := []keys.Key{}
+	for i, val := range vals {
+		results[i].Key = node.space.Compute(val)
+		if !running {
+			results[i].Err = kdht.ShutdownError
+		} else if len(val) > maxValueSize {
+			results[i].Err = kdht.TooLargeError
+		} else if _, ok := values[results[i].Key]; !ok {
+			values[results[i].Key] = val
+			ids = append(ids, results[i].Key)
+		}
+	}
+
+	groups := node.batchLookup(ids)
+	failed := groupErrors(groups)
+	peers, requests := node.storeRequests(groups, values, true)
+
+	counts := make(map[keys.Key]int)
+	rejections := make(map[keys.Key]error)
+	mut := &sync.Mutex{}
+	node.batchContact(peers, requests, func(request *kdht.Message, response *kdht.Message) {
+		key, _ := keys.FromBytes(request.Key)
+		err := responseError(response)
+		mut.Lock()
+		defer mut.Unlock()
+		if err == nil {
+			counts[key]++
+		} else if rejections[key] == nil {
+			rejections[key] = err
+		}
+	})
+
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		key := results[i].Key
+		if err, ok := failed[key]; ok {
+			results[i].Err = err
+			continue
+		}
+		results[i].Err = node.storeResult(counts[key], rejections[key])
+	}
+	return results
+}
+
+// FindValues retrieves each of the given keys as FindValue would, and
+// returns one result per key in the same order.
+//
+// Nearby keys share a single node lookup, and the nodes it finds are
+// sent GET messages for every key in the group, pipelined as in
+// StoreMany.  Any key that is not found this way falls back to a full
+// FindValue.
+func (node *KdmNode) FindValues(ids []keys.Key) []ValueResult {
+	running := node.begin()
+	if running {
+		defer node.end()
+	}
+
+	results := make([]ValueResult, len(ids))
+	wanted := make(map[keys.Key]bool)
+	unique := []keys.Key{}
+	for i, id := range ids {
+		results[i].Key = id
+		if !running {
+			results[i].Err = kdht.ShutdownError
+		} else if !node.space.Contains(id) {
+			results[i].Err = kdht.KeySpaceError
+		} else if !wanted[id] {
+			wanted[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	groups := node.batchLookup(unique)
+	failed := groupErrors(groups)
+	requests := make(map[string][]*kdht.Message)
+	peers := make(map[string]*kdht.NodeInfo)
+	for _, group := range groups {
+		for _, info := range group.closest {
+			peers[info.Address] = info
+			for _, key := range group.keys {
+				request := kdht.Message{}
+				request.Sender = node.info
+				request.Type = kdht.MessageType_GET
+				request.Key = key.Bytes()
+				requests[info.Address] = append(requests[info.Address], &request)
+			}
+		}
+	}
+
+	found := make(map[keys.Key]*kdht.Message)
+	mut := &sync.Mutex{}
+	node.batchContact(peers, requests, func(request *kdht.Message, response *kdht.Message) {
+		if response.Type != kdht.MessageType_VALUE {
+			return
+		}
+		key, _ := keys.FromBytes(request.Key)
+		mut.Lock()
+		defer mut.Unlock()
+		if _, ok := found[key]; !ok {
+			found[key] = response
+		}
+	})
+
+	missing := []keys.Key{}
+	for _, id := range unique {
+		if _, ok := failed[id]; ok {
+			continue
+		}
+		if _, ok := found[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+
+	sem := make(chan bool, batchConcurrency)
+	wg := &sync.WaitGroup{}
+	for _, id := range missing {
+		wg.Add(1)
+		go func(id keys.Key) {
+			defer wg.Done()
+			sem <- true
+			defer func() { <-sem }()
+
+			val, sender, err := node.findValue(id)
+			if err != nil {
+				return
+			}
+
+			response := kdht.Message{}
+			response.Sender = sender
+			response.Value = val
+			mut.Lock()
+			found[id] = &response
+			mut.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	for i := range results {
+		if results[i].Err != nil {
+			continue
+		}
+		if err, ok := failed[results[i].Key]; ok {
+			results[i].Err = err
+			continue
+		}
+
+		response, ok := found[results[i].Key]
+		if !ok {
+			results[i].Err = kdht.ValueError
+			continue
+		}
+		results[i].Value = response.Value
+		results[i].Node = response.Sender
+	}
+	return results
+}
+
+// batchLookup groups the given keys by the routing region they fall
+// in and performs one node lookup per group.
+//
+// A node's routing table has roughly K nodes in its deepest bucket,
+// so the number of buckets approximates how many leading bits two
+// keys must share before they are likely to have the same K closest
+// nodes.  This is only a guess, so every other key in a group whose K
+// closest nodes might differ from the lookup's result, as decided by
+// sharesClosest, gets a lookup of its own.
+func (node *KdmNode) batchLookup(ids []keys.Key) []*batchGroup {
+	sorted := cloneSlice(ids)
+	slices.SortFunc(sorted, func(key1, key2 keys.Key) int {
+		return bytes.Compare(key1.Bytes(), key2.Bytes())
+	})
+
+	prefix, err := node.routes.Buckets()
+	if err != nil {
+		return []*batchGroup{{keys: sorted, err: err}}
+	}
+	groups := []*batchGroup{}
+	for _, key := range sorted {
+		if len(groups) > 0 {
+			group := groups[len(groups)-1]
+			if keys.CommonPrefix(group.keys[0], key) >= prefix {
+				group.keys = append(group.keys, key)
+				continue
+			}
+		}
+		groups = append(groups, &batchGroup{keys: []keys.Key{key}})
+	}
+	node.lookupGroups(groups)
+	k, err := node.routes.K()
+	if err != nil {
+		return []*batchGroup{{keys: sorted, err: err}}
+	}
+
+	alone := []*batchGroup{}
+	for _, group := range groups {
+		if group.err != nil {
+			continue
+		}
+		shared := group.keys[:1]
+		for _, key := range group.keys[1:] {
+			if sharesClosest(key, group.keys[0], group.closest, k) {
+				shared = append(shared, key)
+			} else {
+				alone = append(alone, &batchGroup{keys: []keys.Key{key}})
+			}
+		}
+		group.keys = shared
+	}
+	node.lookupGroups(alone)
+	return append(groups, alone...)
+}
+
+// lookupGroups performs the node lookup of every group, at most
+// batchConcurrency at once.
+func (node *KdmNode) lookupGroups(groups []*batchGroup) {
+	sem := make(chan bool, batchConcurrency)
+	wg := &sync.WaitGroup{}
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group *batchGroup) {
+			defer wg.Done()
+			sem <- true
+			defer func() { <-sem }()
+
+			_, _, group.closest, group.err = node.nodeLookup(group.keys[0], false)
+		}(group)
+	}
+	wg.Wait()
+}
+
+// sharesClosest reports whether closest, the K nodes closest to lead,
+// are certainly also the K nodes closest to key.
+//
+// Every node outside closest is farther from lead than r, the
+// distance of the farthest node in closest.  The distance from key to
+// such a node is then more than r less the distance from lead to key,
+// because XOR distance is at most the sum of two distances, so no node
+// outside closest can be nearer key than the farthest node in closest
+// as long as that node is no farther than this bound.
+func sharesClosest(key keys.Key, lead keys.Key, closest []*kdht.NodeInfo, k int) bool {
+	// A lookup that found fewer than K nodes found every node
+	if len(closest) < k {
+		return true
+	}
+
+	distance := func(a keys.Key, b keys.Key) *big.Int {
+		return new(big.Int).SetBytes(a.Distance(b).Bytes())
+	}
+	r := new(big.Int)
+	far := new(big.Int)
+	for _, info := range closest {
+		id, _ := info.Key()
+		if d := distance(lead, id); d.Cmp(r) > 0 {
+			r = d
+		}
+		if d := distance(key, id); d.Cmp(far) > 0 {
+			far = d
+		}
+	}
+	bound := r.Sub(r, distance(lead, key))
+	return far.Cmp(bound) <= 0
+}
+
+// groupErrors returns the error of every key in a group whose lookup
+// failed.
+func groupErrors(groups []*batchGroup) map[keys.Key]error {
+	failed := make(map[keys.Key]error)
+	for _, group := range groups {
+		if group.err == nil {
+			continue
+		}
+		for _, key := range group.keys {
+			failed[key] = group.err
+		}
+	}
+	return failed
+}
+
+// storeRequests builds the STORE messages for every key in groups,
+// addressed to each of the group's closest nodes.  The local node is
+// skipped unless self is true.
+func (node *KdmNode) storeRequests(groups []*batchGroup, values map[keys.Key][]byte, self bool) (map[string]*kdht.NodeInfo, map[string][]*kdht.Message) {
+	requests := make(map[string][]*kdht.Message)
+	peers := make(map[string]*kdht.NodeInfo)
+	for _, group := range groups {
+		for _, info := range group.closest {
+			if !self && bytes.Equal(info.Id, node.info.Id) {
+				continue
+			}
+
+			peers[info.Address] = info
+			for _, key := range group.keys {
+				request := kdht.Message{}
+				request.Sender = node.info
+				request.Type = kdht.MessageType_STORE
+				request.Key = key.Bytes()
+				request.Value = values[key]
+				requests[info.Address] = append(requests[info.Address], &request)
+			}
+		}
+	}
+	return peers, requests
+}
+
+// batchContact sends each node its list of requests and passes every
+// response to handle along with the request it answers.  At most
+// batchConcurrency nodes are contacted at once.
+func (node *KdmNode) batchContact(peers map[string]*kdht.NodeInfo, requests map[string][]*kdht.Message, handle func(*kdht.Message, *kdht.Message)) {
+	sem := make(chan bool, batchConcurrency)
+	wg := &sync.WaitGroup{}
+	for addr, list := range requests {
+		wg.Add(1)
+		go func(info *kdht.NodeInfo, list []*kdht.Message) {
+			defer wg.Done()
+			sem <- true
+			defer func() { <-sem }()
+
+			var responses []*kdht.Message
+			if kdht.HasCapability(info, kdht.Capability_CAP_PIPELINE) {
+				responses, _ = node.contactAddressMany(list, info.Address)
+			} else {
+				responses = make([]*kdht.Message, len(list))
+				for i, request := range list {
+					responses[i], _ = node.contactAddress(request, info.Address)
+				}
+			}
+
+			for i, response := range responses {
+				if response != nil {
+					handle(list[i], response)
+				}
+			}
+		}(peers[addr], list)
+	}
+	wg.Wait()
+}
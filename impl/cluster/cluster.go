@@ -0,0 +1,477 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+// The cluster package launches a network of k-DHT nodes on the local
+// host for testing, either within the calling process or as kdht-node
+// subprocesses.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cse586.kdht/given/keys"
+	"cse586.kdht/impl"
+)
+
+// Topology determines which earlier nodes each node bootstraps from.
+type Topology int
+
+const (
+	// Chain bootstraps each node from the node started before it.
+	Chain Topology = iota
+	// Star bootstraps every node from the first node.
+	Star
+	// Random bootstraps each node from a randomly chosen node
+	// started before it.
+	Random
+)
+
+func (t Topology) String() string {
+	switch t {
+	case Chain:
+		return "chain"
+	case Star:
+		return "star"
+	case Random:
+		return "random"
+	}
+	return "Topology(" + strconv.Itoa(int(t)) + ")"
+}
+
+// ParseTopology returns the Topology with the given name.
+func ParseTopology(name string) (Topology, error) {
+	for _, t := range []Topology{Chain, Star, Random} {
+		if t.String() == name {
+			return t, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown topology %q", name)
+}
+
+// startTimeout is how long to wait for a subprocess to start serving
+// its control API.
+const startTimeout = 10 * time.Second
+
+// stopTimeout is how long to wait for an interrupted subprocess to
+// exit before it is killed.  It allows for kdht-node's default
+// shutdown timeout of 5 seconds.
+const stopTimeout = 10 * time.Second
+
+// controlTimeout bounds each request to the control API of a
+// subprocess.
+const controlTimeout = 10 * time.Second
+
+// stderrTail is the number of bytes of a subprocess's standard error
+// kept to explain its exit.
+const stderrTail = 2048
+
+// pollInterval is how often node state is sampled while starting
+// subprocesses and waiting for convergence.
+const pollInterval = 100 * time.Millisecond
+
+// Options describes a cluster to launch.
+type Options struct {
+	// N is the number of nodes.
+	N int
+	// K and Alpha are passed to every node.
+	K     int
+	Alpha int
+	// Host is the host name or address that every node listens
+	// on.  Ports are assigned automatically.  The default is
+	// localhost.
+	Host string
+	// Topology determines how the nodes bootstrap.
+	Topology Topology
+	// Seed makes node IDs and the random topology deterministic:
+	// node i has the ID KeySpace.Compute(Seed + "-" + i).  If Seed
+	// is empty, IDs are random.
+	Seed string
+	// KeySpace is the key space of the cluster's network.  The
+	// default is keys.Default.
+	KeySpace *keys.Space
+	// Subprocess runs each node as a kdht-node subprocess rather
+	// than within this process.
+	Subprocess bool
+	// Command is the kdht-node command used for subprocesses.  The
+	// default is "kdht-node", found in the PATH.
+	Command string
+}
+
+// Member is one node of a cluster.
+type Member struct {
+	// Index is the position of this node in the cluster, starting
+	// from 0.
+	Index int
+	// ID and Address are the node's ID and listening address.
+	ID      keys.Key
+	Address string
+	// Node is the node itself, or nil if it is a subprocess.
+	Node *impl.KdmNode
+
+	cmd     *exec.Cmd
+	exited  chan bool
+	stderr  *tailWriter
+	control *http.Client
+}
+
+// tailWriter keeps the last max bytes written to it.
+type tailWriter struct {
+	buf []byte
+	max int
+}
+
+func (w *tailWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > w.max {
+		w.buf = w.buf[len(w.buf)-w.max:]
+	}
+	return len(p), nil
+}
+
+// Status is a summary of a member's routing table.
+type Status struct {
+	// Neighbors is the number of other nodes in the routing table.
+	Neighbors int
+	// Buckets is the number of non-empty buckets.
+	Buckets int
+}
+
+// Cluster is a running set of nodes.
+type Cluster struct {
+	Members []*Member
+	opts    Options
+	dir     string
+}
+
+// Start launches a cluster.  Nodes are started one at a time, each
+// bootstrapping from nodes started earlier as chosen by the topology.
+// If any node fails to start, the nodes already started are shut down
+// and an error is returned.
+func Start(opts Options) (*Cluster, error) {
+	if opts.N < 1 {
+		return nil, errors.New("a cluster needs at least one node")
+	}
+	if opts.Host == "" {
+		opts.Host = "localhost"
+	}
+	if opts.Command == "" {
+		opts.Command = "kdht-node"
+	}
+	if opts.KeySpace == nil {
+		opts.KeySpace = keys.Default
+	}
+
+	c := &Cluster{opts: opts}
+	if opts.Subprocess {
+		dir, err := os.MkdirTemp("", "kdht-cluster")
+		if err != nil {
+			return nil, err
+		}
+		c.dir = dir
+	}
+
+	rng := mrand.New(mrand.NewSource(seedOf(opts.Seed)))
+	for i := 0; i < opts.N; i++ {
+		id, err := c.nodeID(i)
+		if err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+
+		var bootstrap []string
+		if i > 0 {
+			switch opts.Topology {
+			case Chain:
+				bootstrap = []string{c.Members[i-1].Address}
+			case Star:
+				bootstrap = []string{c.Members[0].Address}
+			case Random:
+				bootstrap = []string{c.Members[rng.Intn(i)].Address}
+			}
+		}
+
+		member := &Member{Index: i, ID: id}
+		if opts.Subprocess {
+			err = c.startSubprocess(member)
+		} else {
+			err = c.startNode(member)
+		}
+		if err == nil {
+			c.Members = append(c.Members, member)
+			err = member.join(bootstrap)
+		}
+		if err != nil {
+			c.Shutdown()
+			return nil, fmt.Errorf("node %v: %w", i, err)
+		}
+	}
+	return c, nil
+}
+
+// nodeID returns the ID of node i.
+func (c *Cluster) nodeID(i int) (keys.Key, error) {
+	if c.opts.Seed != "" {
+		return c.opts.KeySpace.Compute([]byte(c.opts.Seed + "-" + strconv.Itoa(i))), nil
+	}
+	return c.opts.KeySpace.RandomFrom(rand.Reader)
+}
+
+// seedOf derives the random topology's seed from the ID seed, or
+// from the current time if there is none.
+func seedOf(seed string) int64 {
+	if seed == "" {
+		return time.Now().UnixNano()
+	}
+	key := keys.Compute([]byte(seed))
+	return int64(binary.BigEndian.Uint64(key.Bytes()))
+}
+
+func (c *Cluster) startNode(member *Member) error {
+	addr := net.JoinHostPort(c.opts.Host, "0")
+	opts := impl.NodeOptions{KeySpace: c.opts.KeySpace}
+	node, err := impl.NewNodeWith(member.ID, addr, c.opts.K, c.opts.Alpha, nil, opts)
+	if err != nil {
+		return err
+	}
+	member.Node = node
+	member.Address = node.Info().Address
+	return nil
+}
+
+// startSubprocess starts a kdht-node with its control API on a Unix
+// socket, and waits until the control API reports its address.
+func (c *Cluster) startSubprocess(member *Member) error {
+	socket := filepath.Join(c.dir, fmt.Sprintf("node-%v.sock", member.Index))
+	args := []string{
+		"-id", member.ID.String(),
+		"-key-space", c.opts.KeySpace.Name(),
+		"-listen", net.JoinHostPort(c.opts.Host, "0"),
+		"-k", strconv.Itoa(c.opts.K),
+		"-alpha", strconv.Itoa(c.opts.Alpha),
+		"-control", "unix:" + socket,
+	}
+
+	member.cmd = exec.Command(c.opts.Command, args...)
+	member.stderr = &tailWriter{max: stderrTail}
+	member.cmd.Stderr = member.stderr
+	if err := member.cmd.Start(); err != nil {
+		return err
+	}
+	member.exited = make(chan bool)
+	go func() {
+		member.cmd.Wait()
+		close(member.exited)
+	}()
+
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}
+	member.control = &http.Client{Transport: transport, Timeout: controlTimeout}
+
+	deadline := time.After(startTimeout)
+	for {
+		info := struct {
+			Address string `json:"address"`
+		}{}
+		if err := member.get("/info", &info); err == nil {
+			member.Address = info.Address
+			return nil
+		}
+
+		select {
+		case <-member.exited:
+			return fmt.Errorf("%v exited: %v: %s", c.opts.Command, member.cmd.ProcessState,
+				bytes.TrimSpace(member.stderr.buf))
+		case <-deadline:
+			member.stop()
+			return errors.New("timed out waiting for the control API")
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// join pings each bootstrap node, so that it is in the member's
+// routing table, and then looks up the member's own ID to populate the
+// rest of the routing table and announce the member to its neighbors.
+func (member *Member) join(bootstrap []string) error {
+	id := member.ID.String()
+	for _, addr := range bootstrap {
+		var err error
+		if member.Node != nil {
+			err = member.Node.PingAddress(addr, nil)
+		} else {
+			err = member.post("/ping", fmt.Sprintf(`{"address": %q}`, addr))
+		}
+		if err != nil {
+			return fmt.Errorf("bootstrapping from %v: %w", addr, err)
+		}
+	}
+
+	if member.Node != nil {
+		_, err := member.Node.FindNode(member.ID)
+		return err
+	}
+	return member.get("/find-node?id="+id, &struct{}{})
+}
+
+// post sends a JSON request to a subprocess's control API.
+func (member *Member) post(path string, body string) error {
+	resp, err := member.control.Post("http://kdht-node"+path, "application/json", strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control API: %v", resp.Status)
+	}
+	return nil
+}
+
+// get fetches a JSON document from a subprocess's control API.
+func (member *Member) get(path string, v any) error {
+	resp, err := member.control.Get("http://kdht-node" + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("control API: %v", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Status returns a summary of the member's routing table.  It is
+// computed from the same neighbors and routing table dump whether the
+// member runs in this process or is a subprocess.
+func (member *Member) Status() (Status, error) {
+	if member.Node != nil {
+		dump, err := member.Node.RoutingDump()
+		if err != nil {
+			return Status{}, err
+		}
+		return Status{Neighbors: len(member.Node.Neighbors()), Buckets: len(dump.Buckets)}, nil
+	}
+
+	neighbors := impl.ControlResult{}
+	if err := member.get("/neighbors", &neighbors); err != nil {
+		return Status{}, err
+	}
+	dump := impl.ControlRouting{}
+	if err := member.get("/routing", &dump); err != nil {
+		return Status{}, err
+	}
+	return Status{Neighbors: len(neighbors.Nodes), Buckets: len(dump.Buckets)}, nil
+}
+
+// Status returns the status of every member, in order.
+func (c *Cluster) Status() ([]Status, error) {
+	statuses := make([]Status, len(c.Members))
+	for i, member := range c.Members {
+		status, err := member.Status()
+		if err != nil {
+			return nil, fmt.Errorf("node %v: %w", i, err)
+		}
+		statuses[i] = status
+	}
+	return statuses, nil
+}
+
+// WaitConverged waits until the routing tables of the cluster stop
+// changing: every node knows of at least one other node, and no node's
+// number of neighbors has changed for the given settle time.  It
+// returns the final statuses, or an error if the cluster has not
+// converged within timeout.
+func (c *Cluster) WaitConverged(settle time.Duration, timeout time.Duration) ([]Status, error) {
+	want := 1
+	if len(c.Members) == 1 {
+		want = 0
+	}
+	deadline := time.Now().Add(timeout)
+	var last []Status
+	stable := time.Now()
+	for {
+		statuses, err := c.Status()
+		if err != nil {
+			return nil, err
+		}
+
+		settled := last != nil
+		for i, status := range statuses {
+			if last != nil && status.Neighbors != last[i].Neighbors {
+				settled = false
+				stable = time.Now()
+			}
+			if status.Neighbors < want {
+				settled = false
+			}
+		}
+		if settled && time.Since(stable) >= settle {
+			return statuses, nil
+		}
+		last = statuses
+
+		if time.Now().After(deadline) {
+			return statuses, errors.New("the cluster did not converge")
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// Shutdown stops every member of the cluster and waits for them to
+// exit.
+func (c *Cluster) Shutdown() {
+	wg := &sync.WaitGroup{}
+	for _, member := range c.Members {
+		wg.Add(1)
+		go func(member *Member) {
+			defer wg.Done()
+			if member.Node != nil {
+				member.Node.Shutdown()
+			} else {
+				member.stop()
+			}
+		}(member)
+	}
+	wg.Wait()
+
+	if c.dir != "" {
+		os.RemoveAll(c.dir)
+	}
+}
+
+// stop interrupts a subprocess and waits for it to exit, killing it
+// if it has not exited within stopTimeout.
+func (member *Member) stop() {
+	member.cmd.Process.Signal(os.Interrupt)
+	select {
+	case <-member.exited:
+	case <-time.After(stopTimeout):
+		member.cmd.Process.Kill()
+		<-member.exited
+	}
+}
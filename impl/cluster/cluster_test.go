@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"bytes"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"cse586.kdht/given/keys"
+)
+
+func TestCluster_Topologies(t *testing.T) {
+	for _, topology := range []Topology{Chain, Star, Random} {
+		t.Run(topology.String(), func(t *testing.T) {
+			opts := Options{N: 6, K: 3, Alpha: 2, Topology: topology, Seed: "test"}
+			c, err := Start(opts)
+			if err != nil {
+				t.Fatalf("(start failed) %v", err)
+			}
+			defer c.Shutdown()
+
+			statuses, err := c.WaitConverged(500*time.Millisecond, 10*time.Second)
+			if err != nil {
+				t.Fatalf("(convergence failed) %v", err)
+			}
+			checkStatuses(t, statuses)
+
+			for i, member := range c.Members {
+				exp := keys.Compute([]byte("test-" + strconv.Itoa(i)))
+				if member.ID != exp {
+					t.Fatalf("node %v had ID %v instead of %v", i, member.ID, exp)
+				}
+			}
+
+			val := []byte("val1")
+			if err := c.Members[0].Node.Store(val); err != nil {
+				t.Fatalf("(store failed) %v", err)
+			}
+			// Look the value up from a node that does not hold it
+			finder := c.Members[0]
+			for _, member := range c.Members {
+				if len(member.Node.LocalValues()) == 0 {
+					finder = member
+				}
+			}
+			act, _, err := finder.Node.FindValue(keys.Compute(val))
+			if err != nil {
+				t.Fatalf("(find value failed) %v", err)
+			}
+			if !bytes.Equal(act, val) {
+				t.Fatalf("found an incorrect value:\n    exp: %v\n    act: %v\n", val, act)
+			}
+		})
+	}
+}
+
+func TestCluster_Subprocess(t *testing.T) {
+	command := filepath.Join(t.TempDir(), "kdht-node")
+	if out, err := exec.Command("go", "build", "-o", command, "cse586.kdht/cmd/kdht-node").CombinedOutput(); err != nil {
+		t.Fatalf("(building kdht-node failed) %v\n%s", err, out)
+	}
+
+	opts := Options{N: 4, K: 3, Alpha: 2, Topology: Star, Seed: "test", Subprocess: true, Command: command}
+	c, err := Start(opts)
+	if err != nil {
+		t.Fatalf("(start failed) %v", err)
+	}
+	defer c.Shutdown()
+
+	statuses, err := c.WaitConverged(500*time.Millisecond, 10*time.Second)
+	if err != nil {
+		t.Fatalf("(convergence failed) %v", err)
+	}
+	checkStatuses(t, statuses)
+
+	for i, member := range c.Members {
+		if member.Node != nil || member.Address == "" {
+			t.Fatalf("node %v is not a subprocess with an address", i)
+		}
+	}
+}
+
+// checkStatuses checks that every node of a converged cluster has a
+// neighbor, and no more non-empty buckets than it has nodes.
+func checkStatuses(t *testing.T, statuses []Status) {
+	t.Helper()
+	for i, status := range statuses {
+		if status.Neighbors == 0 {
+			t.Fatalf("node %v has no neighbors", i)
+		}
+		if status.Buckets < 1 || status.Buckets > status.Neighbors+1 {
+			t.Fatalf("node %v has %v buckets for %v neighbors", i, status.Buckets, status.Neighbors)
+		}
+	}
+}
+
+func TestCluster_ParseTopology(t *testing.T) {
+	for _, topology := range []Topology{Chain, Star, Random} {
+		act, err := ParseTopology(topology.String())
+		if err != nil || act != topology {
+			t.Fatalf("ParseTopology(%q) returned %v, %v", topology.String(), act, err)
+		}
+	}
+	if _, err := ParseTopology("ring"); err == nil {
+		t.Fatalf("ParseTopology accepted an unknown topology")
+	}
+}
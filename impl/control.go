@@ -0,0 +1,393 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package impl
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// StorageStats describes the local storage of a node.
+type StorageStats struct {
+	// Values is the number of values stored locally.
+	Values int `json:"values"`
+	// Bytes is the total size of the values stored locally.
+	Bytes int `json:"bytes"`
+	// Quota is the largest number of bytes that will be stored.
+	Quota int `json:"quota"`
+}
+
+// ControlNode is the JSON representation of a kdht.NodeInfo in the
+// control API.  IDs and keys are always hex encoded.
+type ControlNode struct {
+	ID           string `json:"id"`
+	Address      string `json:"address"`
+	Version      string `json:"version,omitempty"`
+	Capabilities uint64 `json:"capabilities,omitempty"`
+}
+
+// ControlBucket is one non-empty bucket of a routing table dump.
+type ControlBucket struct {
+	Index int           `json:"index"`
+	Nodes []ControlNode `json:"nodes"`
+}
+
+// ControlRouting is a dump of the routing table.
+type ControlRouting struct {
+	K       int             `json:"k"`
+	Buckets []ControlBucket `json:"buckets"`
+}
+
+// ControlResult is the response to an operation.  Only the fields
+// relevant to the operation are present.
+type ControlResult struct {
+	Key   string        `json:"key,omitempty"`
+	Value []byte        `json:"value,omitempty"`
+	Node  *ControlNode  `json:"node,omitempty"`
+	Nodes []ControlNode `json:"nodes,omitempty"`
+	Error string        `json:"error,omitempty"`
+}
+
+// ControlPing is the body of a ping request.  Exactly one of ID and
+// Address must be given.
+type ControlPing struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Message string `json:"message"`
+}
+
+// ControlShutdown is the optional body of a shutdown request.  Fields
+// that are not given keep the defaults passed to NewControlHandler.
+type ControlShutdown struct {
+	Timeout string `json:"timeout"`
+	Handoff *bool  `json:"handoff"`
+}
+
+// StorageStats returns statistics about this node's local storage.
+func (node *KdmNode) StorageStats() StorageStats {
+	node.storageMutex.Lock()
+	defer node.storageMutex.Unlock()
+	return StorageStats{
+		Values: len(node.localStorage),
+		Bytes:  node.storageUsed,
+		Quota:  storageQuota,
+	}
+}
+
+// Done returns a channel that is closed once this node has shut down,
+// whether Shutdown was called directly or through the control API.
+func (node *KdmNode) Done() <-chan struct{} {
+	return node.ctx.Done()
+}
+
+// NewControlHandler returns an HTTP handler exposing the operations
+// of node as a JSON API, for use by local tools and monitoring.  It
+// must only be served on a loopback address or a Unix socket, as it
+// performs no authentication.
+//
+// Every response but a DOT snapshot is a JSON object: a ControlNode
+// from /info, a ControlRouting from /routing, a RoutingSnapshot from
+// /routing/snapshot, a StorageStats from /storage, and a ControlResult
+// otherwise.  Failed requests carry an "error" field and a status code
+// chosen by StatusFor.  The endpoints are:
+//
+//	GET  /info                  this node's ID and address
+//	GET  /neighbors             every node in the routing table
+//	GET  /routing               the routing table, bucket by bucket
+//	GET  /routing/snapshot      a RoutingSnapshot, ?format=dot for Graphviz
+//	GET  /storage               local storage statistics
+//	POST /ping                  ping {"id"} or {"address"}, with "message"
+//	POST /store                 store the request body, return its key
+//	GET  /find-node?id=ID       the K nodes closest to ID
+//	GET  /find-value?key=KEY    look up a value
+//	POST /shutdown              shut down, optionally {"timeout", "handoff"}
+//
+// Shutdown uses the given options unless the request overrides them.
+func NewControlHandler(node *KdmNode, shutdown ShutdownOptions) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/info", func(w http.ResponseWriter, r *http.Request) {
+		if checkMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, toControlNode(node.Info()))
+		}
+	})
+	mux.HandleFunc("/neighbors", func(w http.ResponseWriter, r *http.Request) {
+		if checkMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, &ControlResult{Nodes: toControlNodes(node.Neighbors())})
+		}
+	})
+	mux.HandleFunc("/routing", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		if node.state.Load() != stateRunning {
+			writeError(w, kdht.ShutdownError)
+			return
+		}
+		dump, err := node.RoutingDump()
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, dump)
+	})
+	mux.HandleFunc("/routing/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		if node.state.Load() != stateRunning {
+			writeError(w, kdht.ShutdownError)
+			return
+		}
+		table, ok := node.routingTable.(interface{ Snapshot() *RoutingSnapshot })
+		if !ok {
+			writeJSON(w, http.StatusNotImplemented, &ControlResult{Error: "the routing table has no snapshots"})
+			return
+		}
+
+		snap := table.Snapshot()
+		switch format := r.URL.Query().Get("format"); format {
+		case "", "json":
+			writeJSON(w, http.StatusOK, snap)
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			snap.WriteDOT(w)
+		default:
+			writeJSON(w, http.StatusBadRequest, &ControlResult{Error: fmt.Sprintf("unknown format %q", format)})
+		}
+	})
+	mux.HandleFunc("/storage", func(w http.ResponseWriter, r *http.Request) {
+		if checkMethod(w, r, http.MethodGet) {
+			writeJSON(w, http.StatusOK, node.StorageStats())
+		}
+	})
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodPost) {
+			return
+		}
+		ping := ControlPing{}
+		if err := json.NewDecoder(r.Body).Decode(&ping); err != nil {
+			writeError(w, fmt.Errorf("%w: %v", kdht.BadRequestError, err))
+			return
+		}
+
+		var err error
+		switch {
+		case ping.ID != "" && ping.Address != "":
+			err = fmt.Errorf("%w: only one of id and address may be given", kdht.BadRequestError)
+		case ping.Address != "":
+			err = node.PingAddress(ping.Address, []byte(ping.Message))
+		default:
+			var id keys.Key
+			if id, err = parseHexKey(node.space, ping.ID); err == nil {
+				err = node.Ping(id, []byte(ping.Message))
+			}
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &ControlResult{Key: ping.ID})
+	})
+	mux.HandleFunc("/store", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodPost) {
+			return
+		}
+		val, err := readValue(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		if err := node.Store(val); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &ControlResult{Key: node.space.Compute(val).String()})
+	})
+	mux.HandleFunc("/find-node", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		id, err := parseHexKey(node.space, r.URL.Query().Get("id"))
+		if err == nil {
+			var nodes []*kdht.NodeInfo
+			if nodes, err = node.FindNode(id); err == nil {
+				writeJSON(w, http.StatusOK, &ControlResult{Key: id.String(), Nodes: toControlNodes(nodes)})
+				return
+			}
+		}
+		writeError(w, err)
+	})
+	mux.HandleFunc("/find-value", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		id, err := parseHexKey(node.space, r.URL.Query().Get("key"))
+		if err == nil {
+			var val []byte
+			var info kdht.NodeInfo
+			if val, info, err = node.FindValue(id); err == nil {
+				writeJSON(w, http.StatusOK, &ControlResult{Key: id.String(), Value: val, Node: toControlNode(&info)})
+				return
+			}
+		}
+		writeError(w, err)
+	})
+	mux.HandleFunc("/shutdown", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodPost) {
+			return
+		}
+		opts := shutdown
+		request := ControlShutdown{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, fmt.Errorf("%w: %v", kdht.BadRequestError, err))
+			return
+		}
+		if request.Timeout != "" {
+			timeout, err := time.ParseDuration(request.Timeout)
+			if err != nil {
+				writeError(w, fmt.Errorf("%w: %v", kdht.BadRequestError, err))
+				return
+			}
+			opts.Timeout = timeout
+		}
+		if request.Handoff != nil {
+			opts.Handoff = *request.Handoff
+		}
+
+		if err := node.ShutdownWith(opts); errors.Is(err, kdht.ShutdownError) {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &ControlResult{})
+	})
+	return mux
+}
+
+// RoutingDump returns every non-empty bucket of the routing table,
+// from the furthest bucket to the nearest, as served by /routing.
+func (node *KdmNode) RoutingDump() (*ControlRouting, error) {
+	k, err := node.routes.K()
+	if err != nil {
+		return nil, err
+	}
+	buckets, err := node.routes.Buckets()
+	if err != nil {
+		return nil, err
+	}
+
+	dump := &ControlRouting{K: k, Buckets: []ControlBucket{}}
+	maxbucket := node.space.Bits() - 1
+	minbucket := maxbucket - buckets
+	for i := maxbucket; i >= minbucket && i >= 0; i-- {
+		bucket, err := node.routes.GetNodes(i)
+		if err != nil {
+			return nil, err
+		}
+		if len(bucket) == 0 {
+			continue
+		}
+		dump.Buckets = append(dump.Buckets, ControlBucket{Index: i, Nodes: toControlNodes(bucket)})
+	}
+	return dump, nil
+}
+
+// StatusFor returns the HTTP status code that best describes err, as
+// returned by an operation of a Node.
+func StatusFor(err error) int {
+	switch {
+	case errors.Is(err, kdht.BadRequestError), errors.Is(err, kdht.KeySpaceError):
+		return http.StatusBadRequest
+	case errors.Is(err, kdht.ValueError), errors.Is(err, kdht.InvalidNodeError):
+		return http.StatusNotFound
+	case errors.Is(err, kdht.TooLargeError):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, kdht.QuotaError):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, kdht.ShutdownError), errors.Is(err, kdht.RoutingError):
+		return http.StatusServiceUnavailable
+	}
+	// StorageError, or any other failure to reach or get an answer
+	// from other nodes.
+	return http.StatusBadGateway
+}
+
+// checkMethod replies with 405 Method Not Allowed and returns false
+// if r does not use the given method.
+func checkMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, &ControlResult{Error: "method not allowed"})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, StatusFor(err), &ControlResult{Error: err.Error()})
+}
+
+// readValue reads a request body to be stored, refusing it with
+// TooLargeError as soon as it exceeds the largest storable value.
+func readValue(r *http.Request) ([]byte, error) {
+	val, err := io.ReadAll(io.LimitReader(r.Body, maxValueSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", kdht.BadRequestError, err)
+	}
+	if len(val) > maxValueSize {
+		return nil, kdht.TooLargeError
+	}
+	return val, nil
+}
+
+// parseHexKey decodes a hex key and checks its length, returning
+// BadRequestError if it is not a valid key in space.
+func parseHexKey(space *keys.Space, s string) (keys.Key, error) {
+	key, err := space.Parse(s)
+	if errors.Is(err, keys.LengthError) {
+		return key, fmt.Errorf("%w: key must be %v bytes", kdht.BadRequestError, space.Size())
+	}
+	if err != nil {
+		return key, fmt.Errorf("%w: invalid key %q", kdht.BadRequestError, s)
+	}
+	return key, nil
+}
+
+func toControlNode(info *kdht.NodeInfo) *ControlNode {
+	cn := &ControlNode{ID: hex.EncodeToString(info.Id), Address: info.Address}
+	if info.Version != 0 {
+		major, minor := kdht.VersionOf(info)
+		cn.Version = fmt.Sprintf("%v.%v", major, minor)
+		cn.Capabilities = info.Capabilities
+	}
+	return cn
+}
+
+func toControlNodes(infos []*kdht.NodeInfo) []ControlNode {
+	list := []ControlNode{}
+	for _, info := range infos {
+		list = append(list, *toControlNode(info))
+	}
+	return list
+}
@@ -12,12 +12,17 @@ package impl
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
+	"log"
 	"net"
 	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"cse586.kdht/api/kdht"
 	"cse586.kdht/given/keys"
@@ -28,15 +33,39 @@ type KdmNode struct {
 	info         *kdht.NodeInfo
 	alpha        int
 	routingTable kdht.RoutingTable
-	localStorage map[string][]byte
+	// routes is routingTable as a RoutingTableV2, through which the
+	// node learns of failures of the table itself
+	routes       kdht.RoutingTableV2
+	localStorage map[keys.Key][]byte
+	storageUsed  int
 	storageMutex *sync.Mutex
 	listener     net.Listener
-	closed       bool
+	state        atomic.Int32
+	stateMutex   *sync.Mutex
+	requests     *sync.WaitGroup
+	goroutines   *sync.WaitGroup
+	conns        map[net.Conn]bool
+	connMutex    *sync.Mutex
+	ctx          context.Context
+	cancel       context.CancelFunc
+	logger       atomic.Pointer[log.Logger]
+	transport    Transport
+	timeout      time.Duration
+	space        *keys.Space
 }
 
 const network = "tcp"
 const headerLength = 2
 
+// maxValueSize is the largest value that will be sent or accepted in
+// a STORE.  Messages are framed with a 16-bit length, so this leaves
+// room for the key, sender, and protobuf overhead.
+const maxValueSize = 1<<16 - 1024
+
+// storageQuota is the total number of value bytes that a node will
+// hold in its local storage.
+const storageQuota = 64 << 20
+
 // NewNode returns an instance of a Node that is fully prepared to
 // particpate in a k-DHT and serve requestuests.  The created node MUST be
 // listening on the specified address before this method returns.  It
@@ -55,22 +84,52 @@ const headerLength = 2
 //
 // This function returns an error if the new node cannot be created
 
-func NewNode(key []byte, addr string, k int, alpha int, neighbors []string) (*KdmNode, error) {
+func NewNode(key keys.Key, addr string, k int, alpha int, neighbors []string) (*KdmNode, error) {
+	return NewNodeWith(key, addr, k, alpha, neighbors, NodeOptions{})
+}
+
+// NewNodeWith is identical to NewNode, except that the node's
+// transport and routing table can be replaced through opts.
+func NewNodeWith(key keys.Key, addr string, k int, alpha int, neighbors []string, opts NodeOptions) (*KdmNode, error) {
 	if alpha < 1 {
 		return nil, errors.New("invalid alpha")
 	}
+	if opts.Transport == nil {
+		opts.Transport = TCPTransport
+	}
+	if opts.RoutingTable == nil {
+		opts.RoutingTable = NewRoutingTable
+	}
+	if opts.RequestTimeout == 0 {
+		opts.RequestTimeout = requestTimeout
+	}
+	if opts.KeySpace == nil {
+		opts.KeySpace = keys.Default
+	}
+	if !opts.KeySpace.Contains(key) {
+		return nil, fmt.Errorf("%w: %v is not a %v key", kdht.KeySpaceError, key, opts.KeySpace)
+	}
 
-	ln, err := net.Listen(network, addr)
+	ln, err := opts.Transport.Listen(addr)
 	if err != nil {
 		return nil, err
 	}
 
+	// A port of 0 asks the system to choose one, so advertise the
+	// address that is actually being listened on.
+	if _, port, err := net.SplitHostPort(addr); err == nil && port == "0" {
+		addr = ln.Addr().String()
+	}
+
 	info := new(kdht.NodeInfo)
-	info.Id = key
+	info.Id = key.Bytes()
 	info.Address = addr
+	info.Version = kdht.ProtocolVersion
+	info.Capabilities = kdht.Capabilities
 
-	table, err := NewRoutingTable(info, k)
+	table, err := opts.RoutingTable(info, k)
 	if err != nil {
+		ln.Close()
 		return nil, err
 	}
 
@@ -78,26 +137,45 @@ func NewNode(key []byte, addr string, k int, alpha int, neighbors []string) (*Kd
 	node.info = info
 	node.alpha = alpha
 	node.routingTable = table
-	node.localStorage = make(map[string][]byte)
+	node.routes = kdht.AdaptRoutingTable(table)
+	node.localStorage = make(map[keys.Key][]byte)
 	node.storageMutex = &sync.Mutex{}
 	node.listener = ln
-	node.closed = false
-
-	go node.listenForRequests()
+	node.state.Store(stateRunning)
+	node.stateMutex = &sync.Mutex{}
+	node.requests = &sync.WaitGroup{}
+	node.goroutines = &sync.WaitGroup{}
+	node.conns = make(map[net.Conn]bool)
+	node.connMutex = &sync.Mutex{}
+	node.ctx, node.cancel = context.WithCancel(context.Background())
+	node.transport = opts.Transport
+	node.timeout = opts.RequestTimeout
+	node.space = opts.KeySpace
+
+	node.spawn(node.listenForRequests)
 	for _, neighbor := range neighbors {
-		go func(addr string) {
+		addr := neighbor
+		node.spawn(func() {
 			request := kdht.Message{}
 			request.Sender = node.info
 			request.Type = kdht.MessageType_PING
 			node.contactAddress(&request, addr)
-		}(neighbor)
+		})
 	}
 
 	return &node, nil
 }
 
-func (node *KdmNode) Ping(id []byte, message []byte) error {
-	target, ok := node.routingTable.Lookup(id)
+func (node *KdmNode) Ping(id keys.Key, message []byte) error {
+	if !node.begin() {
+		return kdht.ShutdownError
+	}
+	defer node.end()
+
+	target, ok, err := node.routes.Lookup(id)
+	if err != nil {
+		return err
+	}
 	if !ok {
 		return kdht.InvalidNodeError
 	}
@@ -107,79 +185,302 @@ func (node *KdmNode) Ping(id []byte, message []byte) error {
 	request.Type = kdht.MessageType_PING
 	request.Value = message
 
-	_, err := node.contactAddress(&request, target.Address)
+	response, err := node.contactAddress(&request, target.Address)
 	if err != nil {
 		return err
 	}
-	return nil
+	return responseError(response)
+}
+
+// PingAddress is identical to Ping, except that the node is contacted
+// at the given address rather than looked up by ID.  If the node
+// responds, it is inserted into the routing table before this method
+// returns.
+func (node *KdmNode) PingAddress(addr string, message []byte) error {
+	if !node.begin() {
+		return kdht.ShutdownError
+	}
+	defer node.end()
+
+	request := kdht.Message{}
+	request.Sender = node.info
+	request.Type = kdht.MessageType_PING
+	request.Value = message
+
+	response, err := node.contactAddress(&request, addr)
+	if err != nil {
+		return err
+	}
+
+	err = responseError(response)
+	if err == nil {
+		err = node.routes.InsertNode(response.Sender)
+	}
+	return err
 }
 
 func (node *KdmNode) Store(val []byte) error {
-	if node.closed {
+	if !node.begin() {
 		return kdht.ShutdownError
 	}
+	defer node.end()
 
-	key := keys.Compute(val)
-	_, _, closest := node.nodeLookup(key, false)
+	if len(val) > maxValueSize {
+		return kdht.TooLargeError
+	}
 
+	key := node.space.Compute(val)
+	_, _, closest, err := node.nodeLookup(key, false)
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan *kdht.Message)
 	for _, info := range closest {
 		go func(info *kdht.NodeInfo) {
 			request := kdht.Message{}
 			request.Sender = node.info
 			request.Type = kdht.MessageType_STORE
-			request.Key = key
+			request.Key = key.Bytes()
 			request.Value = val
-			node.contactAddress(&request, info.Address)
+			response, err := node.contactAddress(&request, info.Address)
+			if err != nil {
+				ch <- nil
+				return
+			}
+			ch <- response
 		}(info)
 	}
 
-	if len(closest) < node.routingTable.K() {
-		return kdht.StorageError
+	count := 0
+	var rejection error
+	for range closest {
+		response := <-ch
+		if response == nil {
+			continue
+		}
+
+		err := responseError(response)
+		if err == nil {
+			count++
+		} else if rejection == nil {
+			rejection = err
+		}
 	}
-	return nil
+
+	return node.storeResult(count, rejection)
 }
 
-func (node *KdmNode) FindNode(id []byte) ([]*kdht.NodeInfo, error) {
-	if node.closed {
+func (node *KdmNode) FindNode(id keys.Key) ([]*kdht.NodeInfo, error) {
+	if !node.begin() {
 		return nil, kdht.ShutdownError
 	}
+	defer node.end()
+
+	if !node.space.Contains(id) {
+		return nil, kdht.KeySpaceError
+	}
 
-	_, _, closest := node.nodeLookup(id, false)
+	_, _, closest, err := node.nodeLookup(id, false)
+	if err != nil {
+		return nil, err
+	}
 	return closest, nil
 }
 
-func (node *KdmNode) FindValue(id []byte) ([]byte, kdht.NodeInfo, error) {
-	if node.closed {
+// Refresh looks up a random key in the range of every bucket of the
+// routing table but the last, so that the table learns of nodes for
+// each bucket it has room in.  A node joining a network should
+// refresh once it has looked up its own ID, as described in Section
+// 2.3 of the Kademlia paper.
+func (node *KdmNode) Refresh() error {
+	if !node.begin() {
+		return kdht.ShutdownError
+	}
+	defer node.end()
+
+	ranges, err := node.bucketRanges()
+	if err != nil {
+		return err
+	}
+	for _, r := range ranges {
+		if _, _, _, err := node.nodeLookup(r.Random(), false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketRanges returns the key range of every bucket of the routing
+// table but the last, farthest first.  A table whose buckets are not
+// the distance buckets, such as a KdmRoutingTable with more than one
+// bit per symbol, reports its own ranges.
+func (node *KdmNode) bucketRanges() ([]keys.Range, error) {
+	if table, ok := node.routingTable.(interface{ BucketRanges() []keys.Range }); ok {
+		return table.BucketRanges(), nil
+	}
+
+	buckets, err := node.routes.Buckets()
+	if err != nil {
+		return nil, err
+	}
+	self, _ := node.info.Key()
+	bits := node.space.Bits()
+	ranges := []keys.Range{}
+	for num := bits - 1; num > bits-buckets; num-- {
+		ranges = append(ranges, keys.BucketRange(self, num))
+	}
+	return ranges, nil
+}
+
+func (node *KdmNode) FindValue(id keys.Key) ([]byte, kdht.NodeInfo, error) {
+	if !node.begin() {
 		return nil, kdht.NodeInfo{}, kdht.ShutdownError
 	}
+	defer node.end()
 
-	val, sender, _ := node.nodeLookup(id, true)
+	val, sender, err := node.findValue(id)
+	if err != nil {
+		return nil, kdht.NodeInfo{}, err
+	}
+
+	return val, kdht.NodeInfo{Address: sender.Address, Id: sender.Id}, nil
+}
+
+func (node *KdmNode) findValue(id keys.Key) ([]byte, *kdht.NodeInfo, error) {
+	if !node.space.Contains(id) {
+		return nil, nil, kdht.KeySpaceError
+	}
+
+	val, sender, _, err := node.nodeLookup(id, true)
+	if err != nil {
+		return nil, nil, err
+	}
 	if val == nil {
-		return nil, kdht.NodeInfo{}, kdht.ValueError
+		return nil, nil, kdht.ValueError
 	}
+	return val, sender, nil
+}
 
-	return val, *sender, nil
+func (node *KdmNode) Get(id keys.Key, key keys.Key) ([]byte, error) {
+	if !node.begin() {
+		return nil, kdht.ShutdownError
+	}
+	defer node.end()
+
+	target, ok, err := node.routes.Lookup(id)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, kdht.InvalidNodeError
+	}
+	return node.getAddress(target.Address, key)
 }
 
-func (node *KdmNode) Shutdown() error {
-	if node.closed {
-		return kdht.ShutdownError
+func (node *KdmNode) GetAddress(addr string, key keys.Key) ([]byte, error) {
+	if !node.begin() {
+		return nil, kdht.ShutdownError
+	}
+	defer node.end()
+
+	return node.getAddress(addr, key)
+}
+
+func (node *KdmNode) getAddress(addr string, key keys.Key) ([]byte, error) {
+	if !node.space.Contains(key) {
+		return nil, kdht.KeySpaceError
+	}
+
+	request := kdht.Message{}
+	request.Sender = node.info
+	request.Type = kdht.MessageType_GET
+	request.Key = key.Bytes()
+
+	response, err := node.contactAddress(&request, addr)
+	if err != nil {
+		return nil, err
 	}
 
-	node.closed = true
-	return node.listener.Close()
+	switch response.Type {
+	case kdht.MessageType_VALUE:
+		return response.Value, nil
+	case kdht.MessageType_ACK:
+		return nil, kdht.ValueError
+	case kdht.MessageType_ERROR:
+		return nil, responseError(response)
+	}
+	return nil, fmt.Errorf("unexpected response to GET: %v", response.Type)
+}
+
+// Info returns the information that this node advertises to others.
+func (node *KdmNode) Info() *kdht.NodeInfo {
+	return node.info
+}
+
+// KeySpace returns the key space of this node's network.
+func (node *KdmNode) KeySpace() *keys.Space {
+	return node.space
+}
+
+// RoutingTable returns the routing table used by this node.
+func (node *KdmNode) RoutingTable() kdht.RoutingTable {
+	return node.routingTable
+}
+
+// SetLogger causes this node to log its activity to logger.  A nil
+// logger disables logging, which is the default.
+func (node *KdmNode) SetLogger(logger *log.Logger) {
+	node.logger.Store(logger)
+}
+
+// LocalValues returns the values stored locally at this node.
+func (node *KdmNode) LocalValues() [][]byte {
+	node.storageMutex.Lock()
+	defer node.storageMutex.Unlock()
+
+	vals := make([][]byte, 0, len(node.localStorage))
+	for _, val := range node.localStorage {
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+// StoreLocal stores a value in this node's local storage only, as if
+// it had been received in a STORE.  It fails with TooLargeError or
+// QuotaError under the same conditions as a STORE.
+func (node *KdmNode) StoreLocal(val []byte) error {
+	if len(val) > maxValueSize {
+		return kdht.TooLargeError
+	}
+
+	if !node.storeValue(node.space.Compute(val), val) {
+		return kdht.QuotaError
+	}
+	return nil
 }
 
 func (node *KdmNode) Neighbors() []*kdht.NodeInfo {
-	if node.closed {
+	if node.state.Load() != stateRunning {
 		return []*kdht.NodeInfo{}
 	}
 
+	// Neighbors cannot fail, so a failure of the routing table is
+	// only logged, and the neighbors found before it are returned
 	neighbors := []*kdht.NodeInfo{}
-	maxbucket := kdht.KeyBits - 1
-	minbucket := maxbucket - node.routingTable.Buckets()
+	buckets, err := node.routes.Buckets()
+	if err != nil {
+		node.logf("listing neighbors: %v", err)
+		return neighbors
+	}
+	maxbucket := node.space.Bits() - 1
+	minbucket := maxbucket - buckets
 	for i := minbucket; i <= maxbucket; i++ {
-		bucket := node.routingTable.GetNodes(i)
+		bucket, err := node.routes.GetNodes(i)
+		if err != nil {
+			node.logf("listing neighbors: %v", err)
+			break
+		}
 		if bucket == nil {
 			continue
 		}
@@ -203,36 +504,86 @@ func (node *KdmNode) processPing(message *kdht.Message, conn net.Conn) {
 }
 
 func (node *KdmNode) processStore(message *kdht.Message, conn net.Conn) {
-	node.storeValue(message.Key, message.Value)
+	key, err := node.space.FromBytes(message.Key)
+	if err != nil {
+		node.processError(message, kdht.ErrorCode_BAD_REQUEST, "invalid key length", conn)
+		return
+	}
+
+	if len(message.Value) > maxValueSize {
+		node.processError(message, kdht.ErrorCode_TOO_LARGE, "", conn)
+		return
+	}
+
+	if key != node.space.Compute(message.Value) {
+		node.processError(message, kdht.ErrorCode_BAD_REQUEST, "key does not match value", conn)
+		return
+	}
+
+	if !node.storeValue(key, message.Value) {
+		node.processError(message, kdht.ErrorCode_QUOTA_EXCEEDED, "", conn)
+		return
+	}
+
 	response := kdht.Message{}
 	response.Sender = node.info
 	response.Type = kdht.MessageType_ACK
+	response.Key = message.Key
 	node.sendMessage(&response, conn)
 }
 
 func (node *KdmNode) processGet(message *kdht.Message, conn net.Conn) {
-	response := kdht.Message{}
-	response.Sender = node.info
-	val, ok := node.accessValue(message.Key)
+	key, err := node.space.FromBytes(message.Key)
+	if err != nil {
+		node.processError(message, kdht.ErrorCode_NOT_FOUND, "", conn)
+		return
+	}
+
+	val, ok := node.accessValue(key)
 	if !ok {
-		response.Type = kdht.MessageType_ACK
-	} else {
-		response.Type = kdht.MessageType_VALUE
-		response.Value = val
+		node.processError(message, kdht.ErrorCode_NOT_FOUND, "", conn)
+		return
 	}
+
+	response := kdht.Message{}
+	response.Sender = node.info
+	response.Type = kdht.MessageType_VALUE
+	response.Key = message.Key
+	response.Value = val
 	node.sendMessage(&response, conn)
 }
 
 func (node *KdmNode) processFindNode(message *kdht.Message, conn net.Conn) {
+	key, err := node.space.FromBytes(message.Key)
+	if err != nil {
+		node.processError(message, kdht.ErrorCode_BAD_REQUEST, "invalid key length", conn)
+		return
+	}
+
+	// An empty list would look like a network of one node, so a
+	// failed table is reported instead
+	closest, err := node.routes.ClosestK(key)
+	if err != nil {
+		node.processError(message, kdht.ErrorCode_UNKNOWN, err.Error(), conn)
+		return
+	}
+
 	response := kdht.Message{}
 	response.Sender = node.info
 	response.Type = kdht.MessageType_NODES
-	response.Nodes = node.routingTable.ClosestK(message.Key)
+	response.Key = message.Key
+	response.Nodes = closest
 	node.sendMessage(&response, conn)
 }
 
 func (node *KdmNode) processFindValue(message *kdht.Message, conn net.Conn) {
-	val, ok := node.accessValue(message.Key)
+	key, err := node.space.FromBytes(message.Key)
+	if err != nil {
+		node.processFindNode(message, conn)
+		return
+	}
+
+	val, ok := node.accessValue(key)
 	if !ok {
 		node.processFindNode(message, conn)
 		return
@@ -241,10 +592,34 @@ func (node *KdmNode) processFindValue(message *kdht.Message, conn net.Conn) {
 	response := kdht.Message{}
 	response.Sender = node.info
 	response.Type = kdht.MessageType_VALUE
+	response.Key = message.Key
 	response.Value = val
 	node.sendMessage(&response, conn)
 }
 
+func (node *KdmNode) processError(message *kdht.Message, code kdht.ErrorCode, detail string, conn net.Conn) {
+	node.logf("rejecting %v from %v: %v %v", message.Type, message.Sender.GetAddress(), code, detail)
+	response := kdht.Message{}
+	response.Sender = node.info
+
+	// Nodes that do not understand ERROR get the plain ACK that
+	// preceded it, except that a version mismatch is always
+	// reported since nothing else will be understood either.
+	if code != kdht.ErrorCode_VERSION_MISMATCH &&
+		!kdht.HasCapability(message.Sender, kdht.Capability_CAP_ERROR) {
+		response.Type = kdht.MessageType_ACK
+		response.Key = message.Key
+		node.sendMessage(&response, conn)
+		return
+	}
+
+	response.Type = kdht.MessageType_ERROR
+	response.Key = message.Key
+	response.Error = code
+	response.Detail = detail
+	node.sendMessage(&response, conn)
+}
+
 func (node *KdmNode) listenForRequests() {
 	for {
 		conn, err := node.listener.Accept()
@@ -252,50 +627,90 @@ func (node *KdmNode) listenForRequests() {
 			return
 		}
 
-		if err == nil {
-			go func(conn net.Conn) {
+		if err == nil && node.track(conn) {
+			node.spawn(func() {
 				defer func() { recover() }()
+				defer node.hangup(conn)
+				node.handleConnection(conn)
+			})
+		}
+	}
+}
 
-				for {
-					message, err := node.recieveMessage(conn)
-					if err != nil {
-						return
-					}
+func (node *KdmNode) handleConnection(conn net.Conn) {
+	for {
+		conn.SetDeadline(time.Now().Add(node.timeout))
+		message, err := node.recieveMessage(conn)
+		if err != nil {
+			return
+		}
 
-					go node.routingTable.InsertNode(message.Sender)
-					switch message.Type {
-					case kdht.MessageType_PING:
-						go node.processPing(message, conn)
-					case kdht.MessageType_STORE:
-						go node.processStore(message, conn)
-					case kdht.MessageType_GET:
-						go node.processGet(message, conn)
-					case kdht.MessageType_FIND_NODE:
-						go node.processFindNode(message, conn)
-					case kdht.MessageType_FIND_VALUE:
-						go node.processFindValue(message, conn)
-					}
-				}
-			}(conn)
+		if !kdht.Compatible(message.Sender) {
+			detail := fmt.Sprintf("expected major version %v", kdht.ProtocolMajor)
+			node.processError(message, kdht.ErrorCode_VERSION_MISMATCH, detail, conn)
+			return
+		}
+
+		if !node.validNode(message.Sender) {
+			detail := "invalid sender"
+			if _, err := message.Sender.Key(); err == nil {
+				detail = fmt.Sprintf("sender ID is not a %v key", node.space)
+			}
+			node.processError(message, kdht.ErrorCode_BAD_REQUEST, detail, conn)
+			continue
+		}
+
+		if !node.begin() {
+			node.processError(message, kdht.ErrorCode_SHUTTING_DOWN, "", conn)
+			return
 		}
+
+		node.logf("%v from %v", message.Type, message.Sender.GetAddress())
+		node.spawn(func() {
+			defer node.end()
+			switch message.Type {
+			case kdht.MessageType_PING:
+				node.processPing(message, conn)
+			case kdht.MessageType_STORE:
+				node.processStore(message, conn)
+			case kdht.MessageType_GET:
+				node.processGet(message, conn)
+			case kdht.MessageType_FIND_NODE:
+				node.processFindNode(message, conn)
+			case kdht.MessageType_FIND_VALUE:
+				node.processFindValue(message, conn)
+			default:
+				node.processError(message, kdht.ErrorCode_BAD_REQUEST, "unexpected message type", conn)
+			}
+		})
 	}
 }
 
-func (node *KdmNode) nodeLookup(id []byte, tog bool) ([]byte, *kdht.NodeInfo, []*kdht.NodeInfo) {
-	closest := node.routingTable.ClosestK(id)
-	visited := make(map[string]bool)
-	visited[string(node.info.Id)] = true
+// nodeLookup finds the K nodes closest to id, or the value stored at
+// id if tog is true.  It fails only if the routing table does.
+func (node *KdmNode) nodeLookup(id keys.Key, tog bool) ([]byte, *kdht.NodeInfo, []*kdht.NodeInfo, error) {
+	k, err := node.routes.K()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	closest, err := node.routes.ClosestK(id)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	self, _ := node.info.Key()
+	visited := make(map[keys.Key]bool)
+	visited[self] = true
 	vmut := &sync.Mutex{}
 
-	markVisited := func(id []byte) {
+	markVisited := func(id keys.Key) {
 		vmut.Lock()
-		visited[string(id)] = true
+		visited[id] = true
 		vmut.Unlock()
 	}
 
-	isVisited := func(id []byte) bool {
+	isVisited := func(id keys.Key) bool {
 		vmut.Lock()
-		_, ok := visited[string(id)]
+		_, ok := visited[id]
 		vmut.Unlock()
 		return ok
 	}
@@ -306,16 +721,18 @@ func (node *KdmNode) nodeLookup(id []byte, tog bool) ([]byte, *kdht.NodeInfo, []
 			return nil, nil, closest
 		}
 
-		ch := make(chan *kdht.Message)
+		// The channel is buffered so that workers still running
+		// after a value is found can finish without blocking.
+		ch := make(chan *kdht.Message, len(slice))
 		for _, info := range slice {
-			go func(info *kdht.NodeInfo) {
-				defer recover()
-
-				if isVisited(info.Id) {
+			info := info
+			node.spawn(func() {
+				key, _ := info.Key()
+				if isVisited(key) {
 					ch <- nil
 					return
 				}
-				markVisited(info.Id)
+				markVisited(key)
 
 				request := kdht.Message{}
 				request.Sender = node.info
@@ -324,16 +741,19 @@ func (node *KdmNode) nodeLookup(id []byte, tog bool) ([]byte, *kdht.NodeInfo, []
 				} else {
 					request.Type = kdht.MessageType_FIND_NODE
 				}
-				request.Key = id
+				request.Key = id.Bytes()
 
 				response, err := node.contactAddress(&request, info.Address)
+				if err == nil {
+					err = responseError(response)
+				}
 				if err != nil {
 					ch <- nil
 					return
 				}
 
 				ch <- response
-			}(info)
+			})
 		}
 
 		flag := false
@@ -341,24 +761,23 @@ func (node *KdmNode) nodeLookup(id []byte, tog bool) ([]byte, *kdht.NodeInfo, []
 		for response := range ch {
 			if response != nil {
 				if tog && response.Value != nil {
-					close(ch)
 					return response.Value, response.Sender, nil
 				}
 
 				for _, info := range response.Nodes {
-					if containsNode(closest, info) {
+					if !node.validNode(info) || containsNode(closest, info) {
 						continue
 					}
 
-					if len(closest) < node.routingTable.K() {
+					if len(closest) < k {
 						closest = append(closest, info)
 						flag = true
 						continue
 					}
 
-					dist := sliceOfDistance(info.Id, id)
-					maxidx, maxdist := furthestNode(closest, id)
-					if bytes.Compare(dist, maxdist) < 0 {
+					key, _ := info.Key()
+					maxidx, maxkey := furthestNode(closest, id)
+					if id.Cmp(key, maxkey) < 0 {
 						closest[maxidx] = info
 						flag = true
 					}
@@ -367,7 +786,6 @@ func (node *KdmNode) nodeLookup(id []byte, tog bool) ([]byte, *kdht.NodeInfo, []
 
 			count++
 			if count >= len(slice) {
-				close(ch)
 				break
 			}
 		}
@@ -377,42 +795,151 @@ func (node *KdmNode) nodeLookup(id []byte, tog bool) ([]byte, *kdht.NodeInfo, []
 		}
 		return contactClosest(sliceAtMost(closest, node.alpha), 0)
 	}
-	return contactClosest(sliceAtMost(closest, node.alpha), 0)
+	val, sender, closest := contactClosest(sliceAtMost(closest, node.alpha), 0)
+	return val, sender, closest, nil
 }
 
-func (node *KdmNode) storeValue(key []byte, val []byte) {
+func (node *KdmNode) storeValue(key keys.Key, val []byte) bool {
 	node.storageMutex.Lock()
-	node.localStorage[string(key)] = val
-	node.storageMutex.Unlock()
+	defer node.storageMutex.Unlock()
+
+	used := node.storageUsed + len(val) - len(node.localStorage[key])
+	if used > storageQuota {
+		return false
+	}
+
+	node.localStorage[key] = val
+	node.storageUsed = used
+	return true
 }
 
-func (node *KdmNode) accessValue(key []byte) ([]byte, bool) {
+func (node *KdmNode) accessValue(key keys.Key) ([]byte, bool) {
 	node.storageMutex.Lock()
-	val, ok := node.localStorage[string(key)]
+	val, ok := node.localStorage[key]
 	node.storageMutex.Unlock()
 	return val, ok
 }
 
+// contactRecorder is implemented by routing tables that keep
+// statistics about the nodes in them, such as KdmRoutingTable.
+type contactRecorder interface {
+	RecordResponse(node *kdht.NodeInfo, rtt time.Duration)
+	RecordFailure(addr string)
+}
+
+// recordResponse tells the routing table, if it keeps statistics,
+// that info answered a request after rtt.
+func (node *KdmNode) recordResponse(info *kdht.NodeInfo, rtt time.Duration) {
+	if recorder, ok := node.routingTable.(contactRecorder); ok {
+		recorder.RecordResponse(info, rtt)
+	}
+}
+
+// recordFailure tells the routing table, if it keeps statistics, that
+// the node at addr could not be reached or did not answer.
+func (node *KdmNode) recordFailure(addr string) {
+	if recorder, ok := node.routingTable.(contactRecorder); ok {
+		recorder.RecordFailure(addr)
+	}
+}
+
 func (node *KdmNode) contactAddress(message *kdht.Message, addr string) (*kdht.Message, error) {
-	conn, err := net.Dial(network, addr)
+	start := time.Now()
+	conn, err := node.dial(addr)
 	if err != nil {
+		node.recordFailure(addr)
 		return nil, err
 	}
 
+	conn.SetDeadline(time.Now().Add(node.timeout))
 	err = node.sendMessage(message, conn)
-	defer func() { conn.Close() }()
+	defer node.hangup(conn)
 	if err != nil {
+		node.recordFailure(addr)
 		return nil, err
 	}
 
 	response, err := node.recieveMessage(conn)
 	if err != nil {
+		node.recordFailure(addr)
 		return nil, err
 	}
 
+	if !kdht.Compatible(response.Sender) {
+		major, minor := kdht.VersionOf(response.Sender)
+		return nil, fmt.Errorf("%w: %v speaks version %v.%v", kdht.VersionError, addr, major, minor)
+	}
+
+	if !node.validNode(response.Sender) {
+		return nil, fmt.Errorf("%w: %v has ID %x", kdht.KeySpaceError, addr, response.Sender.GetId())
+	}
+
+	node.recordResponse(response.Sender, time.Since(start))
 	return response, nil
 }
 
+// contactAddressMany sends every message over a single connection to
+// addr and collects the responses, which are matched to their
+// requests by key.  The returned slice is parallel to
+// messages, with nil for any message that was not answered.  This
+// must only be used with nodes advertising CAP_PIPELINE.
+func (node *KdmNode) contactAddressMany(messages []*kdht.Message, addr string) ([]*kdht.Message, error) {
+	responses := make([]*kdht.Message, len(messages))
+	start := time.Now()
+	conn, err := node.dial(addr)
+	if err != nil {
+		node.recordFailure(addr)
+		return responses, err
+	}
+	defer node.hangup(conn)
+
+	pending := make(map[string][]int)
+	for i, message := range messages {
+		pending[string(message.Key)] = append(pending[string(message.Key)], i)
+	}
+
+	node.spawn(func() {
+		for _, message := range messages {
+			conn.SetWriteDeadline(time.Now().Add(node.timeout))
+			if node.sendMessage(message, conn) != nil {
+				return
+			}
+		}
+	})
+
+	// A response that answers no pending request, such as a
+	// duplicate, is ignored rather than counted.
+	for answered := 0; answered < len(messages); {
+		conn.SetReadDeadline(time.Now().Add(node.timeout))
+		response, err := node.recieveMessage(conn)
+		if err != nil {
+			if answered == 0 {
+				node.recordFailure(addr)
+			}
+			return responses, err
+		}
+
+		if !kdht.Compatible(response.Sender) {
+			return responses, kdht.VersionError
+		}
+		if !node.validNode(response.Sender) {
+			return responses, kdht.KeySpaceError
+		}
+		if answered == 0 {
+			node.recordResponse(response.Sender, time.Since(start))
+		}
+
+		idxs := pending[string(response.Key)]
+		if len(idxs) > 0 {
+			responses[idxs[0]] = response
+			pending[string(response.Key)] = idxs[1:]
+			answered++
+		}
+	}
+
+	return responses, nil
+}
+
 func (node *KdmNode) sendMessage(message *kdht.Message, conn net.Conn) error {
 	data, err := proto.Marshal(message)
 	if err != nil {
@@ -424,7 +951,7 @@ func (node *KdmNode) sendMessage(message *kdht.Message, conn net.Conn) error {
 	binary.BigEndian.PutUint16(data[:headerLength], uint16(length))
 
 	var total int
-	for total < int(length) {
+	for total < len(data) {
 		nbytes, err := conn.Write(data[total:])
 		if err != nil {
 			return err
@@ -455,10 +982,63 @@ func (node *KdmNode) recieveMessage(conn net.Conn) (*kdht.Message, error) {
 		return nil, err
 	}
 
-	go node.routingTable.InsertNode(message.Sender)
+	if kdht.Compatible(message.Sender) && node.validNode(message.Sender) {
+		node.spawn(func() {
+			if err := node.routes.InsertNode(message.Sender); err != nil {
+				node.logf("inserting %v: %v", message.Sender.GetAddress(), err)
+			}
+		})
+	}
 	return message, nil
 }
 
+// logf logs a message if a logger has been set with SetLogger.
+func (node *KdmNode) logf(format string, args ...any) {
+	logger := node.logger.Load()
+	if logger != nil {
+		logger.Printf(format, args...)
+	}
+}
+
+// storeResult returns the result of a store that was acknowledged by
+// count nodes.  If any node rejected the store, the first such
+// rejection is wrapped in the returned StorageError.
+func (node *KdmNode) storeResult(count int, rejection error) error {
+	k, err := node.routes.K()
+	if err != nil {
+		return err
+	}
+	if count >= k {
+		return nil
+	}
+
+	if rejection != nil {
+		return fmt.Errorf("%w: %w", kdht.StorageError, rejection)
+	}
+	return kdht.StorageError
+}
+
+// responseError returns the error carried by an ERROR response, or
+// nil for any other response.
+func responseError(response *kdht.Message) error {
+	if response.Type != kdht.MessageType_ERROR {
+		return nil
+	}
+
+	err := kdht.ErrorFor(response.Error)
+	if response.Detail != "" {
+		return fmt.Errorf("%w: %v", err, response.Detail)
+	}
+	return err
+}
+
+// validNode reports whether info, as received from another node,
+// describes a node that can be contacted and placed in the routing
+// table.  Nodes whose IDs are not in this node's key space are not.
+func (node *KdmNode) validNode(info *kdht.NodeInfo) bool {
+	return node.space.Check(info.GetId()) == nil && info.GetAddress() != ""
+}
+
 func containsNode(nodes []*kdht.NodeInfo, target *kdht.NodeInfo) bool {
 	for _, info := range nodes {
 		if bytes.Equal(info.Id, target.Id) {
@@ -468,22 +1048,19 @@ func containsNode(nodes []*kdht.NodeInfo, target *kdht.NodeInfo) bool {
 	return false
 }
 
-func furthestNode(nodes []*kdht.NodeInfo, key []byte) (int, []byte) {
-	var maxdist []byte
+// furthestNode returns the index and ID of the node in nodes that is
+// furthest from key.  The index is -1 if nodes is empty.
+func furthestNode(nodes []*kdht.NodeInfo, key keys.Key) (int, keys.Key) {
+	var maxkey keys.Key
 	maxidx := -1
 	for idx, info := range nodes {
-		dist := sliceOfDistance(info.Id, key)
-		if maxdist == nil || bytes.Compare(maxdist, dist) < 0 {
-			maxdist = dist
+		id, _ := info.Key()
+		if maxidx == -1 || key.Cmp(maxkey, id) < 0 {
+			maxkey = id
 			maxidx = idx
 		}
 	}
-	return maxidx, maxdist
-}
-
-func sliceOfDistance(key1 []byte, key2 []byte) []byte {
-	dist := keys.Distance(key1, key2)
-	return dist[:]
+	return maxidx, maxkey
 }
 
 func sliceAtMost[T any](slice []T, maxlen int) []T {
@@ -2,13 +2,25 @@ package impl
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"cse586.kdht/api/kdht"
+	"cse586.kdht/api/kdht/kdhttest"
 	"cse586.kdht/given/keys"
+	"cse586.kdht/impl/faults"
 )
 
 const (
@@ -77,7 +89,7 @@ func TestDHT_Standard(t *testing.T) {
 								exp = exp[0:k]
 							}
 
-							act, err := nodes[i].FindNode(nodes[j].info.Id)
+							act, err := nodes[i].FindNode(idOf(nodes[j]))
 							if err != nil {
 								t.Fatalf("(node%v FindNode failed) %v", i, err)
 							}
@@ -169,7 +181,7 @@ func TestDHT_Store(t *testing.T) {
 
 				flag := false
 				for j, node := range nodes {
-					act, ok := node.localStorage[string(key)]
+					act, ok := node.localStorage[key]
 					if ok {
 						if bytes.Equal(exp, act) {
 							t.Logf("node%v is storing val%v", j+1, i+1)
@@ -332,7 +344,7 @@ func TestDHT_Complex(t *testing.T) {
 
 	time.Sleep(bufferTime)
 
-	closest, err := node1.FindNode(node5.info.Id)
+	closest, err := node1.FindNode(idOf(node5))
 	if err != nil {
 		t.Fatalf("(node1 FindNode failed) %v", err)
 	}
@@ -352,6 +364,1044 @@ func TestDHT_Complex(t *testing.T) {
 	t.Logf("passed\n\n")
 }
 
+func TestDHT_Get(t *testing.T) {
+	k := 2
+	alpha := 1
+	bufferTime := 3 * time.Second
+
+	node1, err1 := NewNode(byteToKey(0x10), Address1, k, alpha, []string{Address2})
+	node2, err2 := NewNode(byteToKey(0x20), Address2, k, alpha, []string{Address1})
+	nodes := []*KdmNode{node1, node2}
+	errs := []error{err1, err2}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	time.Sleep(bufferTime)
+
+	val := []byte("val1")
+	key := keys.Compute(val)
+	node2.storeValue(key, val)
+
+	act, err := node1.Get(idOf(node2), key)
+	if err != nil {
+		t.Fatalf("(node1 Get failed) %v", err)
+	}
+	if !bytes.Equal(val, act) {
+		t.Fatalf("node1 got an incorrect value:\n    exp: %v\n    act: %v\n", val, act)
+	}
+
+	_, err = node1.Get(idOf(node2), keys.Compute([]byte("val2")))
+	if !errors.Is(err, kdht.ValueError) {
+		t.Fatalf("Get of a missing key returned %v instead of ValueError", err)
+	}
+
+	_, err = node1.Get(byteToKey(0x30), key)
+	if !errors.Is(err, kdht.InvalidNodeError) {
+		t.Fatalf("Get from an unknown node returned %v instead of InvalidNodeError", err)
+	}
+
+	_, err = node1.GetAddress(Address3, key)
+	if err == nil || errors.Is(err, kdht.ValueError) {
+		t.Fatalf("Get from an unreachable address returned %v", err)
+	}
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_Errors(t *testing.T) {
+	k := 2
+	alpha := 1
+
+	node1, err1 := NewNode(byteToKey(0x10), Address1, k, alpha, []string{})
+	node2, err2 := NewNode(byteToKey(0x20), Address2, k, alpha, []string{})
+	nodes := []*KdmNode{node1, node2}
+	errs := []error{err1, err2}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	err := node1.Store(make([]byte, maxValueSize+1))
+	if !errors.Is(err, kdht.TooLargeError) {
+		t.Fatalf("Store of an oversized value returned %v instead of TooLargeError", err)
+	}
+
+	requests := []*kdht.Message{
+		{Type: kdht.MessageType_STORE, Key: byteToKey(0x30).Bytes(), Value: []byte("val1")},
+		{Type: kdht.MessageType_STORE, Key: []byte{0x30}, Value: []byte("val1")},
+		{Type: kdht.MessageType_FIND_NODE, Key: []byte{0x30}},
+		{Type: kdht.MessageType_ACK},
+	}
+	for i, request := range requests {
+		request.Sender = node1.info
+		response, err := node1.contactAddress(request, Address2)
+		if err != nil {
+			t.Fatalf("(request%v failed) %v", i+1, err)
+		}
+
+		if response.Type != kdht.MessageType_ERROR {
+			t.Fatalf("request%v was not rejected: %v", i+1, response.Type)
+		}
+
+		err = responseError(response)
+		if !errors.Is(err, kdht.BadRequestError) {
+			t.Fatalf("request%v returned %v instead of BadRequestError", i+1, err)
+		}
+	}
+
+	// A node whose storage is full rejects a STORE with
+	// QUOTA_EXCEEDED
+	node2.storageMutex.Lock()
+	used := node2.storageUsed
+	node2.storageUsed = storageQuota
+	node2.storageMutex.Unlock()
+
+	val := []byte("over quota")
+	store := &kdht.Message{Type: kdht.MessageType_STORE, Sender: node1.info, Key: node1.space.Compute(val).Bytes(), Value: val}
+	response, err := node1.contactAddress(store, Address2)
+	if err != nil {
+		t.Fatalf("(STORE over quota failed) %v", err)
+	}
+	if err := responseError(response); response.Error != kdht.ErrorCode_QUOTA_EXCEEDED || !errors.Is(err, kdht.QuotaError) {
+		t.Fatalf("STORE over quota returned %v instead of QuotaError", err)
+	}
+	if err := node2.StoreLocal(val); !errors.Is(err, kdht.QuotaError) {
+		t.Fatalf("StoreLocal over quota returned %v instead of QuotaError", err)
+	}
+
+	node2.storageMutex.Lock()
+	node2.storageUsed = used
+	node2.storageMutex.Unlock()
+
+	// A draining node rejects a STORE on a connection opened
+	// before it began to shut down with SHUTTING_DOWN.  The
+	// request held here keeps it draining until the STORE is
+	// answered.
+	conn, err := node1.dial(Address2)
+	if err != nil {
+		t.Fatalf("(dial failed) %v", err)
+	}
+	defer node1.hangup(conn)
+	if !node2.begin() {
+		t.Fatalf("node2 was not running")
+	}
+	shutdown := make(chan error)
+	go func() { shutdown <- node2.ShutdownWith(ShutdownOptions{Timeout: time.Minute}) }()
+	for node2.state.Load() == stateRunning {
+		time.Sleep(time.Millisecond)
+	}
+
+	conn.SetDeadline(time.Now().Add(node1.timeout))
+	if err := node1.sendMessage(store, conn); err != nil {
+		t.Fatalf("(STORE to a draining node failed) %v", err)
+	}
+	response, err = node1.recieveMessage(conn)
+	node2.end()
+	if err != nil {
+		t.Fatalf("(STORE to a draining node failed) %v", err)
+	}
+	if err := responseError(response); response.Error != kdht.ErrorCode_SHUTTING_DOWN || !errors.Is(err, kdht.PeerShutdownError) {
+		t.Fatalf("STORE to a draining node returned %v instead of PeerShutdownError", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("(node2 shutdown failed) %v", err)
+	}
+	nodes[1] = nil
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_Version(t *testing.T) {
+	k := 2
+	alpha := 1
+
+	node1, err := NewNode(byteToKey(0x10), Address1, k, alpha, []string{})
+	if err != nil {
+		t.Fatalf("(node1 creation failed) %v", err)
+	}
+	defer node1.Shutdown()
+
+	request := kdht.Message{}
+	request.Sender = &kdht.NodeInfo{Id: byteToKey(0x20).Bytes(), Address: Address2, Version: 2 << 16}
+	request.Type = kdht.MessageType_PING
+	response, err := node1.contactAddress(&request, Address1)
+	if err != nil {
+		t.Fatalf("(PING failed) %v", err)
+	}
+
+	err = responseError(response)
+	if !errors.Is(err, kdht.VersionError) {
+		t.Fatalf("PING from version 2.0 returned %v instead of VersionError", err)
+	}
+
+	// A node predating ERROR must get the legacy ACK
+	request.Sender = &kdht.NodeInfo{Id: byteToKey(0x20).Bytes(), Address: Address2}
+	request.Type = kdht.MessageType_GET
+	request.Key = byteToKey(0x30).Bytes()
+	response, err = node1.contactAddress(&request, Address1)
+	if err != nil {
+		t.Fatalf("(GET failed) %v", err)
+	}
+
+	if response.Type != kdht.MessageType_ACK {
+		t.Fatalf("GET from a legacy node returned %v instead of ACK", response.Type)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	info, ok := node1.routingTable.Lookup(byteToKey(0x20))
+	if !ok {
+		t.Fatalf("legacy node was not inserted")
+	}
+	if major, minor := kdht.VersionOf(info); major != 1 || minor != 0 {
+		t.Fatalf("legacy node had version %v.%v", major, minor)
+	}
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_Batch(t *testing.T) {
+	k := 2
+	alpha := 1
+	bufferTime := 3 * time.Second
+
+	node1, err1 := NewNode(byteToKey(0x10), Address1, k, alpha, []string{Address2})
+	node2, err2 := NewNode(byteToKey(0x20), Address2, k, alpha, []string{Address3})
+	node3, err3 := NewNode(byteToKey(0x30), Address3, k, alpha, []string{Address4})
+	node4, err4 := NewNode(byteToKey(0x40), Address4, k, alpha, []string{Address5})
+	node5, err5 := NewNode(byteToKey(0x50), Address5, k, alpha, []string{Address1})
+	nodes := []*KdmNode{node1, node2, node3, node4, node5}
+	errs := []error{err1, err2, err3, err4, err5}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	time.Sleep(bufferTime)
+
+	vals := [][]byte{}
+	for i := 0; i < 50; i++ {
+		vals = append(vals, []byte(fmt.Sprintf("val%v", i)))
+	}
+
+	stored := node1.StoreMany(vals)
+	ids := []keys.Key{}
+	for i, result := range stored {
+		if result.Err != nil {
+			t.Fatalf("(val%v StoreMany failed) %v", i, result.Err)
+		}
+		if result.Key != keys.Compute(vals[i]) {
+			t.Fatalf("val%v had an incorrect key", i)
+		}
+		ids = append(ids, result.Key)
+	}
+
+	ids = append(ids, keys.Compute([]byte("missing")))
+	found := node3.FindValues(ids)
+	for i, result := range found[:len(vals)] {
+		if result.Err != nil {
+			t.Fatalf("(val%v FindValues failed) %v", i, result.Err)
+		}
+		if !bytes.Equal(result.Value, vals[i]) {
+			t.Fatalf("val%v was incorrect:\n    exp: %v\n    act: %v\n", i, vals[i], result.Value)
+		}
+	}
+
+	if !errors.Is(found[len(vals)].Err, kdht.ValueError) {
+		t.Fatalf("FindValues of a missing key returned %v instead of ValueError", found[len(vals)].Err)
+	}
+
+	t.Logf("passed\n\n")
+}
+
+// TestDHT_BatchGroups stores two values whose keys are grouped
+// together by StoreMany, but whose K closest nodes differ, and checks
+// that each is stored on the nodes that a lookup of its own key finds.
+func TestDHT_BatchGroups(t *testing.T) {
+	k := 2
+	alpha := 1
+	bufferTime := 3 * time.Second
+
+	node1, err1 := NewNode(byteToKey(0x10), Address1, k, alpha, []string{Address2})
+	node2, err2 := NewNode(byteToKey(0x20), Address2, k, alpha, []string{Address3})
+	node3, err3 := NewNode(byteToKey(0x30), Address3, k, alpha, []string{Address4})
+	node4, err4 := NewNode(byteToKey(0x40), Address4, k, alpha, []string{Address5})
+	node5, err5 := NewNode(byteToKey(0x50), Address5, k, alpha, []string{Address1})
+	nodes := []*KdmNode{node1, node2, node3, node4, node5}
+	errs := []error{err1, err2, err3, err4, err5}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	time.Sleep(bufferTime)
+
+	// closest returns the IDs of the k nodes closest to key, in
+	// ascending order
+	closest := func(key keys.Key) []keys.Key {
+		ids := []keys.Key{}
+		for _, node := range nodes {
+			id, _ := node.info.Key()
+			ids = append(ids, id)
+		}
+		slices.SortFunc(ids, func(id1, id2 keys.Key) int { return key.Cmp(id1, id2) })
+		ids = ids[:k]
+		slices.SortFunc(ids, func(id1, id2 keys.Key) int { return bytes.Compare(id1.Bytes(), id2.Bytes()) })
+		return ids
+	}
+
+	buckets, _ := node1.routes.Buckets()
+	var vals [][]byte
+	for i := 0; i < 4096 && vals == nil; i++ {
+		val1 := []byte(fmt.Sprintf("val%v", i))
+		key1 := keys.Compute(val1)
+		for j := i + 1; j < 4096; j++ {
+			val2 := []byte(fmt.Sprintf("val%v", j))
+			key2 := keys.Compute(val2)
+			if keys.CommonPrefix(key1, key2) >= buckets && !slices.Equal(closest(key1), closest(key2)) {
+				vals = [][]byte{val1, val2}
+				break
+			}
+		}
+	}
+	if vals == nil {
+		t.Fatalf("No values share %v bits with different closest nodes", buckets)
+	}
+
+	for i, result := range node1.StoreMany(vals) {
+		if result.Err != nil {
+			t.Fatalf("(val%v StoreMany failed) %v", i, result.Err)
+		}
+	}
+	// Each value is where a Store of it alone would put it, which
+	// is not always the closest nodes in a network this sparse
+	for i, val := range vals {
+		key := keys.Compute(val)
+		_, _, found, err := node1.nodeLookup(key, false)
+		if err != nil {
+			t.Fatalf("(lookup of val%v failed) %v", i, err)
+		}
+		want := []keys.Key{}
+		for _, info := range found {
+			id, _ := info.Key()
+			want = append(want, id)
+		}
+		for _, node := range nodes {
+			id, _ := node.info.Key()
+			_, stored := node.accessValue(key)
+			if stored != slices.Contains(want, id) {
+				t.Errorf("val%v stored on %v: %v, but a lookup finds %v", i, id, stored, want)
+			}
+		}
+	}
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_Shutdown(t *testing.T) {
+	k := 2
+	alpha := 1
+	bufferTime := 3 * time.Second
+
+	node1, err1 := NewNode(byteToKey(0x10), Address1, k, alpha, []string{Address2})
+	node2, err2 := NewNode(byteToKey(0x20), Address2, k, alpha, []string{Address3})
+	node3, err3 := NewNode(byteToKey(0x30), Address3, k, alpha, []string{Address1})
+	nodes := []*KdmNode{node1, node2, node3}
+	errs := []error{err1, err2, err3}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil || node == node2 {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	time.Sleep(bufferTime)
+
+	val := []byte("val1")
+	key := keys.Compute(val)
+	node2.storeValue(key, val)
+
+	// An idle connection must not hold up shutdown past its timeout
+	conn, err := net.Dial(network, Address2)
+	if err != nil {
+		t.Fatalf("(dial failed) %v", err)
+	}
+	defer conn.Close()
+
+	start := time.Now()
+	err = node2.ShutdownWith(ShutdownOptions{Timeout: time.Second, Handoff: true})
+	if err != nil {
+		t.Fatalf("(node2 shutdown failed) %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > bufferTime {
+		t.Fatalf("node2 shutdown took %v", elapsed)
+	}
+
+	if err := node2.Shutdown(); !errors.Is(err, kdht.ShutdownError) {
+		t.Fatalf("second shutdown returned %v instead of ShutdownError", err)
+	}
+	if _, err := node2.FindNode(key); !errors.Is(err, kdht.ShutdownError) {
+		t.Fatalf("FindNode after shutdown returned %v instead of ShutdownError", err)
+	}
+
+	flag := false
+	for _, node := range []*KdmNode{node1, node3} {
+		if act, ok := node.accessValue(key); ok && bytes.Equal(act, val) {
+			flag = true
+		}
+	}
+	if !flag {
+		t.Fatalf("val1 was not handed off")
+	}
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_Control(t *testing.T) {
+	k := 2
+	alpha := 1
+	bufferTime := 3 * time.Second
+
+	node1, err1 := NewNode(byteToKey(0x10), Address1, k, alpha, []string{Address2})
+	node2, err2 := NewNode(byteToKey(0x20), Address2, k, alpha, []string{Address1})
+	nodes := []*KdmNode{node1, node2}
+	errs := []error{err1, err2}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil && !errors.Is(err, kdht.ShutdownError) {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	time.Sleep(bufferTime)
+
+	server := httptest.NewServer(NewControlHandler(node1, ShutdownOptions{Timeout: time.Second}))
+	defer server.Close()
+
+	request := func(method string, path string, body string, expStatus int) *ControlResult {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("(%v %v failed) %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != expStatus {
+			t.Fatalf("%v %v returned status %v instead of %v", method, path, resp.StatusCode, expStatus)
+		}
+		res := &ControlResult{}
+		json.NewDecoder(resp.Body).Decode(res)
+		return res
+	}
+
+	val := "val1"
+	key := keys.Compute([]byte(val)).String()
+	res := request(http.MethodPost, "/store", val, http.StatusOK)
+	if res.Key != key {
+		t.Fatalf("store returned an incorrect key:\n    exp: %v\n    act: %v\n", key, res.Key)
+	}
+
+	res = request(http.MethodGet, "/find-value?key="+key, "", http.StatusOK)
+	if string(res.Value) != val {
+		t.Fatalf("find-value returned an incorrect value:\n    exp: %v\n    act: %v\n", val, string(res.Value))
+	}
+
+	missing := keys.Compute([]byte("val2")).String()
+	request(http.MethodGet, "/find-value?key="+missing, "", http.StatusNotFound)
+	request(http.MethodGet, "/find-value?key=00", "", http.StatusBadRequest)
+	request(http.MethodGet, "/store", "", http.StatusMethodNotAllowed)
+	request(http.MethodGet, "/routing/snapshot", "", http.StatusNotImplemented)
+
+	request(http.MethodPost, "/ping", fmt.Sprintf(`{"address": %q}`, Address2), http.StatusOK)
+	res = request(http.MethodGet, "/neighbors", "", http.StatusOK)
+	if len(res.Nodes) != 1 || res.Nodes[0].Address != Address2 {
+		t.Fatalf("neighbors returned %v instead of node2", res.Nodes)
+	}
+
+	stats := node1.StorageStats()
+	if stats.Values != 1 || stats.Bytes != len(val) {
+		t.Fatalf("storage stats were incorrect: %+v", stats)
+	}
+
+	request(http.MethodPost, "/shutdown", "", http.StatusOK)
+	select {
+	case <-node1.Done():
+	default:
+		t.Fatalf("node1 was not shut down")
+	}
+	request(http.MethodPost, "/store", val, http.StatusServiceUnavailable)
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_Gateway(t *testing.T) {
+	k := 2
+	alpha := 1
+	bufferTime := 3 * time.Second
+
+	node1, err1 := NewNode(byteToKey(0x10), Address1, k, alpha, []string{Address2})
+	node2, err2 := NewNode(byteToKey(0x20), Address2, k, alpha, []string{Address1})
+	nodes := []*KdmNode{node1, node2}
+	errs := []error{err1, err2}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil && !errors.Is(err, kdht.ShutdownError) {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	time.Sleep(bufferTime)
+
+	server1 := httptest.NewServer(NewGatewayHandler(node1))
+	defer server1.Close()
+	server2 := httptest.NewServer(NewGatewayHandler(node2))
+	defer server2.Close()
+
+	request := func(server *httptest.Server, method string, path string, body string, expStatus int) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("(%v %v failed) %v", method, path, err)
+		}
+		if resp.StatusCode != expStatus {
+			t.Fatalf("%v %v returned status %v instead of %v", method, path, resp.StatusCode, expStatus)
+		}
+		return resp
+	}
+
+	val := "val1"
+	key := keys.Compute([]byte(val)).String()
+	resp := request(server1, http.MethodPut, "/v1/values", val, http.StatusCreated)
+	res := &ControlResult{}
+	json.NewDecoder(resp.Body).Decode(res)
+	resp.Body.Close()
+	if res.Key != key {
+		t.Fatalf("PUT returned an incorrect key:\n    exp: %v\n    act: %v\n", key, res.Key)
+	}
+
+	resp = request(server2, http.MethodGet, "/v1/values/"+key, "", http.StatusOK)
+	act, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(act) != val {
+		t.Fatalf("GET returned an incorrect value:\n    exp: %v\n    act: %v\n", val, string(act))
+	}
+	if resp.Header.Get(NodeAddressHeader) == "" || resp.Header.Get(NodeIDHeader) == "" {
+		t.Fatalf("GET did not identify the responding node")
+	}
+
+	resp = request(server2, http.MethodGet, "/v1/nodes/"+key, "", http.StatusOK)
+	res = &ControlResult{}
+	json.NewDecoder(resp.Body).Decode(res)
+	resp.Body.Close()
+	if len(res.Nodes) == 0 {
+		t.Fatalf("GET of nodes returned no nodes")
+	}
+
+	missing := keys.Compute([]byte("val2")).String()
+	request(server2, http.MethodGet, "/v1/values/"+missing, "", http.StatusNotFound).Body.Close()
+	request(server2, http.MethodGet, "/v1/values/xyz", "", http.StatusBadRequest).Body.Close()
+	request(server2, http.MethodPut, "/v1/values", strings.Repeat("x", maxValueSize+1), http.StatusRequestEntityTooLarge).Body.Close()
+
+	// node2 alone cannot store to K nodes
+	node1.Shutdown()
+	request(server2, http.MethodPut, "/v1/values", "val3", http.StatusBadGateway).Body.Close()
+	request(server1, http.MethodGet, "/v1/values/"+key, "", http.StatusServiceUnavailable).Body.Close()
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_Faults(t *testing.T) {
+	k := 2
+	alpha := 2
+	timeout := 300 * time.Millisecond
+
+	inj1 := faults.New(TCPTransport, 1)
+	inj2 := faults.New(TCPTransport, 2)
+	opts1 := NodeOptions{Transport: inj1, RequestTimeout: timeout}
+	opts2 := NodeOptions{Transport: inj2, RequestTimeout: timeout}
+	opts3 := NodeOptions{RequestTimeout: timeout}
+
+	node1, err1 := NewNodeWith(byteToKey(0x10), Address1, k, alpha, []string{}, opts1)
+	node2, err2 := NewNodeWith(byteToKey(0x20), Address2, k, alpha, []string{Address1}, opts2)
+	node3, err3 := NewNodeWith(byteToKey(0x30), Address3, k, alpha, []string{Address1}, opts3)
+	nodes := []*KdmNode{node1, node2, node3}
+	errs := []error{err1, err2, err3}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	// ping clears the rules and checks that node2 is still serving
+	ping := func(msg string) {
+		inj1.SetRules()
+		inj2.SetRules()
+		if err := node1.PingAddress(Address2, nil); err != nil {
+			t.Fatalf("(ping after %v failed) %v", msg, err)
+		}
+	}
+	ping("startup")
+
+	// A lookup must finish despite a peer that never answers
+	inj1.SetRules(faults.Rule{Peer: Address3, Types: []kdht.MessageType{kdht.MessageType_FIND_NODE}, Fault: faults.Drop})
+	done := make(chan error, 1)
+	go func() {
+		_, err := node1.FindNode(byteToKey(0x30))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("(find node failed) %v", err)
+		}
+	case <-time.After(10 * timeout):
+		t.Fatalf("find node did not finish while FIND_NODE was dropped")
+	}
+	if inj1.Injected(faults.Drop) == 0 {
+		t.Fatalf("no FIND_NODE was dropped")
+	}
+	ping("drop")
+
+	// Corrupt STOREs are rejected by the connection handler
+	val := []byte("val1")
+	inj1.SetRules(faults.Rule{Types: []kdht.MessageType{kdht.MessageType_STORE}, Fault: faults.Corrupt})
+	if err := node1.Store(val); !errors.Is(err, kdht.StorageError) {
+		t.Fatalf("Store with corrupt requests returned %v instead of StorageError", err)
+	}
+	if _, ok := node2.accessValue(keys.Compute(val)); ok {
+		t.Fatalf("node2 stored a corrupt value")
+	}
+	ping("corrupt STORE")
+	if err := node1.Store(val); err != nil {
+		t.Fatalf("(store failed) %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		inj   *faults.Injector
+		rule  faults.Rule
+		check func(err error) bool
+	}{
+		{"duplicate PING", inj1, faults.Rule{Fault: faults.Duplicate}, func(err error) bool { return err == nil }},
+		{"duplicate ACK", inj2, faults.Rule{Fault: faults.Duplicate}, func(err error) bool { return err == nil }},
+		{"short delay", inj1, faults.Rule{Fault: faults.Delay, Delay: timeout / 3}, func(err error) bool { return err == nil }},
+		{"long delay", inj2, faults.Rule{Fault: faults.Delay, Delay: 2 * timeout},
+			func(err error) bool { return errors.Is(err, os.ErrDeadlineExceeded) }},
+		{"dropped PING", inj1, faults.Rule{Fault: faults.Drop},
+			func(err error) bool { return errors.Is(err, os.ErrDeadlineExceeded) }},
+		{"truncated PING", inj1, faults.Rule{Fault: faults.Truncate}, func(err error) bool { return err != nil }},
+		{"truncated ACK", inj2, faults.Rule{Fault: faults.Truncate},
+			func(err error) bool { return errors.Is(err, io.ErrUnexpectedEOF) }},
+		{"corrupt PING", inj1, faults.Rule{Fault: faults.Corrupt}, func(err error) bool { return err != nil }},
+		{"corrupt ACK", inj2, faults.Rule{Fault: faults.Corrupt}, func(err error) bool { return err != nil }},
+		{"refused dial", inj1, faults.Rule{Peer: Address2, Fault: faults.Refuse},
+			func(err error) bool { return errors.Is(err, syscall.ECONNREFUSED) }},
+		{"other peer refused", inj1, faults.Rule{Peer: Address3, Fault: faults.Refuse}, func(err error) bool { return err == nil }},
+		{"ACK type only", inj1, faults.Rule{Types: []kdht.MessageType{kdht.MessageType_ACK}, Fault: faults.Drop},
+			func(err error) bool { return err == nil }},
+	}
+	for _, c := range cases {
+		c.inj.SetRules(c.rule)
+		err := node1.PingAddress(Address2, nil)
+		if !c.check(err) {
+			t.Fatalf("ping with %v returned %v", c.name, err)
+		}
+		ping(c.name)
+	}
+
+	// A rule with a limit applies only that many times
+	inj1.SetRules(faults.Rule{Fault: faults.Drop, Limit: 1})
+	if err := node1.PingAddress(Address2, nil); err == nil {
+		t.Fatalf("first ping with a limited drop succeeded")
+	}
+	if err := node1.PingAddress(Address2, nil); err != nil {
+		t.Fatalf("(second ping with a limited drop failed) %v", err)
+	}
+
+	// The connection handler hangs up on an idle client
+	conn, err := net.Dial(network, Address2)
+	if err != nil {
+		t.Fatalf("(dial failed) %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * timeout))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("idle connection read returned %v instead of EOF", err)
+	}
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_KeySpace(t *testing.T) {
+	k := 2
+	alpha := 1
+	opts := NodeOptions{KeySpace: keys.SHA256}
+
+	if _, err := NewNodeWith(byteToKey(0x10), Address1, k, alpha, []string{}, opts); !errors.Is(err, kdht.KeySpaceError) {
+		t.Fatalf("NewNodeWith of a SHA1 ID in SHA256 returned %v instead of KeySpaceError", err)
+	}
+
+	node1, err1 := NewNodeWith(keys.SHA256.Compute([]byte("node1")), Address1, k, alpha, []string{}, opts)
+	node2, err2 := NewNodeWith(keys.SHA256.Compute([]byte("node2")), Address2, k, alpha, []string{Address1}, opts)
+	node3, err3 := NewNode(byteToKey(0x30), Address3, k, alpha, []string{})
+	nodes := []*KdmNode{node1, node2, node3}
+	errs := []error{err1, err2, err3}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	if node1.RoutingTable().Buckets() == 0 || node1.KeySpace() != keys.SHA256 {
+		t.Fatalf("node1 is not a SHA256 node")
+	}
+	if _, ok := node1.RoutingTable().Lookup(idOf(node2)); !ok {
+		t.Fatalf("node1 does not know node2")
+	}
+
+	val := []byte("val1")
+	if err := node2.Store(val); err != nil {
+		t.Fatalf("(store failed) %v", err)
+	}
+	key := keys.SHA256.Compute(val)
+	if _, ok := node1.accessValue(key); !ok {
+		t.Fatalf("node1 did not store %v", key)
+	}
+	found, _, err := node1.FindValue(key)
+	if err != nil || !bytes.Equal(found, val) {
+		t.Fatalf("FindValue returned %q, %v", found, err)
+	}
+
+	// The in-process tables of SHA256 nodes record round trips
+	for _, b := range node1.routingTable.(*KdmRoutingTable).Snapshot().Buckets {
+		for _, c := range b.Contacts {
+			if c.Address == Address2 && (c.RTT <= 0 || c.LastSeen.IsZero()) {
+				t.Fatalf("node1 recorded no round trip to node2: %+v", c)
+			}
+		}
+	}
+
+	if _, _, err := node1.FindValue(keys.Compute(val)); !errors.Is(err, kdht.KeySpaceError) {
+		t.Fatalf("FindValue of a SHA1 key returned %v instead of KeySpaceError", err)
+	}
+	if _, err := node1.FindNode(idOf(node3)); !errors.Is(err, kdht.KeySpaceError) {
+		t.Fatalf("FindNode of a SHA1 key returned %v instead of KeySpaceError", err)
+	}
+
+	// Nodes of different key spaces refuse each other
+	if err := node1.PingAddress(Address3, nil); !errors.Is(err, kdht.KeySpaceError) {
+		t.Fatalf("ping of a SHA1 node returned %v instead of KeySpaceError", err)
+	}
+	if err := node3.PingAddress(Address1, nil); !errors.Is(err, kdht.KeySpaceError) {
+		t.Fatalf("ping of a SHA256 node returned %v instead of KeySpaceError", err)
+	}
+	if _, ok := node3.RoutingTable().Lookup(idOf(node1)); ok {
+		t.Fatalf("node3 inserted a SHA256 node")
+	}
+	if _, ok := node1.RoutingTable().Lookup(idOf(node3)); ok {
+		t.Fatalf("node1 inserted a SHA1 node")
+	}
+
+	t.Logf("passed\n\n")
+}
+
+func TestDHT_RoutingFailure(t *testing.T) {
+	k := 2
+	alpha := 1
+
+	var table *failingTable
+	opts := NodeOptions{RoutingTable: func(info *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+		kdm, err := NewKdmRoutingTable(info, k)
+		if err != nil {
+			return nil, err
+		}
+		table = &failingTable{KdmRoutingTable: kdm}
+		return table, nil
+	}}
+	node1, err1 := NewNodeWith(byteToKey(0x10), Address1, k, alpha, []string{}, opts)
+	node2, err2 := NewNode(byteToKey(0x20), Address2, k, alpha, []string{Address1})
+	nodes := []*KdmNode{node1, node2}
+	errs := []error{err1, err2}
+
+	defer func() {
+		for i, node := range nodes {
+			if node == nil {
+				continue
+			}
+			err := node.Shutdown()
+			if err != nil {
+				t.Logf("(node %v shutdown failed) %v", i, err)
+			}
+		}
+	}()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("(node%v creation failed) %v", i, err)
+		}
+	}
+
+	if err := node1.PingAddress(Address2, nil); err != nil {
+		t.Fatalf("(ping failed) %v", err)
+	}
+	val := []byte("val1")
+	if err := node1.Store(val); err != nil {
+		t.Fatalf("(store failed) %v", err)
+	}
+
+	// A failed table is reported, rather than looking like a
+	// network of one node
+	table.broken.Store(true)
+	if _, err := node1.FindNode(idOf(node2)); !errors.Is(err, kdht.RoutingError) {
+		t.Fatalf("FindNode returned %v instead of RoutingError", err)
+	}
+	if _, _, err := node1.FindValue(keys.Compute(val)); !errors.Is(err, kdht.RoutingError) {
+		t.Fatalf("FindValue returned %v instead of RoutingError", err)
+	}
+	if err := node1.Store(val); !errors.Is(err, kdht.RoutingError) {
+		t.Fatalf("Store returned %v instead of RoutingError", err)
+	}
+	if err := node1.Ping(idOf(node2), nil); !errors.Is(err, kdht.RoutingError) {
+		t.Fatalf("Ping returned %v instead of RoutingError", err)
+	}
+	if err := node1.PingAddress(Address2, nil); !errors.Is(err, kdht.RoutingError) {
+		t.Fatalf("PingAddress returned %v instead of RoutingError", err)
+	}
+	for _, res := range node1.StoreMany([][]byte{val, []byte("val2")}) {
+		if !errors.Is(res.Err, kdht.RoutingError) {
+			t.Fatalf("StoreMany of %v returned %v instead of RoutingError", res.Key, res.Err)
+		}
+	}
+	for _, res := range node1.FindValues([]keys.Key{keys.Compute(val)}) {
+		if !errors.Is(res.Err, kdht.RoutingError) {
+			t.Fatalf("FindValues of %v returned %v instead of RoutingError", res.Key, res.Err)
+		}
+	}
+	if StatusFor(kdht.RoutingError) != http.StatusServiceUnavailable {
+		t.Fatalf("a failed routing table has status %v", StatusFor(kdht.RoutingError))
+	}
+
+	// Other nodes are refused rather than told of no nodes
+	request := &kdht.Message{Sender: node2.info, Type: kdht.MessageType_FIND_NODE, Key: idOf(node2).Bytes()}
+	response, err := node2.contactAddress(request, Address1)
+	if err != nil {
+		t.Fatalf("(FIND_NODE failed) %v", err)
+	}
+	if response.Type != kdht.MessageType_ERROR {
+		t.Fatalf("FIND_NODE of a failed table was answered with %v", response.Type)
+	}
+
+	table.broken.Store(false)
+	if _, err := node1.FindNode(idOf(node2)); err != nil {
+		t.Fatalf("(FindNode failed after recovery) %v", err)
+	}
+
+	t.Logf("passed\n\n")
+}
+
+// failingTable is a routing table that fails every operation through
+// Fallible while broken is set.
+type failingTable struct {
+	*KdmRoutingTable
+	broken atomic.Bool
+}
+
+// failingRoutes is a failingTable as a kdht.RoutingTableV2.
+type failingRoutes struct {
+	table *failingTable
+}
+
+func (table *failingTable) Fallible() kdht.RoutingTableV2 {
+	return failingRoutes{table}
+}
+
+func (fr failingRoutes) err() error {
+	if fr.table.broken.Load() {
+		return fmt.Errorf("%w: broken", kdht.RoutingError)
+	}
+	return nil
+}
+
+func (fr failingRoutes) K() (int, error) {
+	return fr.table.K(), fr.err()
+}
+
+func (fr failingRoutes) InsertNode(node *kdht.NodeInfo) error {
+	if err := fr.err(); err != nil {
+		return err
+	}
+	fr.table.InsertNode(node)
+	return nil
+}
+
+func (fr failingRoutes) RemoveNode(key keys.Key) error {
+	if err := fr.err(); err != nil {
+		return err
+	}
+	return fr.table.RemoveNode(key)
+}
+
+func (fr failingRoutes) Lookup(key keys.Key) (*kdht.NodeInfo, bool, error) {
+	if err := fr.err(); err != nil {
+		return nil, false, err
+	}
+	node, ok := fr.table.Lookup(key)
+	return node, ok, nil
+}
+
+func (fr failingRoutes) GetNodes(bucket int) ([]*kdht.NodeInfo, error) {
+	if err := fr.err(); err != nil {
+		return nil, err
+	}
+	return fr.table.GetNodes(bucket), nil
+}
+
+func (fr failingRoutes) ClosestK(key keys.Key) ([]*kdht.NodeInfo, error) {
+	if err := fr.err(); err != nil {
+		return nil, err
+	}
+	return fr.table.ClosestK(key), nil
+}
+
+func (fr failingRoutes) Buckets() (int, error) {
+	return fr.table.Buckets(), fr.err()
+}
+
+func TestDHT_Conformance(t *testing.T) {
+	kdhttest.TestNode(t, func(id keys.Key, addr string, k int, alpha int, neighbors []string) (kdht.Node, error) {
+		node, err := NewNode(id, addr, k, alpha, neighbors)
+		if err != nil {
+			return nil, err
+		}
+		return node, nil
+	})
+}
+
 func sprintInfos(msg string, infos []*kdht.NodeInfo) string {
 	str := fmt.Sprintf("%v:\n", msg)
 	lf := ""
@@ -362,8 +1412,15 @@ func sprintInfos(msg string, infos []*kdht.NodeInfo) string {
 	return str
 }
 
-func byteToKey(byt byte) []byte {
-	key := make([]byte, kdht.KeyBytes)
-	key[0] = byt
+// idOf returns the ID of node.
+func idOf(node *KdmNode) keys.Key {
+	id, _ := node.info.Key()
+	return id
+}
+
+func byteToKey(byt byte) keys.Key {
+	b := make([]byte, kdht.KeyBytes)
+	b[0] = byt
+	key, _ := keys.FromBytes(b)
 	return key
 }
@@ -0,0 +1,310 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package impl
+
+import (
+	"sync"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// EventType is the kind of change described by an Event.
+type EventType int
+
+const (
+	// ContactAdded is a node entering a bucket.
+	ContactAdded EventType = iota
+	// ContactRemoved is a node leaving the table, whether it was
+	// removed or replaced as stale.
+	ContactRemoved
+	// ContactUpdated is a node in the table changing its address.
+	ContactUpdated
+	// BucketSplit is a bucket splitting to make room for a node.
+	BucketSplit
+)
+
+func (t EventType) String() string {
+	switch t {
+	case ContactAdded:
+		return "ContactAdded"
+	case ContactRemoved:
+		return "ContactRemoved"
+	case ContactUpdated:
+		return "ContactUpdated"
+	case BucketSplit:
+		return "BucketSplit"
+	}
+	return "EventType(?)"
+}
+
+// Event is a change to a routing table.
+type Event struct {
+	Type EventType
+	// Node is the node added, removed, or updated, and Previous is
+	// the node's entry before it was updated.  Both are nil for
+	// BucketSplit.
+	Node     *kdht.NodeInfo
+	Previous *kdht.NodeInfo
+	// Bucket is the number of the bucket, as passed to GetNodes,
+	// that Node entered, left, or is in, or that split.
+	Bucket int
+	// Dropped is the number of events just before this one that
+	// were discarded because the subscriber fell behind.
+	Dropped int
+}
+
+// maxQueuedEvents is the number of events that may wait for a
+// subscriber before the oldest are dropped.
+const maxQueuedEvents = 1024
+
+// EventSource is implemented by routing tables that report their
+// changes, such as KdmRoutingTable and the tables returned by
+// WatchRoutingTable.
+type EventSource interface {
+	// Subscribe calls f with every later change to the table, in
+	// order, from a goroutine of its own, so f may use the table.
+	// That goroutine runs only while events wait for f.  At most
+	// 1024 events wait; if f falls further behind, the oldest are
+	// dropped, and counted in the Dropped field of the next event
+	// f is called with.  The returned function ends the
+	// subscription, and should be called once it is no longer
+	// wanted.
+	Subscribe(f func(Event)) (cancel func())
+}
+
+// eventHub delivers the events of one table to its subscribers.
+type eventHub struct {
+	mutex *sync.Mutex
+	subs  map[*subscription]bool
+}
+
+// subscription queues events for one subscriber.
+type subscription struct {
+	f     func(Event)
+	mutex *sync.Mutex
+	queue []Event
+	// dropped is the number of events dropped from the front of
+	// the queue since the last one was delivered.
+	dropped int
+	// running is set while a goroutine is delivering the queue.
+	running   bool
+	cancelled bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{mutex: &sync.Mutex{}, subs: make(map[*subscription]bool)}
+}
+
+func (hub *eventHub) Subscribe(f func(Event)) func() {
+	sub := &subscription{f: f, mutex: &sync.Mutex{}}
+	hub.mutex.Lock()
+	hub.subs[sub] = true
+	hub.mutex.Unlock()
+
+	return func() {
+		hub.mutex.Lock()
+		delete(hub.subs, sub)
+		hub.mutex.Unlock()
+
+		sub.mutex.Lock()
+		sub.cancelled = true
+		sub.queue = nil
+		sub.mutex.Unlock()
+	}
+}
+
+// emit queues ev for every subscriber.  It never blocks, so it may be
+// called with the table locked.
+func (hub *eventHub) emit(ev Event) {
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	for sub := range hub.subs {
+		sub.mutex.Lock()
+		if len(sub.queue) >= maxQueuedEvents {
+			sub.queue = sub.queue[1:]
+			sub.dropped++
+		}
+		sub.queue = append(sub.queue, ev)
+		if !sub.running {
+			sub.running = true
+			go sub.run()
+		}
+		sub.mutex.Unlock()
+	}
+}
+
+// run delivers queued events until the queue is empty or the
+// subscription is cancelled.
+func (sub *subscription) run() {
+	for {
+		sub.mutex.Lock()
+		if sub.cancelled || len(sub.queue) == 0 {
+			sub.running = false
+			sub.mutex.Unlock()
+			return
+		}
+		ev := sub.queue[0]
+		sub.queue = sub.queue[1:]
+		ev.Dropped, sub.dropped = sub.dropped, 0
+		sub.mutex.Unlock()
+
+		sub.f(ev)
+	}
+}
+
+// WatchedRoutingTable reports the changes made to a routing table
+// that does not report them itself, such as the kdht-router proxy.
+// Every change to such a table is made through InsertNode or
+// RemoveNode, so it compares the table before and after each call.
+// ContactUpdated is reported only if the table records the new
+// address of a known node, which kdht-router does not.
+//
+// The failures of a kdht.FallibleRoutingTable are still reported
+// through Fallible.
+type WatchedRoutingTable struct {
+	kdht.RoutingTable
+	routes kdht.RoutingTableV2
+	local  *kdht.NodeInfo
+	*eventHub
+	// mutex serializes changes, so that each is compared against
+	// the state it was made to
+	mutex *sync.Mutex
+}
+
+// watchedFallible is a WatchedRoutingTable as a kdht.RoutingTableV2.
+type watchedFallible struct {
+	kdht.RoutingTableV2
+	watched *WatchedRoutingTable
+}
+
+// WatchRoutingTable returns a routing table that passes every call to
+// table, the routing table of the local node info, and reports its
+// changes to subscribers.
+//
+// Watching is not free: each InsertNode looks up the node and counts
+// the buckets both before and after passing it on, and each
+// RemoveNode does so before.  With kdht-router, whose every call is a
+// round trip, an insert thus takes five round trips rather than one,
+// and a removal three.
+//
+// The table may be returned from the RoutingTable function of
+// NodeOptions:
+//
+//	RoutingTable: func(info *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+//		table, err := router.New(info, k)
+//		if err != nil {
+//			return nil, err
+//		}
+//		return impl.WatchRoutingTable(info, table), nil
+//	}
+func WatchRoutingTable(info *kdht.NodeInfo, table kdht.RoutingTable) *WatchedRoutingTable {
+	return &WatchedRoutingTable{
+		RoutingTable: table,
+		routes:       kdht.AdaptRoutingTable(table),
+		local:        info,
+		eventHub:     newEventHub(),
+		mutex:        &sync.Mutex{},
+	}
+}
+
+// Fallible returns the table as a kdht.RoutingTableV2, which reports
+// the failures of the watched table if it is a
+// kdht.FallibleRoutingTable.
+func (watched *WatchedRoutingTable) Fallible() kdht.RoutingTableV2 {
+	return watchedFallible{watched.routes, watched}
+}
+
+func (watched *WatchedRoutingTable) InsertNode(node *kdht.NodeInfo) {
+	watched.Fallible().InsertNode(node)
+}
+
+func (watched *WatchedRoutingTable) RemoveNode(key keys.Key) error {
+	return watched.Fallible().RemoveNode(key)
+}
+
+func (wf watchedFallible) InsertNode(node *kdht.NodeInfo) error {
+	id, err := node.Key()
+	if err != nil {
+		return wf.RoutingTableV2.InsertNode(node)
+	}
+
+	watched := wf.watched
+	watched.mutex.Lock()
+	defer watched.mutex.Unlock()
+
+	before, had, err := wf.RoutingTableV2.Lookup(id)
+	if err != nil {
+		return err
+	}
+	buckets, err := wf.RoutingTableV2.Buckets()
+	if err != nil {
+		return err
+	}
+	if err := wf.RoutingTableV2.InsertNode(node); err != nil {
+		return err
+	}
+	after, ok, err := wf.RoutingTableV2.Lookup(id)
+	if err != nil {
+		return err
+	}
+	grown, err := wf.RoutingTableV2.Buckets()
+	if err != nil {
+		return err
+	}
+
+	// The table grows a bucket at a time, each splitting off from
+	// the last bucket
+	bits := id.Bits()
+	for n := buckets; n < grown; n++ {
+		watched.emit(Event{Type: BucketSplit, Bucket: bits - n})
+	}
+
+	switch {
+	case !had && ok:
+		watched.emit(Event{Type: ContactAdded, Node: after, Bucket: wf.bucketOf(id, grown)})
+	case had && ok && before.Address != after.Address:
+		watched.emit(Event{Type: ContactUpdated, Node: after, Previous: before, Bucket: wf.bucketOf(id, grown)})
+	}
+	return nil
+}
+
+func (wf watchedFallible) RemoveNode(key keys.Key) error {
+	watched := wf.watched
+	watched.mutex.Lock()
+	defer watched.mutex.Unlock()
+
+	before, had, err := wf.RoutingTableV2.Lookup(key)
+	if err != nil {
+		return err
+	}
+	buckets, err := wf.RoutingTableV2.Buckets()
+	if err != nil {
+		return err
+	}
+	err = wf.RoutingTableV2.RemoveNode(key)
+	if err == nil && had {
+		watched.emit(Event{Type: ContactRemoved, Node: before, Bucket: wf.bucketOf(key, buckets)})
+	}
+	return err
+}
+
+// bucketOf returns the number of the bucket that holds key in a table
+// with the given number of buckets: its distance bucket, or the last
+// bucket if it is closer than that.
+func (wf watchedFallible) bucketOf(key keys.Key, buckets int) int {
+	self, _ := wf.watched.local.Key()
+	last := key.Bits() - buckets
+	if num := self.Bucket(key); num > last {
+		return num
+	}
+	return last
+}
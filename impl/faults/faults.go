@@ -0,0 +1,346 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+// The faults package provides a network transport for k-DHT nodes
+// that misbehaves on purpose.  It wraps another transport and, as
+// directed by a list of rules, delays, drops, truncates, duplicates,
+// or corrupts the frames that nodes send, or refuses their dials.
+//
+// An Injector can be given to impl.NewNodeWith as the node's
+// Transport.  Rules apply to the frames a node sends and the dials it
+// makes; to disturb the frames a node receives, wrap the transport of
+// the node sending them.
+package faults
+
+import (
+	"context"
+	"encoding/binary"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"google.golang.org/protobuf/proto"
+)
+
+// headerLength is the length of the frame header that precedes every
+// message, as sent by impl.KdmNode.
+const headerLength = 2
+
+// Transport is the network interface of impl.Transport, repeated here
+// so that this package does not depend on impl.
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// Fault is a kind of misbehavior.
+type Fault int
+
+const (
+	// Delay holds a frame for Rule.Delay before sending it.
+	Delay Fault = iota
+	// Drop discards a frame, as if it were lost in the network.
+	Drop
+	// Truncate sends the header and half of the body of a frame,
+	// and then closes the connection.
+	Truncate
+	// Duplicate sends a frame twice.
+	Duplicate
+	// Corrupt inverts every byte of a frame's body, leaving its
+	// header intact.
+	Corrupt
+	// Refuse fails a dial with ECONNREFUSED.  It applies to dials
+	// rather than frames.
+	Refuse
+)
+
+func (f Fault) String() string {
+	switch f {
+	case Delay:
+		return "delay"
+	case Drop:
+		return "drop"
+	case Truncate:
+		return "truncate"
+	case Duplicate:
+		return "duplicate"
+	case Corrupt:
+		return "corrupt"
+	case Refuse:
+		return "refuse"
+	}
+	return "Fault(" + strconv.Itoa(int(f)) + ")"
+}
+
+// Rule describes when to inject a fault.
+type Rule struct {
+	// Peer is the address of the remote node whose connections
+	// are affected, or "" for every node.  For connections that a
+	// node accepts, the peer is learned from the sender of the
+	// first message received.
+	Peer string
+	// Types limits the rule to frames carrying these message
+	// types.  If it is empty, every frame matches.  It is ignored
+	// for Refuse.
+	Types []kdht.MessageType
+	// Fault is the fault to inject.
+	Fault Fault
+	// Probability is the chance that a matching frame or dial is
+	// affected.  Zero means always.
+	Probability float64
+	// Delay is the delay used by the Delay fault.
+	Delay time.Duration
+	// Limit is the number of times the rule applies, after which
+	// it is ignored.  Zero means no limit.
+	Limit int
+}
+
+// matches reports whether the rule applies to a frame or dial to peer.
+// The message is nil for dials, and for frames that do not parse.
+func (rule *Rule) matches(peer string, message *kdht.Message, dial bool) bool {
+	if (rule.Fault == Refuse) != dial {
+		return false
+	}
+	if rule.Peer != "" && rule.Peer != peer {
+		return false
+	}
+	if dial || len(rule.Types) == 0 {
+		return true
+	}
+	if message == nil {
+		return false
+	}
+	for _, t := range rule.Types {
+		if t == message.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// Injector is a Transport that injects faults into another.
+type Injector struct {
+	inner Transport
+
+	mutex    *sync.Mutex
+	rng      *rand.Rand
+	rules    []Rule
+	applied  []int
+	injected map[Fault]int
+}
+
+// New returns an Injector that wraps inner and applies rules.  Rules
+// are tried in order, and at most one fault is injected into each
+// frame.  The seed makes probabilistic rules reproducible.
+func New(inner Transport, seed int64, rules ...Rule) *Injector {
+	inj := &Injector{
+		inner:    inner,
+		mutex:    &sync.Mutex{},
+		rng:      rand.New(rand.NewSource(seed)),
+		injected: make(map[Fault]int),
+	}
+	inj.SetRules(rules...)
+	return inj
+}
+
+// SetRules replaces the injector's rules, including on connections
+// that are already open.  The limits of the new rules start afresh.
+func (inj *Injector) SetRules(rules ...Rule) {
+	inj.mutex.Lock()
+	defer inj.mutex.Unlock()
+	inj.rules = append([]Rule(nil), rules...)
+	inj.applied = make([]int, len(rules))
+}
+
+// Injected returns the number of times the fault has been injected.
+func (inj *Injector) Injected(fault Fault) int {
+	inj.mutex.Lock()
+	defer inj.mutex.Unlock()
+	return inj.injected[fault]
+}
+
+// choose returns the first rule that applies to a frame or dial, or
+// nil if none does.
+func (inj *Injector) choose(peer string, message *kdht.Message, dial bool) *Rule {
+	inj.mutex.Lock()
+	defer inj.mutex.Unlock()
+	for i := range inj.rules {
+		rule := &inj.rules[i]
+		if !rule.matches(peer, message, dial) {
+			continue
+		}
+		if rule.Limit > 0 && inj.applied[i] >= rule.Limit {
+			continue
+		}
+		if rule.Probability > 0 && inj.rng.Float64() >= rule.Probability {
+			continue
+		}
+		inj.applied[i]++
+		inj.injected[rule.Fault]++
+		chosen := *rule
+		return &chosen
+	}
+	return nil
+}
+
+// Listen returns a listener whose connections are subject to faults.
+func (inj *Injector) Listen(addr string) (net.Listener, error) {
+	l, err := inj.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &listener{Listener: l, inj: inj}, nil
+}
+
+// DialContext connects to addr, unless a Refuse rule applies, and
+// returns a connection subject to faults.
+func (inj *Injector) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if inj.choose(addr, nil, true) != nil {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	c, err := inj.inner.DialContext(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, inj: inj, peer: addr, known: true}, nil
+}
+
+type listener struct {
+	net.Listener
+	inj *Injector
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &conn{Conn: c, inj: l.inj}, nil
+}
+
+// conn is a connection whose outgoing frames are subject to faults.
+type conn struct {
+	net.Conn
+	inj *Injector
+
+	// peer is the address of the remote node, once known.  It is
+	// guarded by pmutex, as it is learned by reads and used by
+	// writes.
+	peer   string
+	known  bool
+	pmutex sync.Mutex
+	rbuf   []byte
+
+	wmutex sync.Mutex
+	wbuf   []byte
+}
+
+// Read reads from the connection, and learns the peer's address from
+// the first message it receives.
+func (c *conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+
+	c.pmutex.Lock()
+	defer c.pmutex.Unlock()
+	if c.known || n == 0 {
+		return n, err
+	}
+	c.rbuf = append(c.rbuf, b[:n]...)
+	if len(c.rbuf) < headerLength {
+		return n, err
+	}
+	length := headerLength + int(binary.BigEndian.Uint16(c.rbuf))
+	if len(c.rbuf) < length {
+		return n, err
+	}
+	message := &kdht.Message{}
+	if proto.Unmarshal(c.rbuf[headerLength:length], message) == nil {
+		c.peer = message.Sender.GetAddress()
+	}
+	c.known = true
+	c.rbuf = nil
+	return n, err
+}
+
+func (c *conn) remote() string {
+	c.pmutex.Lock()
+	defer c.pmutex.Unlock()
+	return c.peer
+}
+
+// Write buffers b until it holds complete frames, and sends each frame
+// subject to the injector's rules.  Frames written concurrently are not
+// interleaved.
+func (c *conn) Write(b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	c.wbuf = append(c.wbuf, b...)
+	for len(c.wbuf) >= headerLength {
+		length := headerLength + int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < length {
+			break
+		}
+		frame := append([]byte(nil), c.wbuf[:length]...)
+		c.wbuf = c.wbuf[length:]
+
+		if err := c.send(frame); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// send writes one frame, after injecting any fault that applies.
+func (c *conn) send(frame []byte) error {
+	message := &kdht.Message{}
+	if proto.Unmarshal(frame[headerLength:], message) != nil {
+		message = nil
+	}
+	rule := c.inj.choose(c.remote(), message, false)
+	if rule == nil {
+		return c.write(frame)
+	}
+
+	switch rule.Fault {
+	case Delay:
+		time.Sleep(rule.Delay)
+	case Drop:
+		return nil
+	case Truncate:
+		body := len(frame) - headerLength
+		c.write(frame[:headerLength+body/2])
+		return c.Conn.Close()
+	case Duplicate:
+		if err := c.write(frame); err != nil {
+			return err
+		}
+	case Corrupt:
+		for i := headerLength; i < len(frame); i++ {
+			frame[i] ^= 0xff
+		}
+	}
+	return c.write(frame)
+}
+
+func (c *conn) write(data []byte) error {
+	for len(data) > 0 {
+		n, err := c.Conn.Write(data)
+		if err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package impl
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+	"google.golang.org/protobuf/proto"
+)
+
+// fuzzNode returns a node for fuzz targets to feed input to.  It uses
+// an in-process routing table so that inputs are checked quickly.
+func fuzzNode(f *testing.F) *KdmNode {
+	opts := NodeOptions{RoutingTable: func(info *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+		return NewKdmRoutingTable(info, k)
+	}}
+	node, err := NewNodeWith(byteToKey(0x10), "localhost:0", 2, 1, nil, opts)
+	if err != nil {
+		f.Fatalf("(node creation failed) %v", err)
+	}
+	f.Cleanup(func() { node.Shutdown() })
+	return node
+}
+
+// fuzzFrames adds seeds holding one frame of each message type, and
+// frames with missing or malformed fields.
+func fuzzFrames(f *testing.F) {
+	sender := &kdht.NodeInfo{Id: byteToKey(0x20).Bytes(), Address: Address2,
+		Version: kdht.ProtocolVersion, Capabilities: kdht.Capabilities}
+	val := []byte("val1")
+	messages := []*kdht.Message{
+		{Sender: sender, Type: kdht.MessageType_PING, Value: []byte("hello")},
+		{Sender: sender, Type: kdht.MessageType_STORE, Key: keys.Compute(val).Bytes(), Value: val},
+		{Sender: sender, Type: kdht.MessageType_GET, Key: keys.Compute(val).Bytes()},
+		{Sender: sender, Type: kdht.MessageType_FIND_NODE, Key: byteToKey(0x30).Bytes()},
+		{Sender: sender, Type: kdht.MessageType_FIND_VALUE, Key: keys.Compute(val).Bytes()},
+		{Sender: sender, Type: kdht.MessageType_ACK},
+		{Sender: &kdht.NodeInfo{Id: []byte{0x20}, Address: Address2}, Type: kdht.MessageType_PING},
+		{Sender: &kdht.NodeInfo{Address: Address2}, Type: kdht.MessageType_FIND_NODE, Key: []byte{0x30}},
+		{Type: kdht.MessageType_PING},
+	}
+
+	var all []byte
+	for _, message := range messages {
+		frame := fuzzFrame(f, message)
+		f.Add(frame)
+		all = append(all, frame...)
+	}
+	f.Add(all)
+	f.Add(all[:len(all)-1])
+	f.Add([]byte{0xff, 0xff, 0x00})
+}
+
+func fuzzFrame(f *testing.F, message *kdht.Message) []byte {
+	data, err := proto.Marshal(message)
+	if err != nil {
+		f.Fatal(err)
+	}
+	frame := make([]byte, headerLength, headerLength+len(data))
+	binary.BigEndian.PutUint16(frame, uint16(len(data)))
+	return append(frame, data...)
+}
+
+// FuzzRecieveMessage feeds arbitrary bytes to the frame parser.
+func FuzzRecieveMessage(f *testing.F) {
+	fuzzFrames(f)
+	node := fuzzNode(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		defer server.Close()
+		go func() {
+			client.Write(data)
+			client.Close()
+		}()
+
+		for {
+			message, err := node.recieveMessage(server)
+			if err != nil {
+				return
+			}
+			if message == nil {
+				t.Fatalf("recieveMessage returned neither a message nor an error")
+			}
+		}
+	})
+}
+
+// FuzzHandleConnection feeds arbitrary bytes to the connection loop,
+// which dispatches every message that parses to its handler.
+func FuzzHandleConnection(f *testing.F) {
+	fuzzFrames(f)
+	node := fuzzNode(f)
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			defer server.Close()
+			node.handleConnection(server)
+		}()
+
+		// Responses are discarded so that the connection loop
+		// never blocks sending them
+		go io.Copy(io.Discard, client)
+		client.Write(data)
+		client.Close()
+		<-done
+	})
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package impl
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// The headers identifying the node that a value was retrieved from.
+const (
+	NodeIDHeader      = "Kdht-Node-Id"
+	NodeAddressHeader = "Kdht-Node-Address"
+)
+
+// NewGatewayHandler returns an HTTP handler that lets clients that
+// cannot link this package store and fetch values through node:
+//
+//	PUT /v1/values           store the request body, return its key
+//	GET /v1/values/KEY       the value stored under KEY
+//	GET /v1/nodes/KEY        the K nodes closest to KEY
+//
+// Values are sent and returned as raw bytes.  A successful PUT
+// returns 201 Created with the value's URL in the Location header and
+// a JSON object containing its "key".  A successful value GET carries
+// the ID and address of the node it was found at in the NodeIDHeader
+// and NodeAddressHeader headers.  Keys are hex encoded.
+//
+// Failures are returned as a JSON object with an "error" field, and a
+// status code chosen by StatusFor: for example, 502 Bad Gateway for
+// StorageError, 404 Not Found for ValueError, and 503 Service
+// Unavailable for ShutdownError.
+func NewGatewayHandler(node kdht.Node) http.Handler {
+	space := spaceOf(node)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/values", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodPut) {
+			return
+		}
+		val, err := readValue(r)
+		if err == nil {
+			err = node.Store(val)
+		}
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		key := space.Compute(val).String()
+		w.Header().Set("Location", "/v1/values/"+key)
+		writeJSON(w, http.StatusCreated, &ControlResult{Key: key})
+	})
+	mux.HandleFunc("/v1/values/", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		id, err := parseHexKey(space, strings.TrimPrefix(r.URL.Path, "/v1/values/"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		val, info, err := node.FindValue(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", strconv.Itoa(len(val)))
+		w.Header().Set(NodeIDHeader, hex.EncodeToString(info.Id))
+		w.Header().Set(NodeAddressHeader, info.Address)
+		w.WriteHeader(http.StatusOK)
+		w.Write(val)
+	})
+	mux.HandleFunc("/v1/nodes/", func(w http.ResponseWriter, r *http.Request) {
+		if !checkMethod(w, r, http.MethodGet) {
+			return
+		}
+		id, err := parseHexKey(space, strings.TrimPrefix(r.URL.Path, "/v1/nodes/"))
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		nodes, err := node.FindNode(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, &ControlResult{Key: id.String(), Nodes: toControlNodes(nodes)})
+	})
+	return mux
+}
+
+// spaceOf returns the key space of node, if it reports one, or else
+// keys.Default.
+func spaceOf(node kdht.Node) *keys.Space {
+	if n, ok := node.(interface{ KeySpace() *keys.Space }); ok {
+		return n.KeySpace()
+	}
+	return keys.Default
+}
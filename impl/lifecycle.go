@@ -0,0 +1,194 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package impl
+
+import (
+	"net"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// A node moves through these states in order, and never goes back.
+const (
+	// The node is serving requests and accepting operations.
+	stateRunning int32 = iota
+	// The node has stopped accepting connections and operations,
+	// and is waiting for in-flight requests and handing off its
+	// values.
+	stateDraining
+	// The node has closed every connection and all of its
+	// goroutines have exited or are exiting.
+	stateClosed
+)
+
+// shutdownTimeout is how long Shutdown waits for in-flight requests
+// before closing their connections.
+const shutdownTimeout = 5 * time.Second
+
+// ShutdownOptions controls a graceful shutdown.
+type ShutdownOptions struct {
+	// Timeout bounds how long to wait for in-flight requests and
+	// value handoff before forcibly closing every connection.
+	Timeout time.Duration
+
+	// Handoff causes every locally stored value to be stored to
+	// the other nodes closest to its key before this node leaves.
+	Handoff bool
+}
+
+// Shutdown stops this node with the default ShutdownOptions: in-flight
+// requests are given shutdownTimeout to complete, and stored values
+// are not handed off.
+func (node *KdmNode) Shutdown() error {
+	return node.ShutdownWith(ShutdownOptions{Timeout: shutdownTimeout})
+}
+
+// ShutdownWith stops this node.  It immediately stops accepting
+// connections and operations, waits up to opts.Timeout for requests
+// that are already in flight, optionally hands off its stored values,
+// and then closes every remaining connection.  When it returns, every
+// goroutine started by this node has exited.
+//
+// This method returns ShutdownError if the node is already shut down
+// or shutting down.
+func (node *KdmNode) ShutdownWith(opts ShutdownOptions) error {
+	node.stateMutex.Lock()
+	if node.state.Load() != stateRunning {
+		node.stateMutex.Unlock()
+		return kdht.ShutdownError
+	}
+	node.state.Store(stateDraining)
+	node.stateMutex.Unlock()
+	node.logf("shutting down")
+
+	err := node.listener.Close()
+	deadline := time.After(opts.Timeout)
+
+	drained := make(chan bool)
+	go func() {
+		node.requests.Wait()
+		if opts.Handoff {
+			node.handoff()
+		}
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-deadline:
+		node.logf("shutdown timed out, closing connections")
+	}
+
+	node.stateMutex.Lock()
+	node.state.Store(stateClosed)
+	node.stateMutex.Unlock()
+
+	node.cancel()
+	node.connMutex.Lock()
+	for conn := range node.conns {
+		conn.Close()
+	}
+	node.connMutex.Unlock()
+
+	<-drained
+	node.goroutines.Wait()
+	return err
+}
+
+// begin registers an in-flight request or operation, which Shutdown
+// will wait for.  It returns false if the node is no longer running,
+// in which case end must not be called.
+//
+// The caller also counts as a goroutine of this node until it calls
+// end, so that any goroutines it spawns are always waited for.
+func (node *KdmNode) begin() bool {
+	node.stateMutex.Lock()
+	defer node.stateMutex.Unlock()
+	if node.state.Load() != stateRunning {
+		return false
+	}
+	node.requests.Add(1)
+	node.goroutines.Add(1)
+	return true
+}
+
+// end completes a request or operation registered with begin.
+func (node *KdmNode) end() {
+	node.goroutines.Done()
+	node.requests.Done()
+}
+
+// spawn runs f in a new goroutine that Shutdown will wait for.  It
+// must only be called while the node is running, or from a goroutine
+// that Shutdown is already waiting for.
+func (node *KdmNode) spawn(f func()) {
+	node.goroutines.Add(1)
+	go func() {
+		defer node.goroutines.Done()
+		f()
+	}()
+}
+
+// dial connects to addr and tracks the connection so that Shutdown
+// can close it.  The connection must be released with hangup.
+func (node *KdmNode) dial(addr string) (net.Conn, error) {
+	conn, err := node.transport.DialContext(node.ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if !node.track(conn) {
+		return nil, kdht.ShutdownError
+	}
+	return conn, nil
+}
+
+// track records an open connection so that Shutdown can close it.
+// If the node is already closed, the connection is closed and false
+// is returned.
+func (node *KdmNode) track(conn net.Conn) bool {
+	node.connMutex.Lock()
+	defer node.connMutex.Unlock()
+	if node.state.Load() == stateClosed {
+		conn.Close()
+		return false
+	}
+	node.conns[conn] = true
+	return true
+}
+
+// hangup closes a connection returned by dial or passed to track.
+func (node *KdmNode) hangup(conn net.Conn) {
+	node.connMutex.Lock()
+	delete(node.conns, conn)
+	node.connMutex.Unlock()
+	conn.Close()
+}
+
+// handoff stores every locally stored value to the nodes closest to
+// its key, other than this one.
+func (node *KdmNode) handoff() {
+	values := make(map[keys.Key][]byte)
+	ids := []keys.Key{}
+	node.storageMutex.Lock()
+	for key, val := range node.localStorage {
+		values[key] = val
+		ids = append(ids, key)
+	}
+	node.storageMutex.Unlock()
+
+	node.logf("handing off %v values", len(ids))
+	groups := node.batchLookup(ids)
+	peers, requests := node.storeRequests(groups, values, false)
+	node.batchContact(peers, requests, func(*kdht.Message, *kdht.Message) {})
+}
@@ -11,64 +11,307 @@ policies for more package.
 package impl
 
 import (
-	"bytes"
+	"errors"
 	"slices"
+	"sync"
+	"time"
 
 	"cse586.kdht/api/kdht"
 	"cse586.kdht/given/keys"
 	"cse586.kdht/given/router"
 )
 
+// KdmRoutingTable is a split-tree routing table.  Each level of the
+// tree resolves one symbol of SymbolBits bits of the distance from
+// the local node, and holds a k-bucket for every value of that symbol
+// but zero; the nodes sharing every resolved symbol with the local
+// node are in a final bucket, which splits into a new level when it
+// is full.  With one bit per symbol, this is the routing table of
+// the Kademlia paper, and the buckets are the k-buckets numbered by
+// keys.DistanceBucket.  The Split policy may also split buckets off
+// the local node's path through the tree.
+//
+// Changes to the table are reported to the functions registered with
+// Subscribe.
 type KdmRoutingTable struct {
-	local   *kdht.NodeInfo
-	k       int
-	buckets [][]*kdht.NodeInfo
+	local  *kdht.NodeInfo
+	id     keys.Key
+	k      int
+	symbol int
+	split  SplitPolicy
+	// buckets holds the leaves of the tree, farthest level first,
+	// with the final bucket last.
+	buckets []*bucket
+	// stats holds what is known of every node in a bucket or a
+	// replacement cache, other than the local node.
+	stats map[keys.Key]*contactStats
+	mutex *sync.Mutex
+	*eventHub
 }
 
+// bucket is a leaf of a KdmRoutingTable: up to k nodes whose IDs are
+// in the range of keys sharing their first depth bits.
+type bucket struct {
+	keys  keys.Range
+	depth int
+	nodes []*kdht.NodeInfo
+	// cache holds up to k nodes in the range of the bucket that
+	// were seen while it was full, least recently seen first.
+	// They replace nodes of the bucket that become stale, as in
+	// Section 4.1 of the Kademlia paper.
+	cache []*kdht.NodeInfo
+}
+
+// contactStats is what a KdmRoutingTable knows of a node.
+type contactStats struct {
+	lastSeen time.Time
+	rtt      time.Duration
+	failures int
+}
+
+// staleFailures is the number of requests in a row that a node must
+// fail to answer before it is replaced from its bucket's cache.
+const staleFailures = 5
+
+// SplitPolicy chooses which full buckets of a KdmRoutingTable are
+// split to make room for a new node.  The bucket holding the local
+// node is always split.
+type SplitPolicy int
+
+const (
+	// SplitLocal splits only the bucket holding the local node,
+	// as in Section 2.2 of the Kademlia paper.  Every other
+	// bucket holds at most k nodes, so a region near the local
+	// node but off its path through the tree is known only
+	// through k of its nodes.
+	SplitLocal SplitPolicy = iota
+	// SplitRelaxed also splits a full bucket when the new node
+	// would be among the k nodes in the table closest to the
+	// local node, as in Section 2.4 of the paper.  The table then
+	// keeps every node of the smallest subtree around the local
+	// node that holds at least k nodes, however unbalanced the
+	// tree is.
+	SplitRelaxed
+)
+
+// RoutingOptions holds the optional parameters of
+// NewKdmRoutingTableWith.  Any zero field takes the same default as
+// NewKdmRoutingTable.
+type RoutingOptions struct {
+	// SymbolBits is the number of bits of the distance resolved by
+	// each level of the table, which is b in Section 4.2 of the
+	// Kademlia paper.  A table with b bits per symbol has 2^b - 1
+	// buckets per level, and a lookup through such tables takes
+	// about log_{2^b}(n) hops rather than log2(n).  It must divide
+	// the width of the local node's ID and be at most 8.  The
+	// default is 1.
+	SymbolBits int
+
+	// Split chooses which full buckets are split.  The default is
+	// SplitLocal.
+	Split SplitPolicy
+}
+
+// NewRoutingTable returns a routing table maintained by kdht-router.
+// kdht-router supports only keys.SHA1, so the table of a node in any
+// other key space is maintained within this process instead.
 func NewRoutingTable(node *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
-	return router.New(node, k)
-	/*
-		if node.GetId() == nil || len(node.GetId()) != kdht.KeyBytes {
-			return nil, errors.New("invalid id")
+	if keys.SHA1.Check(node.GetId()) != nil {
+		table, err := NewKdmRoutingTable(node, k)
+		if err != nil {
+			return nil, err
 		}
+		return table, nil
+	}
+	return router.New(node, k)
+}
 
-		if k <= 0 {
-			return nil, errors.New("invalid k")
-		}
+// NewKdmRoutingTable returns a routing table that is maintained
+// within this process rather than by kdht-router.  This is useful
+// when running many nodes at once, such as in simulations, where a
+// router process per node would be too costly.
+func NewKdmRoutingTable(node *kdht.NodeInfo, k int) (*KdmRoutingTable, error) {
+	return NewKdmRoutingTableWith(node, k, RoutingOptions{})
+}
 
-		bucket := make([]*kdht.NodeInfo, 0, k)
-		bucket = append(bucket, node)
-		table := new(KdmRoutingTable)
-		table.local = node
-		table.k = k
-		table.buckets = make([][]*kdht.NodeInfo, 0, kdht.KeyBits)
-		table.buckets = append(table.buckets, bucket)
-		return table, nil
-	*/
+// NewKdmRoutingTableWith is identical to NewKdmRoutingTable, except
+// that the table's structure can be changed through opts.
+//
+// With more than one bit per symbol, a bucket number passed to
+// GetNodes names every bucket of the table holding nodes at that
+// distance, so GetNodes may return up to 2^(SymbolBits-1) * k nodes.
+func NewKdmRoutingTableWith(node *kdht.NodeInfo, k int, opts RoutingOptions) (*KdmRoutingTable, error) {
+	id, err := node.Key()
+	if err != nil {
+		return nil, errors.New("invalid id")
+	}
+
+	if k <= 0 {
+		return nil, errors.New("invalid k")
+	}
+
+	if opts.SymbolBits == 0 {
+		opts.SymbolBits = 1
+	}
+	if opts.SymbolBits < 0 || opts.SymbolBits > 8 || id.Bits()%opts.SymbolBits != 0 {
+		return nil, errors.New("invalid symbol bits")
+	}
+	if opts.Split != SplitLocal && opts.Split != SplitRelaxed {
+		return nil, errors.New("invalid split policy")
+	}
+
+	table := new(KdmRoutingTable)
+	table.local = node
+	table.id = id
+	table.k = k
+	table.symbol = opts.SymbolBits
+	table.split = opts.Split
+	table.buckets = []*bucket{table.newBucket(id, 0)}
+	table.buckets[0].nodes = append(table.buckets[0].nodes, node)
+	table.stats = make(map[keys.Key]*contactStats)
+	table.mutex = &sync.Mutex{}
+	table.eventHub = newEventHub()
+	return table, nil
 }
 
 func (table *KdmRoutingTable) K() int {
 	return table.k
 }
 
+// SymbolBits returns the number of bits of the distance resolved by
+// each level of the table.
+func (table *KdmRoutingTable) SymbolBits() int {
+	return table.symbol
+}
+
+// InsertNode inserts node, which has just been heard from.  A node
+// that does not fit in its bucket is kept in the bucket's replacement
+// cache instead.
 func (table *KdmRoutingTable) InsertNode(node *kdht.NodeInfo) {
-	num := table.bucketNumber(node.GetId())
-	idx, bucket := table.findBucket(num)
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
 
-	for len(bucket) == cap(bucket) {
-		if idx != len(table.buckets)-1 {
+	table.insert(node)
+}
+
+// RecordResponse records that node answered a request after rtt, and
+// inserts it as InsertNode does.
+func (table *KdmRoutingTable) RecordResponse(node *kdht.NodeInfo, rtt time.Duration) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	if stats := table.insert(node); stats != nil {
+		stats.rtt = rtt
+	}
+}
+
+// RecordFailure records that the node in a bucket at addr failed to
+// answer a request.  Once it has failed staleFailures requests in a
+// row, it is replaced by the most recently seen node in the bucket's
+// replacement cache, if there is one.
+func (table *KdmRoutingTable) RecordFailure(addr string) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	for _, b := range table.buckets {
+		for idx, node := range b.nodes {
+			if node.Address != addr || node == table.local {
+				continue
+			}
+			id, _ := node.Key()
+			stats := table.stats[id]
+			if stats == nil {
+				return
+			}
+			stats.failures++
+			if stats.failures < staleFailures || len(b.cache) == 0 {
+				return
+			}
+
+			last := len(b.cache) - 1
+			b.nodes[idx] = b.cache[last]
+			b.cache = b.cache[:last]
+			delete(table.stats, id)
+			num := table.bucketNumber(table.bucketIndex(id))
+			table.emit(Event{Type: ContactRemoved, Node: node, Bucket: num})
+			table.emit(Event{Type: ContactAdded, Node: b.nodes[idx], Bucket: num})
 			return
 		}
+	}
+}
+
+// uncache returns cache without the node with the given ID.
+func uncache(cache []*kdht.NodeInfo, id keys.Key) []*kdht.NodeInfo {
+	return slices.DeleteFunc(cache, func(cached *kdht.NodeInfo) bool {
+		other, _ := cached.Key()
+		return other == id
+	})
+}
+
+// insert inserts node and returns its statistics, or nil if it does
+// not belong in the table.
+func (table *KdmRoutingTable) insert(node *kdht.NodeInfo) *contactStats {
+	// The local node's own entry is authoritative, and nodes
+	// from other key spaces do not belong in the table
+	id, err := node.Key()
+	if err != nil || id == table.id || id.Size() != table.id.Size() {
+		return nil
+	}
+
+	stats := table.stats[id]
+	if stats == nil {
+		stats = &contactStats{}
+	}
+	stats.lastSeen = time.Now()
+	stats.failures = 0
+
+	// A known node is replaced so that its latest address,
+	// version, and capabilities are recorded.
+	if idx1, idx2 := table.findKey(id); idx1 != -1 {
+		old := table.buckets[idx1].nodes[idx2]
+		table.buckets[idx1].nodes[idx2] = node
+		if old.Address != node.Address {
+			table.emit(Event{Type: ContactUpdated, Node: node, Previous: old, Bucket: table.bucketNumber(idx1)})
+		}
+		return stats
+	}
 
-		table.split()
-		idx, bucket = table.findBucket(num)
+	idx := table.bucketIndex(id)
+	for len(table.buckets[idx].nodes) >= table.k {
+		if !table.splitFor(idx, id) {
+			table.cacheNode(table.buckets[idx], id, node)
+			table.stats[id] = stats
+			return stats
+		}
+		idx = table.bucketIndex(id)
 	}
 
-	table.buckets[idx] = append(bucket, node)
+	b := table.buckets[idx]
+	b.nodes = append(b.nodes, node)
+	b.cache = uncache(b.cache, id)
+	table.stats[id] = stats
+	table.emit(Event{Type: ContactAdded, Node: node, Bucket: table.bucketNumber(idx)})
+	return stats
+}
+
+// cacheNode adds node to the replacement cache of b as its most
+// recently seen entry, dropping the least recently seen if the cache
+// is full.
+func (table *KdmRoutingTable) cacheNode(b *bucket, id keys.Key, node *kdht.NodeInfo) {
+	b.cache = uncache(b.cache, id)
+	if len(b.cache) >= table.k {
+		dropped, _ := b.cache[0].Key()
+		delete(table.stats, dropped)
+		b.cache = b.cache[1:]
+	}
+	b.cache = append(b.cache, node)
 }
 
-func (table *KdmRoutingTable) RemoveNode(key []byte) error {
-	if bytes.Equal(table.local.GetId(), key) {
+func (table *KdmRoutingTable) RemoveNode(key keys.Key) error {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	if key == table.id {
 		return kdht.InvalidNodeError
 	}
 
@@ -78,135 +321,233 @@ func (table *KdmRoutingTable) RemoveNode(key []byte) error {
 		return kdht.InvalidNodeError
 	}
 
-	table.buckets[idx1] = sliceDelete(table.buckets[idx1], idx2)
+	node := table.buckets[idx1].nodes[idx2]
+	table.buckets[idx1].nodes = sliceDelete(table.buckets[idx1].nodes, idx2)
+	delete(table.stats, key)
+	table.emit(Event{Type: ContactRemoved, Node: node, Bucket: table.bucketNumber(idx1)})
 	return nil
 }
 
-func (table *KdmRoutingTable) Lookup(key []byte) (node *kdht.NodeInfo, ok bool) {
+func (table *KdmRoutingTable) Lookup(key keys.Key) (node *kdht.NodeInfo, ok bool) {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
 	idx1, idx2 := table.findKey(key)
 
 	if idx1 == -1 || idx2 == -1 {
 		return nil, false
 	}
 
-	return table.buckets[idx1][idx2], true
+	return table.buckets[idx1].nodes[idx2], true
 }
 
+// GetNodes returns the nodes in bucket num, numbered as by
+// keys.DistanceBucket.  The last bucket, num = 160 - Buckets() for
+// SHA-1 keys, holds the local node and every node closer to it.
+//
+// With more than one bit per symbol, or relaxed splitting, a bucket
+// number names every leaf of the table holding nodes at that
+// distance, so GetNodes may return more than k nodes.
 func (table *KdmRoutingTable) GetNodes(num int) []*kdht.NodeInfo {
-	idx, bucket := table.getBucket(num)
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
 
-	if idx == -1 || len(bucket) == 0 {
-		return nil
+	var nodes []*kdht.NodeInfo
+	for idx, b := range table.buckets {
+		if table.bucketNumber(idx) == num {
+			nodes = append(nodes, b.nodes...)
+		}
 	}
 
-	return table.buckets[idx]
+	if len(nodes) == 0 {
+		return nil
+	}
+	return nodes
 }
 
-func (table *KdmRoutingTable) ClosestK(key []byte) []*kdht.NodeInfo {
-	closest := make([]*kdht.NodeInfo, 0, table.k)
-
-	cmp := func(node1, node2 *kdht.NodeInfo) int {
-		dist1 := keys.Distance(key, node1.GetId())
-		dist2 := keys.Distance(key, node2.GetId())
-		return bytes.Compare(dist1[:], dist2[:])
+// ClosestK returns the nodes closest to key, nearest first.  Buckets
+// need not be contiguous in key space relative to key (the nodes of
+// an empty or partial bucket may be closer than those of the next
+// one), so every node is considered.
+func (table *KdmRoutingTable) ClosestK(key keys.Key) []*kdht.NodeInfo {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	var closest []*kdht.NodeInfo
+	for _, b := range table.buckets {
+		closest = append(closest, b.nodes...)
 	}
 
-	phase := 1
-	num := table.bucketNumber(key)
-	origidx, bucket := table.findBucket(num)
-	idx := origidx
-
-	for {
-		if phase == 2 {
-			idx--
-			if idx < 0 {
-				return closest
-			}
-			bucket = table.buckets[idx]
-		}
+	slices.SortFunc(closest, func(node1, node2 *kdht.NodeInfo) int {
+		id1, _ := node1.Key()
+		id2, _ := node2.Key()
+		return key.Cmp(id1, id2)
+	})
+	if len(closest) > table.k {
+		closest = closest[:table.k]
+	}
+	return closest
+}
 
-		if len(closest)+len(bucket) > cap(closest) {
-			sorted := cloneSlice(bucket)
-			slices.SortFunc(sorted, cmp)
-			bidx := cap(closest) - len(closest)
-			closest = append(closest, sorted[:bidx]...)
-			return closest
-		}
+// Buckets returns the number of distance buckets resolved by the
+// levels of the table, plus the final bucket.
+func (table *KdmRoutingTable) Buckets() int {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
 
-		if phase == 1 {
-			closest = append(closest, bucket...)
+	return table.buckets[len(table.buckets)-1].depth + 1
+}
 
-			key = nextKey(key)
-			if key == nil {
-				return closest
-			}
+// BucketRanges returns the range of keys covered by each bucket but
+// the final one, farthest level first.
+func (table *KdmRoutingTable) BucketRanges() []keys.Range {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
 
-			nextnum := table.bucketNumber(key)
-			nextidx, nextbucket := table.findBucket(nextnum)
-			if idx == nextidx {
-				phase = 2
-				idx = origidx
-				continue
-			}
-			idx = nextidx
-			bucket = nextbucket
-		}
+	ranges := []keys.Range{}
+	for _, b := range table.buckets[:len(table.buckets)-1] {
+		ranges = append(ranges, b.keys)
 	}
+	return ranges
 }
 
-func (table *KdmRoutingTable) Buckets() int {
-	return len(table.buckets)
+// newBucket returns an empty bucket for the keys that share their
+// first depth bits with prefix.
+func (table *KdmRoutingTable) newBucket(prefix keys.Key, depth int) *bucket {
+	return &bucket{keys: keys.PrefixRange(prefix, depth), depth: depth, nodes: make([]*kdht.NodeInfo, 0, table.k)}
 }
 
-func (table *KdmRoutingTable) split() {
-	idx := len(table.buckets) - 1
-	bucket := cloneSlice(table.buckets[idx])
-	left := make([]*kdht.NodeInfo, 0, table.k)
-	right := make([]*kdht.NodeInfo, 0, table.k)
-	table.buckets[idx] = left
-	table.buckets = append(table.buckets, right)
-
-	for _, node := range bucket {
-		num := table.bucketNumber(node.GetId())
-		idx, _ := table.findBucket(num)
+// splitFor splits the full bucket at idx to make room for id if the
+// split policy allows it, and reports whether it did.  The final
+// bucket splits until it is a single distance bucket.
+func (table *KdmRoutingTable) splitFor(idx int, id keys.Key) bool {
+	b := table.buckets[idx]
+	if idx == len(table.buckets)-1 {
+		if b.depth+table.symbol > table.id.Bits()-table.symbol {
+			return false
+		}
+		table.splitFinal()
+		return true
+	}
 
-		table.buckets[idx] = append(table.buckets[idx], node)
+	if table.split == SplitRelaxed && b.depth < table.id.Bits() && table.amongClosest(id) {
+		table.splitBucket(idx)
+		return true
 	}
+	return false
 }
 
-func (table *KdmRoutingTable) bucketNumber(key []byte) int {
-	dist := keys.Distance(table.local.GetId(), key)
-	num := keys.DistanceBucket(dist)
-	return num
+// splitFinal replaces the final bucket with a new level and a new
+// final bucket, and moves each of its nodes to whichever it belongs
+// in.
+func (table *KdmRoutingTable) splitFinal() {
+	last := len(table.buckets) - 1
+	final := table.buckets[last]
+	table.emit(Event{Type: BucketSplit, Bucket: table.bucketNumber(last)})
+	table.buckets = table.buckets[:last]
+
+	depth := final.depth + table.symbol
+	top := table.id.Bits() - 1 - final.depth
+	for sym := 1; sym < 1<<table.symbol; sym++ {
+		// d is the distance whose symbol at this level is sym,
+		// and which is zero elsewhere
+		d := make([]byte, table.id.Size())
+		for b := 0; b < table.symbol; b++ {
+			if sym&(1<<b) != 0 {
+				pos := top - table.symbol + 1 + b
+				d[len(d)-1-pos/8] |= 1 << (pos % 8)
+			}
+		}
+		dk, _ := keys.FromBytes(d)
+		table.buckets = append(table.buckets, table.newBucket(table.id.Distance(dk), depth))
+	}
+	table.buckets = append(table.buckets, table.newBucket(table.id, depth))
+	table.reinsert(final)
 }
 
-func (table *KdmRoutingTable) getBucket(num int) (int, []*kdht.NodeInfo) {
-	idx := cap(table.buckets) - num - 1
+// splitBucket replaces the bucket at idx, which is not the final
+// bucket, with the two buckets for each value of its next bit.
+func (table *KdmRoutingTable) splitBucket(idx int) {
+	b := table.buckets[idx]
+	table.emit(Event{Type: BucketSplit, Bucket: table.bucketNumber(idx)})
+	lower := table.newBucket(b.keys.Lo, b.depth+1)
+	upper := table.newBucket(b.keys.Hi, b.depth+1)
+	table.buckets = slices.Replace(table.buckets, idx, idx+1, lower, upper)
+	table.reinsert(b)
+}
 
-	if idx < 0 || idx >= len(table.buckets) {
-		return -1, nil
+// reinsert adds the nodes of a bucket that has been split to the
+// buckets they now belong in.  Its cached nodes, most recently seen
+// first, join any of those buckets that has room, and the caches of
+// the others.
+func (table *KdmRoutingTable) reinsert(old *bucket) {
+	for _, node := range old.nodes {
+		id, _ := node.Key()
+		idx := table.bucketIndex(id)
+		table.buckets[idx].nodes = append(table.buckets[idx].nodes, node)
+	}
+	for i := len(old.cache) - 1; i >= 0; i-- {
+		node := old.cache[i]
+		id, _ := node.Key()
+		idx := table.bucketIndex(id)
+		b := table.buckets[idx]
+		if len(b.nodes) < table.k {
+			b.nodes = append(b.nodes, node)
+			table.emit(Event{Type: ContactAdded, Node: node, Bucket: table.bucketNumber(idx)})
+			continue
+		}
+		b.cache = slices.Insert(b.cache, 0, node)
 	}
-
-	return idx, table.buckets[idx]
 }
 
-func (table *KdmRoutingTable) findBucket(num int) (int, []*kdht.NodeInfo) {
-	idx, bucket := table.getBucket(num)
+// amongClosest reports whether fewer than k nodes in the table are
+// closer to the local node than id is.
+func (table *KdmRoutingTable) amongClosest(id keys.Key) bool {
+	closer := 0
+	for _, b := range table.buckets {
+		for _, node := range b.nodes {
+			other, _ := node.Key()
+			if other != table.id && table.id.Cmp(other, id) < 0 {
+				closer++
+			}
+		}
+	}
+	return closer < table.k
+}
 
-	if idx == -1 {
-		idx = len(table.buckets) - 1
-		return idx, table.buckets[idx]
+// bucketIndex returns the index in table.buckets of the bucket whose
+// range holds key, or -1 if key is not in the table's key space.
+// Most keys are far from the local node, in the first levels of the
+// tree, so it is searched from the start.
+func (table *KdmRoutingTable) bucketIndex(key keys.Key) int {
+	for idx, b := range table.buckets {
+		if b.keys.Contains(key) {
+			return idx
+		}
 	}
+	return -1
+}
 
-	return idx, bucket
+// bucketNumber returns the number, as passed to GetNodes, of the
+// bucket at idx in table.buckets.  The final bucket holds every
+// distance below those of the levels above it, and is numbered by the
+// farthest of them.
+func (table *KdmRoutingTable) bucketNumber(idx int) int {
+	b := table.buckets[idx]
+	if idx == len(table.buckets)-1 {
+		return table.id.Bits() - 1 - b.depth
+	}
+	return table.id.Bucket(b.keys.Lo)
 }
 
-func (table *KdmRoutingTable) findKey(key []byte) (int, int) {
-	num := table.bucketNumber(key)
-	idx1, bucket := table.findBucket(num)
+func (table *KdmRoutingTable) findKey(key keys.Key) (int, int) {
+	idx1 := table.bucketIndex(key)
+	if idx1 == -1 {
+		return -1, -1
+	}
 
-	for idx2, node := range bucket {
-		if bytes.Equal(node.GetId(), key) {
+	for idx2, node := range table.buckets[idx1].nodes {
+		if id, _ := node.Key(); id == key {
 			return idx1, idx2
 		}
 	}
@@ -225,24 +566,3 @@ func sliceDelete[Type any](slice []Type, idx int) []Type {
 	right := slice[idx+1:]
 	return append(left, right...)
 }
-
-func nextKey(key []byte) []byte {
-	next := cloneSlice(key)
-
-	for idx, b := range next {
-		if b == 0x0 {
-			continue
-		}
-
-		for count := 0; count < 8; count++ {
-			mask := byte(1 << (7 - count))
-
-			if b&mask>>(7-count) == 1 {
-				next[idx] = b &^ mask
-				return next
-			}
-		}
-	}
-
-	return nil
-}
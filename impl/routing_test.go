@@ -1,5 +1,559 @@
 package impl
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/api/kdht/kdhttest"
+	"cse586.kdht/given/keys"
+	"cse586.kdht/given/router"
+)
+
+func TestRouting_Conformance(t *testing.T) {
+	kdhttest.TestRoutingTable(t, func(node *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+		return NewKdmRoutingTable(node, k)
+	})
+}
+
+func TestRouting_Space(t *testing.T) {
+	kdhttest.TestRoutingTableSpace(t, func(node *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+		return NewKdmRoutingTable(node, k)
+	}, keys.SHA256)
+}
+
+// KdmRoutingTable.ClosestK sorts every node in the table by distance
+// instead of walking its buckets with nextKey, as it did when the
+// model was written, so comparing its ClosestK to the model's no
+// longer exercises a search algorithm of its own.  The comparison
+// still checks that the table holds the nodes the model does, and
+// still checks the search of kdht-router in TestRouterProperties.
+func TestRouting_Properties(t *testing.T) {
+	kdhttest.TestProperties(t, func(node *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+		return NewKdmRoutingTable(node, k)
+	}, 200)
+}
+
+func TestRouting_SymbolBits(t *testing.T) {
+	rng := rand.New(rand.NewSource(44))
+	for _, split := range []SplitPolicy{SplitLocal, SplitRelaxed} {
+		for _, bits := range []int{1, 2, 4, 8} {
+			for _, k := range []int{1, 3, 8} {
+				id, _ := keys.RandomFrom(rng)
+				self := &kdht.NodeInfo{Id: id.Bytes(), Address: "self"}
+				table, err := NewKdmRoutingTableWith(self, k, RoutingOptions{SymbolBits: bits, Split: split})
+				if err != nil {
+					t.Fatalf("(routing table creation failed) %v", err)
+				}
+
+				present := []*kdht.NodeInfo{self}
+				for i := 0; i < 300; i++ {
+					// Half of the nodes share a prefix with
+					// the local node, to split the table deeply
+					other, _ := keys.RandomFrom(rng)
+					if i%2 == 1 {
+						other, _ = keys.PrefixRange(id, rng.Intn(24)).RandomFrom(rng)
+					}
+					node := &kdht.NodeInfo{Id: other.Bytes(), Address: fmt.Sprintf("node%v", i)}
+					table.InsertNode(node)
+					if _, ok := table.Lookup(other); ok {
+						present = append(present, node)
+					}
+					if i%20 == 19 {
+						victim := present[1+rng.Intn(len(present)-1)]
+						victimID, _ := victim.Key()
+						if err := table.RemoveNode(victimID); err != nil {
+							t.Fatalf("(removing a present node failed) %v", err)
+						}
+						present = slices.DeleteFunc(present, func(node *kdht.NodeInfo) bool { return node == victim })
+					}
+				}
+				checkKdmTable(t, table, present)
+			}
+		}
+	}
+
+	info := &kdht.NodeInfo{Id: keys.Random().Bytes(), Address: "self"}
+	for _, bits := range []int{-1, 3, 9} {
+		if _, err := NewKdmRoutingTableWith(info, 2, RoutingOptions{SymbolBits: bits}); err == nil {
+			t.Errorf("a table with %v bits per symbol was created", bits)
+		}
+	}
+	if _, err := NewKdmRoutingTableWith(info, 2, RoutingOptions{Split: SplitRelaxed + 1}); err == nil {
+		t.Errorf("a table with an unknown split policy was created")
+	}
+	info = &kdht.NodeInfo{Id: keys.SHA256.Random().Bytes(), Address: "self"}
+	if _, err := NewKdmRoutingTableWith(info, 2, RoutingOptions{SymbolBits: 8}); err != nil {
+		t.Errorf("(SHA256 table with 8 bits per symbol creation failed) %v", err)
+	}
+}
+
+// TestRouting_Split fills tables with a dense neighborhood of nodes
+// near the local node but off its path through the tree, and compares
+// how well each split policy finds the nodes closest to the local
+// node.
+func TestRouting_Split(t *testing.T) {
+	rng := rand.New(rand.NewSource(45))
+	for _, bits := range []int{1, 4} {
+		for _, k := range []int{2, 8, 20} {
+			id, _ := keys.RandomFrom(rng)
+			near, _ := keys.BucketRange(id, keys.Bits-8).RandomFrom(rng)
+			dense := keys.PrefixRange(near, 12)
+
+			var all []*kdht.NodeInfo
+			for i := 0; i < 400; i++ {
+				other, _ := dense.RandomFrom(rng)
+				if i%4 == 0 {
+					other, _ = keys.RandomFrom(rng)
+				}
+				all = append(all, &kdht.NodeInfo{Id: other.Bytes(), Address: fmt.Sprintf("node%v", i)})
+			}
+
+			// Targets near the local node have the same closest
+			// nodes as the local node itself
+			targets := []keys.Key{id}
+			for i := 0; i < 20; i++ {
+				target, _ := keys.PrefixRange(id, keys.Bits-16).RandomFrom(rng)
+				targets = append(targets, target)
+			}
+
+			accuracy := make(map[SplitPolicy]float64)
+			for _, split := range []SplitPolicy{SplitLocal, SplitRelaxed} {
+				self := &kdht.NodeInfo{Id: id.Bytes(), Address: "self"}
+				table, err := NewKdmRoutingTableWith(self, k, RoutingOptions{SymbolBits: bits, Split: split})
+				if err != nil {
+					t.Fatalf("(routing table creation failed) %v", err)
+				}
+				for _, node := range all {
+					table.InsertNode(node)
+				}
+
+				for i, target := range targets {
+					exp := closestOf(append([]*kdht.NodeInfo{self}, all...), target, k)
+					found := 0
+					for _, node := range table.ClosestK(target) {
+						if slices.Contains(exp, node) {
+							found++
+						}
+					}
+					if i == 0 && split == SplitRelaxed && found != len(exp) {
+						t.Fatalf("relaxed table with b = %v, k = %v found %v of the %v nodes closest to the local node",
+							bits, k, found, len(exp))
+					}
+					accuracy[split] += float64(found) / float64(len(exp)) / float64(len(targets))
+				}
+			}
+
+			t.Logf("b = %v, k = %v: ClosestK accuracy %.3f with SplitLocal, %.3f with SplitRelaxed",
+				bits, k, accuracy[SplitLocal], accuracy[SplitRelaxed])
+			if accuracy[SplitRelaxed] <= accuracy[SplitLocal] {
+				t.Errorf("relaxed splitting did not improve accuracy with b = %v, k = %v", bits, k)
+			}
+		}
+	}
+}
+
+// checkKdmTable checks that every bucket of table holds at most k
+// nodes, all within its range, that GetNodes numbers the buckets by
+// distance, and that ClosestK agrees with a brute-force search.
+func checkKdmTable(t *testing.T, table *KdmRoutingTable, present []*kdht.NodeInfo) {
+	t.Helper()
+	desc := fmt.Sprintf("table with b = %v, k = %v, split %v", table.SymbolBits(), table.K(), table.split)
+
+	final := table.buckets[len(table.buckets)-1]
+	if final.keys != keys.PrefixRange(table.id, final.depth) {
+		t.Fatalf("the final bucket of %v is %v at depth %v", desc, final.keys, final.depth)
+	}
+	if table.Buckets() != final.depth+1 {
+		t.Fatalf("%v of depth %v reports %v buckets", desc, final.depth, table.Buckets())
+	}
+	levels := final.depth / table.symbol
+	if exp := levels*(1<<table.symbol-1) + 1; table.split == SplitLocal && len(table.buckets) != exp {
+		t.Fatalf("%v with %v levels has %v buckets instead of %v", desc, levels, len(table.buckets), exp)
+	}
+
+	count := 0
+	for idx, b := range table.buckets {
+		if len(b.nodes) > table.K() {
+			t.Fatalf("bucket %v of %v holds %v nodes", idx, desc, len(b.nodes))
+		}
+		for other, o := range table.buckets {
+			if other != idx && (o.keys.Contains(b.keys.Lo) || b.keys.Contains(o.keys.Lo)) {
+				t.Fatalf("buckets %v and %v of %v overlap", idx, other, desc)
+			}
+		}
+		for _, node := range b.nodes {
+			if id, _ := node.Key(); !b.keys.Contains(id) {
+				t.Fatalf("node %v in bucket %v of %v is outside its range %v", id, idx, desc, b.keys)
+			}
+		}
+		count += len(b.nodes)
+	}
+	if count != len(present) {
+		t.Fatalf("%v holds %v nodes instead of %v", desc, count, len(present))
+	}
+	if ranges := table.BucketRanges(); len(ranges) != len(table.buckets)-1 {
+		t.Fatalf("%v reports %v bucket ranges", desc, len(ranges))
+	}
+
+	bits := table.id.Bits()
+	last := bits - table.Buckets()
+	count = 0
+	for num := 0; num < bits; num++ {
+		nodes := table.GetNodes(num)
+		if num < last && nodes != nil {
+			t.Fatalf("bucket %v of %v is below the last bucket %v", num, desc, last)
+		}
+		for _, node := range nodes {
+			id, _ := node.Key()
+			if db := table.id.Bucket(id); (num > last && db != num) || (num == last && db > num) {
+				t.Fatalf("node %v at distance bucket %v is in bucket %v of %v", id, db, num, desc)
+			}
+		}
+		count += len(nodes)
+	}
+	if count != len(present) {
+		t.Fatalf("the buckets of %v hold %v nodes instead of %v", desc, count, len(present))
+	}
+
+	for _, node := range present {
+		target, _ := node.Key()
+		if act := table.ClosestK(target); !slices.Equal(act, closestOf(present, target, table.K())) {
+			t.Fatalf("ClosestK(%v) of %v returned the wrong nodes", target, desc)
+		}
+	}
+}
+
+// closestOf returns the k nodes closest to target, nearest first.
+func closestOf(nodes []*kdht.NodeInfo, target keys.Key, k int) []*kdht.NodeInfo {
+	closest := slices.Clone(nodes)
+	slices.SortFunc(closest, func(node1, node2 *kdht.NodeInfo) int {
+		id1, _ := node1.Key()
+		id2, _ := node2.Key()
+		return target.Cmp(id1, id2)
+	})
+	if len(closest) > k {
+		closest = closest[:k]
+	}
+	return closest
+}
+
+func TestRouting_Snapshot(t *testing.T) {
+	info := func(byt byte) *kdht.NodeInfo {
+		return &kdht.NodeInfo{Id: byteToKey(byt).Bytes(), Address: fmt.Sprintf("node%02x", byt)}
+	}
+	self := info(0x00)
+	table, err := NewKdmRoutingTable(self, 2)
+	if err != nil {
+		t.Fatalf("(routing table creation failed) %v", err)
+	}
+
+	// 0xa0 finds bucket 1* full, and is cached
+	for _, byt := range []byte{0x80, 0xc0, 0xa0, 0x40, 0x20} {
+		table.InsertNode(info(byt))
+	}
+	table.RecordResponse(info(0x40), 5*time.Millisecond)
+
+	snap := table.Snapshot()
+	if snap.Contacts != 4 || snap.Capacity != 6 || snap.Fill != 4.0/6.0 {
+		t.Fatalf("snapshot has %v contacts, capacity %v, fill %v", snap.Contacts, snap.Capacity, snap.Fill)
+	}
+	exp := []struct {
+		index    int
+		prefix   string
+		contacts []string
+		cache    []string
+	}{
+		{159, "1", []string{"node80", "nodec0"}, []string{"nodea0"}},
+		{158, "01", []string{"node40"}, nil},
+		{157, "00", []string{"node00", "node20"}, nil},
+	}
+	if len(snap.Buckets) != len(exp) {
+		t.Fatalf("snapshot has %v buckets instead of %v", len(snap.Buckets), len(exp))
+	}
+	for i, e := range exp {
+		b := snap.Buckets[i]
+		if b.Index != e.index || b.Prefix != e.prefix || b.Local != (i == len(exp)-1) {
+			t.Fatalf("bucket %v is %v %q local %v", i, b.Index, b.Prefix, b.Local)
+		}
+		if !slices.Equal(addresses(b.Contacts), e.contacts) || !slices.Equal(addresses(b.Replacements), e.cache) {
+			t.Fatalf("bucket %q holds %v and caches %v", b.Prefix, addresses(b.Contacts), addresses(b.Replacements))
+		}
+		if r := keys.PrefixRange(byteToKey(0x00), len(e.prefix)); i == len(exp)-1 && (b.Lo != r.Lo.String() || b.Hi != r.Hi.String()) {
+			t.Fatalf("the local bucket's range is %v-%v instead of %v", b.Lo, b.Hi, r)
+		}
+	}
+	if c := snap.Buckets[1].Contacts[0]; c.RTT != 5*time.Millisecond || c.LastSeen.IsZero() {
+		t.Fatalf("node40 has RTT %v, last seen %v", c.RTT, c.LastSeen)
+	}
+
+	// A node is replaced from the cache once it becomes stale, but
+	// only if there is a replacement
+	for i := 0; i < staleFailures; i++ {
+		if _, ok := table.Lookup(byteToKey(0x80)); !ok {
+			t.Fatalf("node80 was replaced after %v failures", i)
+		}
+		table.RecordFailure("node80")
+		table.RecordFailure("node40")
+	}
+	if _, ok := table.Lookup(byteToKey(0x80)); ok {
+		t.Fatalf("node80 was not replaced after %v failures", staleFailures)
+	}
+	if _, ok := table.Lookup(byteToKey(0xa0)); !ok {
+		t.Fatalf("node80 was not replaced by nodea0")
+	}
+	snap = table.Snapshot()
+	if c := snap.Buckets[1].Contacts[0]; c.Failures != staleFailures {
+		t.Fatalf("node40 has %v failures instead of %v", c.Failures, staleFailures)
+	}
+	if len(snap.Buckets[0].Replacements) != 0 {
+		t.Fatalf("bucket 1* still caches %v", addresses(snap.Buckets[0].Replacements))
+	}
+	table.InsertNode(info(0x40))
+	if c := table.Snapshot().Buckets[1].Contacts[0]; c.Failures != 0 {
+		t.Fatalf("node40 has %v failures after it was heard from", c.Failures)
+	}
+
+	var buf bytes.Buffer
+	if err := snap.WriteJSON(&buf); err != nil {
+		t.Fatalf("(WriteJSON failed) %v", err)
+	}
+	decoded := &RoutingSnapshot{}
+	if err := json.Unmarshal(buf.Bytes(), decoded); err != nil {
+		t.Fatalf("(decoding the snapshot failed) %v", err)
+	}
+	if decoded.ID != snap.ID || len(decoded.Buckets) != len(snap.Buckets) ||
+		decoded.Buckets[1].Contacts[0].RTT != 5*time.Millisecond {
+		t.Fatalf("the snapshot did not survive JSON: %+v", decoded)
+	}
+
+	buf.Reset()
+	if err := snap.WriteDOT(&buf); err != nil {
+		t.Fatalf("(WriteDOT failed) %v", err)
+	}
+	dot := buf.String()
+	for _, s := range []string{"digraph routing {", `"p" -> "b1"`, `"p" -> "p0"`, `"p0" -> "b01"`, `"p0" -> "b00"`, "style=bold"} {
+		if !strings.Contains(dot, s) {
+			t.Fatalf("the DOT rendering does not contain %q:\n%v", s, dot)
+		}
+	}
+	if edges := strings.Count(dot, "->"); edges != 4 {
+		t.Fatalf("the DOT rendering has %v edges instead of 4:\n%v", edges, dot)
+	}
+}
+
+func TestRouting_SplitCache(t *testing.T) {
+	info := func(byt byte) *kdht.NodeInfo {
+		return &kdht.NodeInfo{Id: byteToKey(byt).Bytes(), Address: fmt.Sprintf("node%02x", byt)}
+	}
+	table, err := NewKdmRoutingTableWith(info(0x00), 2, RoutingOptions{Split: SplitRelaxed})
+	if err != nil {
+		t.Fatalf("(routing table creation failed) %v", err)
+	}
+
+	// 0xa0 finds bucket 1* full while 0x40 and 0x20 are closer to
+	// the local node, so it is cached rather than split for
+	for _, byt := range []byte{0x80, 0xc0, 0x40, 0x20, 0xa0} {
+		table.InsertNode(info(byt))
+	}
+	if _, ok := table.Lookup(byteToKey(0xa0)); ok {
+		t.Fatalf("nodea0 was inserted into a full bucket")
+	}
+
+	// Once they are gone, 0x90 splits 1*, and 0xa0 moves into 10*,
+	// which has room for it
+	table.RemoveNode(byteToKey(0x40))
+	table.RemoveNode(byteToKey(0x20))
+	table.InsertNode(info(0x90))
+	for _, byt := range []byte{0x80, 0x90, 0xa0, 0xc0} {
+		if _, ok := table.Lookup(byteToKey(byt)); !ok {
+			t.Fatalf("node%02x is not in the table after 1* split", byt)
+		}
+	}
+	for _, b := range table.Snapshot().Buckets {
+		if len(b.Replacements) != 0 {
+			t.Fatalf("bucket %q still caches %v", b.Prefix, addresses(b.Replacements))
+		}
+	}
+}
+
+// addresses returns the addresses of contacts.
+func addresses(contacts []ContactSnapshot) []string {
+	var addrs []string
+	for _, c := range contacts {
+		addrs = append(addrs, c.Address)
+	}
+	return addrs
+}
+
+func TestRouting_Events(t *testing.T) {
+	tables := map[string]func(*kdht.NodeInfo) (kdht.RoutingTable, error){
+		"kdm": func(info *kdht.NodeInfo) (kdht.RoutingTable, error) {
+			return NewKdmRoutingTable(info, 2)
+		},
+		"router": func(info *kdht.NodeInfo) (kdht.RoutingTable, error) {
+			table, err := router.New(info, 2)
+			if err != nil {
+				return nil, err
+			}
+			return WatchRoutingTable(info, table), nil
+		},
+	}
+	for name, newTable := range tables {
+		newTable := newTable
+		t.Run(name, func(t *testing.T) {
+			testEvents(t, newTable)
+		})
+	}
+}
+
+func testEvents(t *testing.T, newTable func(*kdht.NodeInfo) (kdht.RoutingTable, error)) {
+	info := func(byt byte, addr string) *kdht.NodeInfo {
+		return &kdht.NodeInfo{Id: byteToKey(byt).Bytes(), Address: addr}
+	}
+	self := info(0x00, "self")
+	table, err := newTable(self)
+	if err != nil {
+		t.Fatalf("(routing table creation failed) %v", err)
+	}
+	source, ok := table.(EventSource)
+	if !ok {
+		t.Fatalf("%T is not an EventSource", table)
+	}
+
+	// Subscribers may use the table while it is changing
+	events := make(chan Event, 64)
+	cancel := source.Subscribe(func(ev Event) {
+		table.Buckets()
+		events <- ev
+	})
+	defer cancel()
+
+	type expEvent struct {
+		typ      EventType
+		addr     string
+		previous string
+		bucket   int
+	}
+	expect := func(exp ...expEvent) {
+		t.Helper()
+		for _, e := range exp {
+			var ev Event
+			select {
+			case ev = <-events:
+			case <-time.After(5 * time.Second):
+				t.Fatalf("no %v event for %q", e.typ, e.addr)
+			}
+			var addr, previous string
+			if ev.Node != nil {
+				addr = ev.Node.Address
+			}
+			if ev.Previous != nil {
+				previous = ev.Previous.Address
+			}
+			if ev.Type != e.typ || addr != e.addr || previous != e.previous || ev.Bucket != e.bucket {
+				t.Fatalf("event %v %q (was %q) in bucket %v, expected %v %q (was %q) in bucket %v",
+					ev.Type, addr, previous, ev.Bucket, e.typ, e.addr, e.previous, e.bucket)
+			}
+		}
+	}
+
+	table.InsertNode(info(0x80, "node80"))
+	table.InsertNode(info(0xc0, "nodec0"))
+	table.InsertNode(info(0x40, "node40"))
+	table.InsertNode(info(0x20, "node20"))
+	expect(
+		expEvent{ContactAdded, "node80", "", 159},
+		expEvent{BucketSplit, "", "", 159},
+		expEvent{ContactAdded, "nodec0", "", 159},
+		expEvent{ContactAdded, "node40", "", 158},
+		expEvent{BucketSplit, "", "", 158},
+		expEvent{ContactAdded, "node20", "", 157},
+	)
+
+	// Hearing from a known node again is only an update if its
+	// address changed, and a node that does not fit is not added
+	table.InsertNode(info(0x40, "node40"))
+	table.InsertNode(info(0x40, "moved40"))
+	table.InsertNode(info(0xa0, "nodea0"))
+	if err := table.RemoveNode(byteToKey(0xc0)); err != nil {
+		t.Fatalf("(removing nodec0 failed) %v", err)
+	}
+	if err := table.RemoveNode(byteToKey(0xc0)); err == nil {
+		t.Fatalf("nodec0 was removed twice")
+	}
+	table.InsertNode(info(0x60, "node60"))
+
+	// kdht-router keeps the address a node was first seen at
+	if node, _ := table.Lookup(byteToKey(0x40)); node.Address == "moved40" {
+		expect(expEvent{ContactUpdated, "moved40", "node40", 158})
+	}
+	expect(
+		expEvent{ContactRemoved, "nodec0", "", 159},
+		expEvent{ContactAdded, "node60", "", 158},
+	)
+
+	if kdm, ok := table.(*KdmRoutingTable); ok {
+		for i := 0; i < staleFailures; i++ {
+			kdm.RecordFailure("node80")
+		}
+		expect(
+			expEvent{ContactRemoved, "node80", "", 159},
+			expEvent{ContactAdded, "nodea0", "", 159},
+		)
+	}
+
+	// Nothing is delivered once the subscription is cancelled
+	cancel()
+	table.RemoveNode(byteToKey(0x20))
+	select {
+	case ev := <-events:
+		t.Fatalf("%v event delivered after cancel", ev.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRouting_EventQueue(t *testing.T) {
+	hub := newEventHub()
+	taken := make(chan Event, 2*maxQueuedEvents)
+	block := make(chan struct{})
+	cancel := hub.Subscribe(func(ev Event) {
+		taken <- ev
+		<-block
+	})
+	defer cancel()
+
+	// While the subscriber is stuck on the first event, all but the
+	// last maxQueuedEvents of the rest are dropped
+	hub.emit(Event{Bucket: 0})
+	<-taken
+	for i := 1; i <= maxQueuedEvents+5; i++ {
+		hub.emit(Event{Bucket: i})
+	}
+	close(block)
+	for i := 6; i <= maxQueuedEvents+5; i++ {
+		var ev Event
+		select {
+		case ev = <-taken:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("event %v was not delivered", i)
+		}
+		dropped := 0
+		if i == 6 {
+			dropped = 5
+		}
+		if ev.Bucket != i || ev.Dropped != dropped {
+			t.Fatalf("event %v, after %v dropped, delivered instead of %v after %v", ev.Bucket, ev.Dropped, i, dropped)
+		}
+	}
+}
+
 /*
 import (
 	"fmt"
@@ -0,0 +1,490 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package sim
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"google.golang.org/protobuf/proto"
+)
+
+// headerLength is the length of the frame header that precedes every
+// message, as sent by impl.KdmNode.
+const headerLength = 2
+
+// queueLength bounds the number of frames in flight in one direction
+// of a connection.
+const queueLength = 1024
+
+// Latency is a distribution of one-way network delays.
+type Latency interface {
+	// Sample returns a delay drawn from the distribution.
+	Sample(rng *rand.Rand) time.Duration
+}
+
+// Constant is a Latency that is always the same.
+type Constant time.Duration
+
+func (c Constant) Sample(rng *rand.Rand) time.Duration {
+	return time.Duration(c)
+}
+
+// Uniform is a Latency distributed uniformly between Min and Max.
+type Uniform struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+func (u Uniform) Sample(rng *rand.Rand) time.Duration {
+	if u.Max <= u.Min {
+		return u.Min
+	}
+	return u.Min + time.Duration(rng.Int63n(int64(u.Max-u.Min)))
+}
+
+// Exponential is a Latency of at least Min, plus an exponentially
+// distributed delay with the given mean.  It models a network that is
+// usually fast but has a long tail.
+type Exponential struct {
+	Min  time.Duration
+	Mean time.Duration
+}
+
+func (e Exponential) Sample(rng *rand.Rand) time.Duration {
+	return e.Min + time.Duration(rng.ExpFloat64()*float64(e.Mean))
+}
+
+// NetworkConfig describes the behavior of a simulated network.
+type NetworkConfig struct {
+	// Latency is the one-way delay of every message and of each
+	// step of connection setup.  The default is no delay.
+	Latency Latency
+	// Loss is the probability that a message is lost.  A lost
+	// message resets its connection after LossTimeout, as a TCP
+	// connection eventually does when its peer stops answering.
+	Loss float64
+	// LossTimeout is how long a connection that lost a message
+	// takes to fail.  The default is one second.
+	LossTimeout time.Duration
+	// Seed seeds the network's random number generator.
+	Seed int64
+}
+
+// Network is an in-memory impl.Transport that delivers messages with
+// simulated latency and loss.  All delays are measured with the time
+// package, so that within a testing/synctest bubble the network runs
+// on virtual time.
+//
+// The network understands the message framing used by impl.KdmNode,
+// and applies delays and loss to whole messages.  It must not be used
+// for any other protocol.
+type Network struct {
+	cfg       NetworkConfig
+	mutex     *sync.Mutex
+	rng       *rand.Rand
+	listeners map[string]*listener
+	nextPort  int
+
+	// observe, if not nil, is called with every message sent and
+	// the address of the node it is sent to.
+	observe func(to string, message *kdht.Message)
+}
+
+// NewNetwork returns an empty network.
+func NewNetwork(cfg NetworkConfig) *Network {
+	if cfg.Latency == nil {
+		cfg.Latency = Constant(0)
+	}
+	if cfg.LossTimeout == 0 {
+		cfg.LossTimeout = time.Second
+	}
+	return &Network{
+		cfg:       cfg,
+		mutex:     &sync.Mutex{},
+		rng:       rand.New(rand.NewSource(cfg.Seed)),
+		listeners: make(map[string]*listener),
+		nextPort:  1024,
+	}
+}
+
+// latency samples the latency distribution.
+func (network *Network) latency() time.Duration {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.cfg.Latency.Sample(network.rng)
+}
+
+// lost decides whether a message is lost.
+func (network *Network) lost() bool {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	return network.cfg.Loss > 0 && network.rng.Float64() < network.cfg.Loss
+}
+
+// Listen satisfies impl.Transport.Listen.  A port of 0 is replaced by
+// an unused port.
+func (network *Network) Listen(addr string) (net.Listener, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+	if port == "0" {
+		for {
+			network.nextPort++
+			addr = net.JoinHostPort(host, strconv.Itoa(network.nextPort))
+			if network.listeners[addr] == nil {
+				break
+			}
+		}
+	}
+	if network.listeners[addr] != nil {
+		return nil, &net.OpError{Op: "listen", Net: "sim", Addr: simAddr(addr), Err: syscall.EADDRINUSE}
+	}
+
+	ln := &listener{
+		network: network,
+		addr:    simAddr(addr),
+		conns:   make(chan net.Conn, queueLength),
+		done:    make(chan struct{}),
+	}
+	network.listeners[addr] = ln
+	return ln, nil
+}
+
+// DialContext satisfies impl.Transport.DialContext.  Connecting takes
+// one round trip, after which the connection is either accepted or
+// refused.
+func (network *Network) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	if err := sleep(ctx, network.latency()); err != nil {
+		return nil, err
+	}
+
+	// The listener is only closed with the mutex held, so a
+	// connection queued here is always either accepted or closed.
+	client, server := network.pipe(addr)
+	accepted := false
+	network.mutex.Lock()
+	if ln := network.listeners[addr]; ln != nil {
+		select {
+		case ln.conns <- server:
+			accepted = true
+		default:
+		}
+	}
+	network.mutex.Unlock()
+
+	if err := sleep(ctx, network.latency()); err != nil {
+		client.Close()
+		return nil, err
+	}
+	if !accepted {
+		client.Close()
+		server.Close()
+		return nil, &net.OpError{Op: "dial", Net: "sim", Addr: simAddr(addr), Err: syscall.ECONNREFUSED}
+	}
+	return client, nil
+}
+
+// sleep waits for d, or until ctx is cancelled.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// simAddr is the net.Addr of a simulated endpoint.
+type simAddr string
+
+func (addr simAddr) Network() string { return "sim" }
+func (addr simAddr) String() string  { return string(addr) }
+
+type listener struct {
+	network *Network
+	addr    simAddr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    sync.Once
+}
+
+func (ln *listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-ln.conns:
+		return conn, nil
+	case <-ln.done:
+		return nil, &net.OpError{Op: "accept", Net: "sim", Addr: ln.addr, Err: net.ErrClosed}
+	}
+}
+
+func (ln *listener) Close() error {
+	ln.once.Do(func() {
+		ln.network.mutex.Lock()
+		delete(ln.network.listeners, string(ln.addr))
+		close(ln.done)
+		ln.network.mutex.Unlock()
+
+		// Refuse connections that were never accepted
+		for {
+			select {
+			case conn := <-ln.conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+func (ln *listener) Addr() net.Addr {
+	return ln.addr
+}
+
+// packet is a message in flight, to be delivered at a particular time.
+type packet struct {
+	at   time.Time
+	data []byte
+}
+
+// half is one direction of a connection.  The writer queues packets,
+// and a delivery goroutine hands each one to the reader at its
+// delivery time.
+type half struct {
+	queue chan packet
+	ready chan []byte
+	last  time.Time
+}
+
+// link is the state shared by both ends of a connection.
+type link struct {
+	// server is the address that was dialed, and client is the
+	// address of the node that dialed it, as learned from the
+	// first message it sends.
+	server string
+	client string
+	mutex  *sync.Mutex
+
+	// broken is closed when the connection is reset after losing
+	// a message.
+	broken chan struct{}
+	once   sync.Once
+}
+
+func (l *link) reset() {
+	l.once.Do(func() { close(l.broken) })
+}
+
+// conn is one end of a simulated connection.
+type conn struct {
+	network *Network
+	link    *link
+	local   simAddr
+	remote  simAddr
+	dialer  bool
+	in      *half
+	out     *half
+	pending []byte
+	wbuf    []byte
+	wmutex  *sync.Mutex
+	closed  chan struct{}
+	once    sync.Once
+
+	// deadline is the read deadline, guarded by dmutex.
+	deadline time.Time
+	dmutex   sync.Mutex
+}
+
+// pipe returns both ends of a new connection to addr.
+func (network *Network) pipe(addr string) (*conn, *conn) {
+	l := &link{server: addr, mutex: &sync.Mutex{}, broken: make(chan struct{})}
+	up := &half{queue: make(chan packet, queueLength), ready: make(chan []byte, queueLength)}
+	down := &half{queue: make(chan packet, queueLength), ready: make(chan []byte, queueLength)}
+
+	client := &conn{network: network, link: l, local: "client", remote: simAddr(addr), dialer: true,
+		in: down, out: up, wmutex: &sync.Mutex{}, closed: make(chan struct{})}
+	server := &conn{network: network, link: l, local: simAddr(addr), remote: "client",
+		in: up, out: down, wmutex: &sync.Mutex{}, closed: make(chan struct{})}
+
+	go up.deliver(server.closed)
+	go down.deliver(client.closed)
+	return client, server
+}
+
+// deliver hands each queued packet to the reader at its delivery
+// time, until the writer closes the queue.  Packets are dropped once
+// the reader is closed.
+func (h *half) deliver(readerClosed chan struct{}) {
+	defer close(h.ready)
+	for p := range h.queue {
+		time.Sleep(time.Until(p.at))
+		select {
+		case h.ready <- p.data:
+		case <-readerClosed:
+		}
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(c.pending) == 0 {
+		var timeout <-chan time.Time
+		c.dmutex.Lock()
+		deadline := c.deadline
+		c.dmutex.Unlock()
+		if !deadline.IsZero() {
+			if !time.Now().Before(deadline) {
+				return 0, c.opError("read", os.ErrDeadlineExceeded)
+			}
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case data, ok := <-c.in.ready:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.pending = data
+		case <-c.closed:
+			return 0, c.opError("read", net.ErrClosed)
+		case <-c.link.broken:
+			return 0, c.opError("read", syscall.ECONNRESET)
+		case <-timeout:
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+	}
+
+	n := copy(b, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Write buffers b until it holds complete messages, and then sends
+// each message with its own latency, or loses it.
+func (c *conn) Write(b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	select {
+	case <-c.closed:
+		return 0, c.opError("write", net.ErrClosed)
+	case <-c.link.broken:
+		return 0, c.opError("write", syscall.ECONNRESET)
+	default:
+	}
+
+	c.wbuf = append(c.wbuf, b...)
+	for len(c.wbuf) >= headerLength {
+		length := headerLength + int(binary.BigEndian.Uint16(c.wbuf))
+		if len(c.wbuf) < length {
+			break
+		}
+		frame := c.wbuf[:length:length]
+		c.wbuf = c.wbuf[length:]
+		c.observe(frame[headerLength:])
+
+		if c.network.lost() {
+			go func() {
+				time.Sleep(c.network.cfg.LossTimeout)
+				c.link.reset()
+			}()
+			continue
+		}
+
+		at := time.Now().Add(c.network.latency())
+		if at.Before(c.out.last) {
+			// Messages on one connection arrive in order
+			at = c.out.last
+		}
+		c.out.last = at
+
+		select {
+		case c.out.queue <- packet{at: at, data: frame}:
+		case <-c.closed:
+			return 0, c.opError("write", net.ErrClosed)
+		}
+	}
+	return len(b), nil
+}
+
+// observe passes a message being sent to the network's observer,
+// along with the address of the node receiving it.
+func (c *conn) observe(data []byte) {
+	if c.network.observe == nil {
+		return
+	}
+	message := &kdht.Message{}
+	if proto.Unmarshal(data, message) != nil {
+		return
+	}
+
+	c.link.mutex.Lock()
+	if c.dialer && c.link.client == "" {
+		c.link.client = message.Sender.GetAddress()
+	}
+	to := c.link.server
+	if !c.dialer {
+		to = c.link.client
+	}
+	c.link.mutex.Unlock()
+
+	c.network.observe(to, message)
+}
+
+func (c *conn) Close() error {
+	c.once.Do(func() {
+		close(c.closed)
+		c.wmutex.Lock()
+		close(c.out.queue)
+		c.wmutex.Unlock()
+	})
+	return nil
+}
+
+func (c *conn) opError(op string, err error) error {
+	return &net.OpError{Op: op, Net: "sim", Source: c.local, Addr: c.remote, Err: err}
+}
+
+func (c *conn) LocalAddr() net.Addr  { return c.local }
+func (c *conn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline sets the deadline for future Read calls; a Read that
+// is already blocked keeps the deadline it started with.
+func (c *conn) SetReadDeadline(t time.Time) error {
+	c.dmutex.Lock()
+	c.deadline = t
+	c.dmutex.Unlock()
+	return nil
+}
+
+// Write deadlines are not supported, as writes never block for long.
+func (c *conn) SetWriteDeadline(t time.Time) error { return nil }
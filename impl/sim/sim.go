@@ -0,0 +1,497 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+// The sim package runs many impl.KdmNode instances over a simulated
+// network on a virtual clock, and measures how well the DHT performs
+// as nodes come and go.
+//
+// A simulation is meant to run inside a testing/synctest bubble, so
+// that simulated time only advances when every node is waiting on the
+// network.  A simulation covering minutes of activity among thousands
+// of nodes then runs far faster than real time, without binding any
+// real ports.  The package itself does not depend on the testing
+// package; the caller provides the bubble.
+package sim
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"slices"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+	"cse586.kdht/impl"
+)
+
+// Churn describes nodes leaving and joining the network.  Every
+// Interval, Leave randomly chosen nodes fail without warning and Join
+// new nodes join through a randomly chosen live node.
+type Churn struct {
+	Interval time.Duration
+	Leave    int
+	Join     int
+}
+
+// Config describes a simulation.
+type Config struct {
+	NetworkConfig
+
+	// Nodes is the number of nodes in the network at the start.
+	Nodes int
+	// K and Alpha are passed to every node.
+	K     int
+	Alpha int
+	// SymbolBits is the number of bits resolved by each level of
+	// every node's routing table, as for impl.RoutingOptions.
+	SymbolBits int
+	// Refresh makes every node refresh its routing table once it
+	// has joined, as with impl.KdmNode.Refresh.
+	Refresh bool
+	// Churn describes nodes leaving and joining.  With a zero
+	// Interval there is no churn.
+	Churn Churn
+	// Values is the number of values stored once the network has
+	// been built, whose availability is then measured.
+	Values int
+	// Duration is how much simulated time to run for once the
+	// network has been built.
+	Duration time.Duration
+	// Interval is how often the network is sampled.
+	Interval time.Duration
+	// Lookups is the number of node lookups performed at each
+	// sample, each from a random live node for a random key.
+	Lookups int
+}
+
+// Sample holds the measurements taken at one point in simulated time.
+type Sample struct {
+	// Time is the simulated time since the network was built.
+	Time time.Duration
+	// Live is the number of nodes in the network.
+	Live int
+	// Lookups is the number of node lookups performed, and
+	// Succeeded is the number that found the live node closest to
+	// their key.
+	Lookups   int
+	Succeeded int
+	// Hops holds the hop count of each lookup: the length of the
+	// longest chain of referrals that the lookup followed.
+	Hops []int
+	// Values is the number of values stored, and Available is the
+	// number that FindValue could retrieve from a random live node.
+	Values    int
+	Available int
+}
+
+// SuccessRate returns the fraction of lookups that succeeded.
+func (s *Sample) SuccessRate() float64 {
+	return ratio(s.Succeeded, s.Lookups)
+}
+
+// MeanHops returns the mean hop count of the sample's lookups.
+func (s *Sample) MeanHops() float64 {
+	return mean(s.Hops)
+}
+
+// Availability returns the fraction of values that were retrieved.
+func (s *Sample) Availability() float64 {
+	return ratio(s.Available, s.Values)
+}
+
+// Report is the result of a simulation.
+type Report struct {
+	Samples []Sample
+}
+
+// SuccessRate returns the fraction of all lookups that succeeded.
+func (r *Report) SuccessRate() float64 {
+	lookups, succeeded := 0, 0
+	for _, s := range r.Samples {
+		lookups += s.Lookups
+		succeeded += s.Succeeded
+	}
+	return ratio(succeeded, lookups)
+}
+
+// MeanHops returns the mean hop count of all lookups.
+func (r *Report) MeanHops() float64 {
+	hops := []int{}
+	for _, s := range r.Samples {
+		hops = append(hops, s.Hops...)
+	}
+	return mean(hops)
+}
+
+// Availability returns the fraction of value retrievals that
+// succeeded across all samples.
+func (r *Report) Availability() float64 {
+	values, available := 0, 0
+	for _, s := range r.Samples {
+		values += s.Values
+		available += s.Available
+	}
+	return ratio(available, values)
+}
+
+// String formats the report as a table with one row per sample.
+func (r *Report) String() string {
+	b := &strings.Builder{}
+	w := tabwriter.NewWriter(b, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "TIME\tLIVE\tLOOKUPS\tSUCCESS\tHOPS\tVALUES\tAVAILABLE\t")
+	for _, s := range r.Samples {
+		fmt.Fprintf(w, "%v\t%v\t%v\t%.3f\t%.2f\t%v\t%.3f\t\n", s.Time, s.Live, s.Lookups,
+			s.SuccessRate(), s.MeanHops(), s.Values, s.Availability())
+	}
+	w.Flush()
+	return b.String()
+}
+
+// simNode is a node in the simulation.
+type simNode struct {
+	node *impl.KdmNode
+	addr string
+	id   keys.Key
+}
+
+// lookupKey identifies a lookup by the node performing it and the key
+// it looks up.
+type lookupKey struct {
+	origin string
+	key    keys.Key
+}
+
+// trace records the hop count of each node contacted by a lookup.
+type trace struct {
+	hops map[string]int
+	max  int
+}
+
+// Sim is a running simulation.
+type Sim struct {
+	cfg     Config
+	network *Network
+	rng     *rand.Rand
+	live    []*simNode
+	dead    []*simNode
+	values  [][]byte
+	next    int
+
+	mutex  *sync.Mutex
+	traces map[lookupKey]*trace
+}
+
+// Run runs a simulation and returns its report, or an error if the
+// network cannot be built.  The simulation is run by passing it to
+// bubble, which must call it and return once it and every goroutine
+// it starts have finished.  A test would run it in a synctest bubble:
+//
+//	report, err := sim.Run(cfg, func(f func()) {
+//		synctest.Test(t, func(*testing.T) { f() })
+//	})
+//
+// With a bubble that simply calls it, the simulation runs in real
+// time.
+func Run(cfg Config, bubble func(func())) (*Report, error) {
+	report := &Report{}
+	var err error
+	bubble(func() {
+		s := newSim(cfg)
+		defer s.shutdown()
+
+		if err = s.build(); err != nil {
+			err = fmt.Errorf("building the network: %w", err)
+			return
+		}
+		s.storeValues()
+		report.Samples = s.run()
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func newSim(cfg Config) *Sim {
+	if cfg.Interval == 0 {
+		cfg.Interval = cfg.Duration
+	}
+
+	s := &Sim{
+		cfg:     cfg,
+		network: NewNetwork(cfg.NetworkConfig),
+		rng:     rand.New(rand.NewSource(cfg.Seed)),
+		mutex:   &sync.Mutex{},
+		traces:  make(map[lookupKey]*trace),
+	}
+	s.network.observe = s.observe
+	return s
+}
+
+// build starts the initial nodes one at a time, each joining through
+// a random node started before it.
+func (s *Sim) build() error {
+	for i := 0; i < s.cfg.Nodes; i++ {
+		if err := s.join(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// joinAttempts is the number of nodes that a joining node tries to
+// join through before giving up.
+const joinAttempts = 3
+
+// join starts a new node and has it join the network through a random
+// live node.
+func (s *Sim) join() error {
+	id, _ := keys.RandomFrom(s.rng)
+	addr := fmt.Sprintf("node%v:4586", s.next)
+	s.next++
+
+	opts := impl.NodeOptions{
+		Transport: s.network,
+		RoutingTable: func(info *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+			return impl.NewKdmRoutingTableWith(info, k, impl.RoutingOptions{SymbolBits: s.cfg.SymbolBits})
+		},
+	}
+	node, err := impl.NewNodeWith(id, addr, s.cfg.K, s.cfg.Alpha, nil, opts)
+	if err != nil {
+		return err
+	}
+
+	if len(s.live) > 0 {
+		// A lost message can fail the ping, so try a few nodes
+		for attempt := 1; ; attempt++ {
+			bootstrap := s.randomNode()
+			err = node.PingAddress(bootstrap.addr, nil)
+			if err == nil {
+				break
+			}
+			if attempt == joinAttempts {
+				node.Shutdown()
+				return fmt.Errorf("%v could not join through %v: %w", addr, bootstrap.addr, err)
+			}
+		}
+		node.FindNode(id)
+		if s.cfg.Refresh {
+			node.Refresh()
+		}
+	}
+	s.live = append(s.live, &simNode{node: node, addr: addr, id: id})
+	return nil
+}
+
+// leave makes a random live node fail.  Its connections are closed
+// immediately, and it neither finishes its requests nor hands off its
+// values.
+func (s *Sim) leave() {
+	if len(s.live) <= 1 {
+		return
+	}
+	i := s.rng.Intn(len(s.live))
+	sn := s.live[i]
+	s.live = slices.Delete(s.live, i, i+1)
+	s.dead = append(s.dead, sn)
+	sn.node.ShutdownWith(impl.ShutdownOptions{})
+}
+
+// storeValues stores each value from a random live node.
+func (s *Sim) storeValues() {
+	for i := 0; i < s.cfg.Values; i++ {
+		val := []byte(fmt.Sprintf("value %v", i))
+		s.values = append(s.values, val)
+		s.randomNode().node.Store(val)
+	}
+}
+
+func (s *Sim) randomNode() *simNode {
+	return s.live[s.rng.Intn(len(s.live))]
+}
+
+// run advances simulated time, applying churn and taking a sample at
+// every interval.  Churn and sampling never overlap: if a sample takes
+// longer than the time until the next churn, the churn waits for it.
+func (s *Sim) run() []Sample {
+	samples := []Sample{}
+	start := time.Now()
+	nextSample := time.Duration(0)
+	nextChurn := s.cfg.Churn.Interval
+	churn := s.cfg.Churn.Interval > 0
+
+	for nextSample <= s.cfg.Duration {
+		if churn && nextChurn < nextSample {
+			time.Sleep(time.Until(start.Add(nextChurn)))
+			for i := 0; i < s.cfg.Churn.Leave; i++ {
+				s.leave()
+			}
+			for i := 0; i < s.cfg.Churn.Join; i++ {
+				s.join()
+			}
+			nextChurn += s.cfg.Churn.Interval
+			continue
+		}
+
+		time.Sleep(time.Until(start.Add(nextSample)))
+		sample := s.sample()
+		sample.Time = nextSample
+		samples = append(samples, sample)
+		nextSample += s.cfg.Interval
+	}
+	return samples
+}
+
+// sample performs the configured lookups and retrieves every value,
+// all concurrently, and records the results.
+func (s *Sim) sample() Sample {
+	sample := Sample{Live: len(s.live), Lookups: s.cfg.Lookups, Values: len(s.values)}
+	mut := &sync.Mutex{}
+	wg := &sync.WaitGroup{}
+
+	for i := 0; i < s.cfg.Lookups; i++ {
+		origin := s.randomNode()
+		key, _ := keys.RandomFrom(s.rng)
+		closest := s.closestLive(key)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tr := s.beginTrace(origin, key)
+			nodes, err := origin.node.FindNode(key)
+			hops := s.endTrace(origin, key, tr)
+
+			mut.Lock()
+			defer mut.Unlock()
+			sample.Hops = append(sample.Hops, hops)
+			if err == nil && slices.ContainsFunc(nodes, func(info *kdht.NodeInfo) bool {
+				return bytes.Equal(info.Id, closest.Bytes())
+			}) {
+				sample.Succeeded++
+			}
+		}()
+	}
+
+	for _, val := range s.values {
+		val := val
+		origin := s.randomNode()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := origin.node.FindValue(keys.Compute(val)); err == nil {
+				mut.Lock()
+				sample.Available++
+				mut.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return sample
+}
+
+// closestLive returns the ID of the live node closest to key.
+func (s *Sim) closestLive(key keys.Key) keys.Key {
+	var best keys.Key
+	for i, sn := range s.live {
+		if i == 0 || key.Cmp(sn.id, best) < 0 {
+			best = sn.id
+		}
+	}
+	return best
+}
+
+// beginTrace starts tracing a lookup.  The nodes that the lookup
+// starts from are one hop away.
+func (s *Sim) beginTrace(origin *simNode, key keys.Key) *trace {
+	tr := &trace{hops: make(map[string]int)}
+	for _, info := range origin.node.RoutingTable().ClosestK(key) {
+		tr.hops[info.Address] = 1
+	}
+	s.mutex.Lock()
+	s.traces[lookupKey{origin.addr, key}] = tr
+	s.mutex.Unlock()
+	return tr
+}
+
+// endTrace stops tracing a lookup and returns its hop count.
+func (s *Sim) endTrace(origin *simNode, key keys.Key, tr *trace) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.traces, lookupKey{origin.addr, key})
+	return tr.max
+}
+
+// observe follows the lookups being traced.  A node contacted from
+// the origin's own routing table is one hop away, and a node learned
+// of from a node h hops away is h + 1 hops away.
+func (s *Sim) observe(to string, message *kdht.Message) {
+	key, _ := keys.FromBytes(message.Key)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch message.Type {
+	case kdht.MessageType_FIND_NODE, kdht.MessageType_FIND_VALUE:
+		tr := s.traces[lookupKey{message.Sender.GetAddress(), key}]
+		if tr == nil {
+			return
+		}
+		if tr.hops[to] == 0 {
+			tr.hops[to] = 1
+		}
+		if tr.hops[to] > tr.max {
+			tr.max = tr.hops[to]
+		}
+
+	case kdht.MessageType_NODES:
+		tr := s.traces[lookupKey{to, key}]
+		if tr == nil {
+			return
+		}
+		hops := tr.hops[message.Sender.GetAddress()]
+		for _, info := range message.Nodes {
+			if _, ok := tr.hops[info.Address]; !ok {
+				tr.hops[info.Address] = hops + 1
+			}
+		}
+	}
+}
+
+// shutdown stops every node, so that the bubble can exit.
+func (s *Sim) shutdown() {
+	for _, sn := range s.live {
+		sn.node.ShutdownWith(impl.ShutdownOptions{})
+	}
+}
+
+// mean returns the mean of values, or NaN if there are none.
+func mean(values []int) float64 {
+	if len(values) == 0 {
+		return math.NaN()
+	}
+	sum := 0
+	for _, v := range values {
+		sum += v
+	}
+	return float64(sum) / float64(len(values))
+}
+
+// ratio returns n / d, or NaN if d is 0.
+func ratio(n int, d int) float64 {
+	if d == 0 {
+		return math.NaN()
+	}
+	return float64(n) / float64(d)
+}
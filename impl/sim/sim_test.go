@@ -0,0 +1,187 @@
+package sim
+
+import (
+	"errors"
+	"math"
+	"syscall"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+	"cse586.kdht/impl"
+)
+
+// run runs a simulation in a synctest bubble, and fails t if it
+// cannot be run.
+func run(t *testing.T, cfg Config) *Report {
+	t.Helper()
+	report, err := Run(cfg, func(f func()) {
+		synctest.Test(t, func(*testing.T) { f() })
+	})
+	if err != nil {
+		t.Fatalf("(simulation failed) %v", err)
+	}
+	return report
+}
+
+func TestSim_Latency(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		latency := 25 * time.Millisecond
+		network := NewNetwork(NetworkConfig{Latency: Constant(latency)})
+		opts := impl.NodeOptions{
+			Transport: network,
+			RoutingTable: func(info *kdht.NodeInfo, k int) (kdht.RoutingTable, error) {
+				return impl.NewKdmRoutingTable(info, k)
+			},
+		}
+
+		node1, err := impl.NewNodeWith(byteToKey(0x10), "node1:4586", 2, 1, nil, opts)
+		if err != nil {
+			t.Fatalf("(node1 creation failed) %v", err)
+		}
+		defer node1.Shutdown()
+		node2, err := impl.NewNodeWith(byteToKey(0x20), "node2:4586", 2, 1, nil, opts)
+		if err != nil {
+			t.Fatalf("(node2 creation failed) %v", err)
+		}
+		defer node2.Shutdown()
+
+		// Connecting takes a round trip, and so does the ping
+		start := time.Now()
+		if err := node1.PingAddress("node2:4586", nil); err != nil {
+			t.Fatalf("(ping failed) %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != 4*latency {
+			t.Fatalf("ping took %v instead of %v", elapsed, 4*latency)
+		}
+
+		start = time.Now()
+		err = node1.PingAddress("node3:4586", nil)
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("ping of a missing node returned %v instead of ECONNREFUSED", err)
+		}
+		if elapsed := time.Since(start); elapsed != 2*latency {
+			t.Fatalf("refused dial took %v instead of %v", elapsed, 2*latency)
+		}
+	})
+}
+
+func TestSim_Stable(t *testing.T) {
+	cfg := Config{
+		NetworkConfig: NetworkConfig{Latency: Uniform{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond}, Seed: 1},
+		Nodes:         100,
+		K:             8,
+		Alpha:         3,
+		Values:        20,
+		Duration:      time.Minute,
+		Interval:      20 * time.Second,
+		Lookups:       50,
+	}
+	report := run(t, cfg)
+	t.Logf("\n%v", report)
+
+	if len(report.Samples) != 4 {
+		t.Fatalf("report had %v samples instead of 4", len(report.Samples))
+	}
+	if rate := report.SuccessRate(); rate < 0.75 {
+		t.Fatalf("lookup success rate was only %.3f", rate)
+	}
+	if hops := report.MeanHops(); hops < 1 || hops > 6 {
+		t.Fatalf("mean hop count was %.2f", hops)
+	}
+}
+
+func TestSim_Churn(t *testing.T) {
+	cfg := Config{
+		NetworkConfig: NetworkConfig{
+			Latency:     Exponential{Min: 5 * time.Millisecond, Mean: 20 * time.Millisecond},
+			Loss:        0.01,
+			LossTimeout: 500 * time.Millisecond,
+			Seed:        2,
+		},
+		Nodes:    100,
+		K:        8,
+		Alpha:    3,
+		Churn:    Churn{Interval: 10 * time.Second, Leave: 5, Join: 2},
+		Values:   20,
+		Duration: time.Minute,
+		Interval: 30 * time.Second,
+		Lookups:  50,
+	}
+	report := run(t, cfg)
+	t.Logf("\n%v", report)
+
+	// Churn at 10s through 50s; churn at 30s follows the sample
+	last := report.Samples[len(report.Samples)-1]
+	if last.Live != 100-5*3 {
+		t.Fatalf("%v nodes were live at the end instead of %v", last.Live, 100-5*3)
+	}
+	if math.IsNaN(report.SuccessRate()) || math.IsNaN(report.Availability()) {
+		t.Fatalf("the report was missing measurements")
+	}
+}
+
+// TestSim_Refresh compares lookups in a network whose nodes refresh
+// their routing tables after joining with one whose nodes do not.  A
+// node that has only looked up its own ID knows little of the buckets
+// far from it, so its lookups take more hops.
+func TestSim_Refresh(t *testing.T) {
+	hops := make(map[bool]float64)
+	for _, refresh := range []bool{false, true} {
+		cfg := Config{
+			NetworkConfig: NetworkConfig{Latency: Constant(10 * time.Millisecond), Seed: 3},
+			Nodes:         200,
+			K:             4,
+			Alpha:         2,
+			Refresh:       refresh,
+			Duration:      time.Second,
+			Lookups:       200,
+		}
+		report := run(t, cfg)
+		hops[refresh] = report.MeanHops()
+		t.Logf("refresh = %v: %.3f hops, success rate %.3f", refresh, hops[refresh], report.SuccessRate())
+		if rate := report.SuccessRate(); rate < 0.95 {
+			t.Fatalf("lookup success rate with refresh = %v was only %.3f", refresh, rate)
+		}
+	}
+
+	if hops[true] >= hops[false] {
+		t.Fatalf("refreshing did not save hops: %v", hops)
+	}
+}
+
+func TestSim_SymbolBits(t *testing.T) {
+	hops := make(map[int]float64)
+	for _, bits := range []int{1, 2, 4} {
+		cfg := Config{
+			NetworkConfig: NetworkConfig{Latency: Constant(10 * time.Millisecond), Seed: 3},
+			Nodes:         200,
+			K:             4,
+			Alpha:         2,
+			SymbolBits:    bits,
+			Refresh:       true,
+			Duration:      time.Second,
+			Lookups:       200,
+		}
+		report := run(t, cfg)
+		hops[bits] = report.MeanHops()
+		t.Logf("b = %v: %.3f hops, success rate %.3f", bits, hops[bits], report.SuccessRate())
+		if rate := report.SuccessRate(); rate < 0.95 {
+			t.Fatalf("lookup success rate with b = %v was only %.3f", bits, rate)
+		}
+	}
+
+	// Each wider symbol saves hops
+	if hops[2] >= hops[1] || hops[4] >= hops[2] {
+		t.Fatalf("hop counts did not fall as b grew: %v", hops)
+	}
+}
+
+func byteToKey(byt byte) keys.Key {
+	b := make([]byte, kdht.KeyBytes)
+	b[0] = byt
+	key, _ := keys.FromBytes(b)
+	return key
+}
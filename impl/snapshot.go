@@ -0,0 +1,197 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package impl
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// RoutingSnapshot is the state of a KdmRoutingTable at one moment, for
+// debugging and monitoring.  It is encoded as JSON by WriteJSON and
+// drawn as a Graphviz graph of the tree of buckets by WriteDOT.
+type RoutingSnapshot struct {
+	// ID is the local node's ID in hexadecimal.
+	ID         string `json:"id"`
+	K          int    `json:"k"`
+	SymbolBits int    `json:"symbol-bits"`
+	// Contacts is the number of nodes in the buckets, not counting
+	// the local node, and Capacity is the number of nodes that the
+	// buckets could hold.  Fill is Contacts / Capacity.
+	Contacts int     `json:"contacts"`
+	Capacity int     `json:"capacity"`
+	Fill     float64 `json:"fill"`
+	// Buckets holds every bucket, farthest level first, with the
+	// bucket holding the local node last.
+	Buckets []BucketSnapshot `json:"buckets"`
+}
+
+// BucketSnapshot is one bucket of a RoutingSnapshot.
+type BucketSnapshot struct {
+	// Index is the number of the bucket as passed to GetNodes,
+	// which is the distance bucket of its nodes.  Several buckets
+	// share an index if the table has more than one bit per
+	// symbol or splits buckets off the local node's path.
+	Index int `json:"index"`
+	// Prefix is the bits shared by the IDs of every node in the
+	// bucket, such as "0110", and Lo and Hi are the lowest and
+	// highest IDs in the bucket's range, in hexadecimal.
+	Prefix string `json:"prefix"`
+	Lo     string `json:"lo"`
+	Hi     string `json:"hi"`
+	// Local is true for the bucket holding the local node.
+	Local        bool              `json:"local,omitempty"`
+	Contacts     []ContactSnapshot `json:"contacts"`
+	Replacements []ContactSnapshot `json:"replacements"`
+}
+
+// ContactSnapshot is one node of a BucketSnapshot.
+type ContactSnapshot struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	// LastSeen is when a message was last received from the node,
+	// and is zero for the local node.
+	LastSeen time.Time `json:"last-seen"`
+	// RTT is the time the node took to answer the last request it
+	// answered, or zero if none has been answered.  It is encoded
+	// in nanoseconds.
+	RTT time.Duration `json:"rtt"`
+	// Failures is the number of requests in a row the node has
+	// failed to answer.
+	Failures int `json:"failures"`
+}
+
+// Snapshot returns the current state of the table.
+func (table *KdmRoutingTable) Snapshot() *RoutingSnapshot {
+	table.mutex.Lock()
+	defer table.mutex.Unlock()
+
+	snap := &RoutingSnapshot{
+		ID:         table.id.String(),
+		K:          table.k,
+		SymbolBits: table.symbol,
+		Capacity:   table.k * len(table.buckets),
+		Buckets:    []BucketSnapshot{},
+	}
+
+	last := len(table.buckets) - 1
+	for idx, b := range table.buckets {
+		bs := BucketSnapshot{
+			Index:        table.bucketNumber(idx),
+			Prefix:       prefixString(b.keys.Lo, b.depth),
+			Lo:           b.keys.Lo.String(),
+			Hi:           b.keys.Hi.String(),
+			Local:        idx == last,
+			Contacts:     table.contactSnapshots(b.nodes),
+			Replacements: table.contactSnapshots(b.cache),
+		}
+		snap.Contacts += len(b.nodes)
+		snap.Buckets = append(snap.Buckets, bs)
+	}
+
+	// The local node takes up room in its bucket, but is not a
+	// contact
+	snap.Contacts--
+	snap.Fill = float64(snap.Contacts) / float64(snap.Capacity)
+	return snap
+}
+
+// contactSnapshots returns the snapshots of nodes.
+func (table *KdmRoutingTable) contactSnapshots(nodes []*kdht.NodeInfo) []ContactSnapshot {
+	snaps := []ContactSnapshot{}
+	for _, node := range nodes {
+		cs := ContactSnapshot{ID: fmt.Sprintf("%x", node.Id), Address: node.Address}
+		id, _ := node.Key()
+		if stats := table.stats[id]; stats != nil {
+			cs.LastSeen = stats.lastSeen
+			cs.RTT = stats.rtt
+			cs.Failures = stats.failures
+		}
+		snaps = append(snaps, cs)
+	}
+	return snaps
+}
+
+// prefixString returns the first n bits of k as a string of 0s and
+// 1s.
+func prefixString(k keys.Key, n int) string {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		sb.WriteByte(byte('0' + k.Bit(k.Bits()-1-i)))
+	}
+	return sb.String()
+}
+
+// WriteJSON writes snap to w as indented JSON.
+func (snap *RoutingSnapshot) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(snap)
+}
+
+// WriteDOT writes snap to w as a Graphviz digraph of the tree of
+// buckets.  Each inner vertex is a prefix of the IDs below it, and
+// each leaf is a bucket labeled with its index and how full it is.
+// The bucket holding the local node is drawn in bold.
+func (snap *RoutingSnapshot) WriteDOT(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "digraph routing {\n")
+	fmt.Fprintf(bw, "\tlabel=%q;\n", fmt.Sprintf("%v k=%v b=%v %v/%v contacts", short(snap.ID), snap.K,
+		snap.SymbolBits, snap.Contacts, snap.Capacity))
+	fmt.Fprintf(bw, "\tnode [shape=point];\n")
+	fmt.Fprintf(bw, "\t\"p\";\n")
+
+	// Every prefix of a bucket's prefix is an inner vertex, and
+	// each is drawn once
+	inner := map[string]bool{"": true}
+	for _, b := range snap.Buckets {
+		for i := 1; i < len(b.Prefix); i++ {
+			if !inner[b.Prefix[:i]] {
+				inner[b.Prefix[:i]] = true
+				fmt.Fprintf(bw, "\t\"p%v\";\n", b.Prefix[:i])
+				fmt.Fprintf(bw, "\t\"p%v\" -> \"p%v\" [label=%q];\n", b.Prefix[:i-1], b.Prefix[:i], b.Prefix[i-1:i])
+			}
+		}
+
+		label := fmt.Sprintf("bucket %v\\n%v*\\n%v/%v", b.Index, b.Prefix, len(b.Contacts), snap.K)
+		if len(b.Replacements) > 0 {
+			label += fmt.Sprintf(" +%v", len(b.Replacements))
+		}
+		style := "solid"
+		if b.Local {
+			style = "bold"
+		}
+		fmt.Fprintf(bw, "\t\"b%v\" [shape=box, style=%v, label=\"%v\"];\n", b.Prefix, style, label)
+		if b.Prefix == "" {
+			fmt.Fprintf(bw, "\t\"p\" -> \"b\";\n")
+		} else {
+			fmt.Fprintf(bw, "\t\"p%v\" -> \"b%v\" [label=%q];\n", b.Prefix[:len(b.Prefix)-1], b.Prefix,
+				b.Prefix[len(b.Prefix)-1:])
+		}
+	}
+	fmt.Fprintf(bw, "}\n")
+	return bw.Flush()
+}
+
+// short returns the first eight characters of an ID, for labels.
+func short(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
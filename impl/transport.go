@@ -0,0 +1,75 @@
+/*
+Copyright 2021, 2023 Ethan Blanton <eblanton@buffalo.edu>
+
+This file is part of a CSE 486/586 project from the University at
+Buffalo.  Distribution of this file or its associated repository
+requires the written permission of Ethan Blanton.  Sharing this file
+may be a violation of academic integrity, please consult the course
+policies for more information.
+*/
+
+package impl
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"cse586.kdht/api/kdht"
+	"cse586.kdht/given/keys"
+)
+
+// Transport is the network over which a node listens for and makes
+// connections.  Nodes use TCPTransport unless another is given in
+// NodeOptions, which allows nodes to run over a simulated or faulty
+// network in tests.
+type Transport interface {
+	// Listen returns a listener for connections to addr.
+	Listen(addr string) (net.Listener, error)
+
+	// DialContext connects to the node listening on addr.  The
+	// dial is abandoned if ctx is cancelled.
+	DialContext(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// NodeOptions holds the optional parameters of NewNodeWith.  Any zero
+// field takes the same default as NewNode.
+type NodeOptions struct {
+	// Transport is the network used by the node.  The default is
+	// TCPTransport.
+	Transport Transport
+
+	// RoutingTable creates the node's routing table.  The default
+	// is NewRoutingTable.
+	RoutingTable func(info *kdht.NodeInfo, k int) (kdht.RoutingTable, error)
+
+	// RequestTimeout bounds how long the node waits for a peer to
+	// answer a request, and how long it waits for the next request
+	// on a connection it is serving.  The default is
+	// requestTimeout.
+	RequestTimeout time.Duration
+
+	// KeySpace is the key space of the node's network, which sets
+	// the width of IDs and keys and the hash that computes the key
+	// of a value.  The node's ID must be in it, and peers whose IDs
+	// are not are refused.  The default is keys.Default.
+	KeySpace *keys.Space
+}
+
+// requestTimeout is the default NodeOptions.RequestTimeout.
+const requestTimeout = 10 * time.Second
+
+// TCPTransport is the Transport used by default, which makes real TCP
+// connections.
+var TCPTransport Transport = tcpTransport{}
+
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen(network, addr)
+}
+
+func (tcpTransport) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, network, addr)
+}